@@ -0,0 +1,71 @@
+/*
+
+Clock abstraction, so time can be controlled in tests.
+
+*/
+
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of sessions and stores: creation and access times, timeouts
+// and periodic tasks such as session cleaners are based on it.
+// Durations of operations (e.g. latency metrics) and network deadlines always use the system time.
+//
+// The default is SystemClock; tests may use a manual fake clock such as the one of the clocktest package.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// Every calls f periodically with the specified interval until stop is called.
+	// stop waits for a call of f in progress to return, and it may be called multiple times.
+	Every(interval time.Duration, f func()) (stop func())
+}
+
+// SystemClock is the Clock using the system time and tickers.
+var SystemClock Clock = systemClock{}
+
+// systemClock is the Clock using the system time and tickers.
+type systemClock struct{}
+
+// Now is to implement Clock.Now().
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Every is to implement Clock.Every().
+func (systemClock) Every(interval time.Duration, f func()) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done, stopped := make(chan struct{}), make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				f()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
+
+// clockOrSystem returns c if it is not nil, else SystemClock.
+func clockOrSystem(c Clock) Clock {
+	if c == nil {
+		return SystemClock
+	}
+	return c
+}
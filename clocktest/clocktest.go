@@ -0,0 +1,113 @@
+/*
+
+Package clocktest provides a manual fake clock for deterministic tests of session timeouts.
+
+Clock implements the session.Clock interface: time only changes when Advance is called,
+and functions registered with Every (e.g. session cleaners of stores) are called synchronously by Advance.
+
+Example:
+
+	clock := clocktest.New(time.Now())
+	st := session.NewInMemStoreOptions(&session.InMemStoreOptions{Clock: clock, SessCleanerInterval: time.Second})
+	sess := session.NewSessionOptions(&session.SessOptions{Clock: clock, Timeout: time.Minute})
+	st.Save(sess)
+	clock.Advance(time.Minute + time.Second) // The session cleaner runs and removes the session
+
+*/
+
+package clocktest
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a manual fake clock.
+// It is safe for concurrent use.
+type Clock struct {
+	mux     sync.Mutex
+	now     time.Time
+	tickers []*ticker
+}
+
+// ticker is a periodic function registered with Clock.Every.
+type ticker struct {
+	interval time.Duration
+	next     time.Time // Time of the next call
+	f        func()
+}
+
+// New returns a new Clock set to now.
+func New(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.now
+}
+
+// Every registers f to be called by Advance periodically with the specified interval,
+// first at interval after the current time of the clock.
+// stop unregisters f; it may be called multiple times.
+func (c *Clock) Every(interval time.Duration, f func()) (stop func()) {
+	if interval <= 0 {
+		panic("clocktest: non-positive interval")
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	t := &ticker{interval: interval, next: c.now.Add(interval), f: f}
+	c.tickers = append(c.tickers, t)
+
+	return func() {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+
+		for i, t2 := range c.tickers {
+			if t2 == t {
+				c.tickers = append(c.tickers[:i], c.tickers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Advance moves the clock forward by d.
+// Registered functions due in the meantime are called in chronological order, in the calling goroutine;
+// while a function is called, the time of the clock is the time it is due.
+func (c *Clock) Advance(d time.Duration) {
+	c.mux.Lock()
+	end := c.now.Add(d)
+	for {
+		var t *ticker
+		for _, t2 := range c.tickers {
+			if !t2.next.After(end) && (t == nil || t2.next.Before(t.next)) {
+				t = t2
+			}
+		}
+		if t == nil {
+			break
+		}
+		c.now = t.next
+		t.next = t.next.Add(t.interval)
+
+		c.mux.Unlock()
+		t.f() // Called without holding the lock, so f may use the clock
+		c.mux.Lock()
+	}
+	c.now = end
+	c.mux.Unlock()
+}
+
+// Tickers returns the number of registered (not stopped) periodic functions.
+func (c *Clock) Tickers() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return len(c.tickers)
+}
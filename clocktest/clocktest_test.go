@@ -0,0 +1,37 @@
+package clocktest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+)
+
+func TestClock(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := New(start)
+	eq(start, c.Now())
+
+	var calls []string
+	stop1 := c.Every(10*time.Second, func() { calls = append(calls, "10s@"+c.Now().Sub(start).String()) })
+	c.Every(25*time.Second, func() { calls = append(calls, "25s@"+c.Now().Sub(start).String()) })
+	eq(2, c.Tickers())
+
+	c.Advance(5 * time.Second)
+	eq(0, len(calls))
+	eq(start.Add(5*time.Second), c.Now())
+
+	c.Advance(25 * time.Second)
+	eq("10s@10s 10s@20s 25s@25s 10s@30s", strings.Join(calls, " "))
+	eq(start.Add(30*time.Second), c.Now())
+
+	stop1()
+	stop1() // Stopping again is a no-op
+	eq(1, c.Tickers())
+	calls = nil
+	c.Advance(time.Minute)
+	eq("25s@50s 25s@1m15s", strings.Join(calls, " "))
+}
@@ -0,0 +1,50 @@
+package cloudstore
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by Cache and DocStore implementations if the requested item or entity does not exist.
+var ErrNotFound = errors.New("cloudstore: not found")
+
+// Cache is a key-value cache with item expiration, the first tier of the store
+// (e.g. memcached, Memorystore or the legacy App Engine Memcache).
+// The cache may lose items at any time.
+// Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the value of the item specified by its key, ErrNotFound if it's not in the cache.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Set stores an item which expires after exp.
+	Set(ctx context.Context, key string, value []byte, exp time.Duration) error
+
+	// Delete deletes an item. Deleting a non-existing item is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// Entity models the session entity saved to the DocStore.
+// The ID of the entity is the session id.
+type Entity struct {
+	Expires time.Time `datastore:"exp" firestore:"exp"`
+	Value   []byte    `datastore:"val" firestore:"val"`
+}
+
+// DocStore is a durable document store, the second tier of the store
+// (e.g. Cloud Datastore or Firestore; documents of a kind are a collection in Firestore).
+// Implementations must be safe for concurrent use.
+type DocStore interface {
+	// Get returns the entity of the specified kind and id, ErrNotFound if it does not exist.
+	Get(ctx context.Context, kind, id string) (*Entity, error)
+
+	// Put stores an entity of the specified kind and id.
+	Put(ctx context.Context, kind, id string, e *Entity) error
+
+	// Delete deletes entities of the specified kind and ids. Deleting non-existing entities is not an error.
+	Delete(ctx context.Context, kind string, ids ...string) error
+
+	// Expired returns the ids of at most limit entities of the specified kind which expire before the specified time.
+	// This requires an index on Entity.Expires.
+	Expired(ctx context.Context, kind string, before time.Time, limit int) ([]string, error)
+}
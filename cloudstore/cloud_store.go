@@ -0,0 +1,405 @@
+/*
+
+Package cloudstore provides a two-tier session store: a Cache in front of a durable DocStore.
+
+It is the successor of the gaestore package which depends on first-generation App Engine APIs.
+The semantics are the same: sessions are looked up in the cache first, and if not found there
+(e.g. because the cache lost them), in the document store. Saved sessions are written to both tiers;
+writing to the document store may happen asynchronously, and may be disabled completely.
+Expired sessions are deleted from the document store by a purge job.
+
+Unlike gaestore, the backends are abstracted over the Cache and DocStore interfaces, so the store
+can run against Cloud Datastore, Firestore, their emulators, or the in-memory MemCache and MemDocStore
+implementations of this package. Also unlike gaestore, the store is not bound to a request,
+a single store is to be created and used for the lifetime of the application.
+
+Since sessions are marshalled into both tiers, a new Session value is returned on each Load().
+
+*/
+
+package cloudstore
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-osin/session"
+	"github.com/go-osin/session/codec"
+)
+
+// Two-tier session Store implementation.
+type cloudStore struct {
+	cache Cache    // First tier, nil if only the DocStore is used
+	docs  DocStore // Second tier, nil if only the Cache is used
+
+	keyPrefix    string      // Prefix to use in front of session ids to construct cache keys
+	retries      int         // Number of retries to perform in case of backend failures
+	codec        codec.Codec // Codec used to marshal and unmarshal a Session to a byte slice
+	asyncDocSave bool        // Tells if saving in the DocStore should happen asynchronously, in a new goroutine
+	entityName   string      // Name of the entity kind to use to save sessions
+
+	purgeMaxDuration time.Duration // Max duration of a purge
+
+	savesMux sync.Mutex     // Mutex to synchronize starting asynchronous saves with Close
+	saves    sync.WaitGroup // Pending asynchronous saves
+	closed   bool           // Tells if the store is closed, after which saves are synchronous
+
+	clock      session.Clock // Clock to decide session timeouts and to run the purge job with
+	stopPurger func()        // Function to stop the purge job, nil if it is disabled
+}
+
+// StoreOptions defines options that may be passed when creating a new two-tier session Store.
+// Cache or DocStore is required; default value will be used for any other field that has the zero value.
+type StoreOptions struct {
+	// Cache to look up and save sessions in first; if nil, only DocStore is used.
+	Cache Cache
+
+	// Document store to save sessions in as backup, in case they would be removed from the cache;
+	// if nil, only Cache is used.
+	DocStore DocStore
+
+	// Prefix to use when storing sessions in the cache; default value is the empty string.
+	// The cache key will be this prefix and the session id concatenated.
+	KeyPrefix string
+
+	// Number of attempts to perform if backend operations fail; default value is 3.
+	Retries int
+
+	// Codec used to marshal and unmarshal a Session to a byte slice;
+	// default value is codec.Gob (attribute types must be registered with gob.Register()).
+	Codec *codec.Codec
+
+	// Tells if saving in the DocStore should happen asynchronously (in a new goroutine, possibly after returning),
+	// if false, saving in the DocStore will happen in the same goroutine, before returning from Save().
+	// Asynchronous saving gives smaller latency (and is enough most of the time as the cache is always checked first);
+	// default value is false. Close() waits for pending asynchronous saves.
+	AsyncDocSave bool
+
+	// Name of the entity kind (collection) to use for saving sessions; default value is "sess_".
+	EntityName string
+
+	// Interval of the background job purging expired sessions from the DocStore; default value is 30 minutes.
+	// Pass a negative value to disable the background job (e.g. if PurgeExpiredSessFunc() is used from a cron job).
+	PurgeInterval time.Duration
+
+	// Max duration of a purge, after which the purge stops even if there are more expired sessions;
+	// default value is 8 minutes.
+	PurgeMaxDuration time.Duration
+
+	// Clock to decide session timeouts (in the DocStore) and to run the purge job with;
+	// default value is session.SystemClock. Expiration of Cache items is up to the Cache
+	// (MemCache has its own Clock).
+	Clock session.Clock
+}
+
+const defaultEntityName = "sess_" // Default value of EntityName.
+
+// purgeBatchSize is the number of sessions to delete in one batch when purging.
+const purgeBatchSize = 100
+
+// NewStoreOptions returns a new, two-tier session Store with the specified options.
+// Unless disabled (or there is no DocStore), the returned Store has a background job purging expired sessions
+// which runs in its own goroutine.
+func NewStoreOptions(o *StoreOptions) session.Store {
+	if o.Cache == nil && o.DocStore == nil {
+		panic("cloudstore: Cache or DocStore is required")
+	}
+	s := &cloudStore{
+		cache:            o.Cache,
+		docs:             o.DocStore,
+		keyPrefix:        o.KeyPrefix,
+		retries:          o.Retries,
+		asyncDocSave:     o.AsyncDocSave,
+		entityName:       o.EntityName,
+		purgeMaxDuration: o.PurgeMaxDuration,
+		clock:            o.Clock,
+	}
+	if s.clock == nil {
+		s.clock = session.SystemClock
+	}
+	if s.retries <= 0 {
+		s.retries = 3
+	}
+	if o.Codec != nil {
+		s.codec = *o.Codec
+	} else {
+		s.codec = codec.Gob
+	}
+	if s.entityName == "" {
+		s.entityName = defaultEntityName
+	}
+	if s.purgeMaxDuration <= 0 {
+		s.purgeMaxDuration = 8 * time.Minute
+	}
+
+	interval := o.PurgeInterval
+	if interval == 0 {
+		interval = 30 * time.Minute
+	}
+	if interval > 0 && s.docs != nil {
+		s.stopPurger = s.clock.Every(interval, func() {
+			if _, err := s.purge(context.Background()); err != nil {
+				log.Printf("Failed to purge expired sessions: %v", err)
+			}
+		})
+	}
+	return s
+}
+
+// retry calls f until it succeeds, returns ErrNotFound, or s.retries attempts are made.
+func (s *cloudStore) retry(f func() error) (err error) {
+	for i := 0; i < s.retries; i++ {
+		if err = f(); err == nil || err == ErrNotFound {
+			return
+		}
+		// Service error? Retry..
+	}
+	return
+}
+
+// Load is to implement Store.Load().
+func (s *cloudStore) Load(id string) session.Session {
+	return s.LoadContext(context.Background(), id)
+}
+
+// LoadContext is to implement session.ContextStore.LoadContext().
+func (s *cloudStore) LoadContext(ctx context.Context, id string) session.Session {
+	var data []byte
+	var err error
+	fromCache := false
+
+	// First check in the cache
+	if s.cache != nil {
+		err = s.retry(func() (err error) {
+			data, err = s.cache.Get(ctx, s.keyPrefix+id)
+			return
+		})
+		if err == nil {
+			fromCache = true
+		} else if err != ErrNotFound {
+			log.Printf("Failed to get session from cache, id: %s, error: %v", id, err)
+		}
+	}
+
+	// Ok, we didn't get it from the cache (either was not there or the cache is unavailable).
+	// Now it's time to check in the DocStore.
+	if !fromCache {
+		if s.docs == nil {
+			return nil
+		}
+		var e *Entity
+		err = s.retry(func() (err error) {
+			e, err = s.docs.Get(ctx, s.entityName, id)
+			return
+		})
+		if err == ErrNotFound {
+			return nil // It's not in the DocStore either
+		}
+		if err != nil {
+			log.Printf("Failed to get session from doc store, id: %s, error: %v", id, err)
+			return nil
+		}
+		if e.Expires.Before(s.clock.Now()) {
+			// Session expired.
+			s.docs.Delete(ctx, s.entityName, id) // Omitting error check...
+			return nil
+		}
+		data = e.Value
+	}
+
+	o, err := session.UnmarshalSession(s.codec, data, id)
+	if err != nil {
+		log.Printf("Failed to unmarshal session, id: %s, error: %v", id, err)
+		return nil
+	}
+
+	// Yes! We have it! "Actualize" it:
+	o.Clock, o.State = s.clock, session.StateLoaded
+	ss := session.NewSessionOptions(o)
+	ss.Access()
+
+	// Extend the expiration due to the access (this also puts it back into the cache if it was loaded from the DocStore).
+	// Like gaestore did, this writes both tiers on each load.
+	if s.cache != nil {
+		s.setCache(ctx, ss.ID(), data, ss.Timeout())
+	}
+	if s.docs != nil {
+		s.saveDoc(ctx, ss.ID(), &Entity{Expires: ss.Accessed().Add(ss.Timeout()), Value: data})
+	}
+	return ss
+}
+
+// setCache sets a marshalled session in the cache.
+func (s *cloudStore) setCache(ctx context.Context, id string, data []byte, timeout time.Duration) bool {
+	err := s.retry(func() error {
+		return s.cache.Set(ctx, s.keyPrefix+id, data, timeout)
+	})
+	if err != nil {
+		log.Printf("Failed to add session to cache, id: %s, error: %v", id, err)
+		return false
+	}
+	return true
+}
+
+// Save is to implement Store.Save().
+func (s *cloudStore) Save(sess session.Session) {
+	s.SaveContext(context.Background(), sess)
+}
+
+// SaveContext is to implement session.ContextStore.SaveContext().
+func (s *cloudStore) SaveContext(ctx context.Context, sess session.Session) {
+	// Marshal the session value itself (its exported fields), holding its read lock:
+	mux := sess.Mutex()
+	mux.RLock()
+	data, err := s.codec.Marshal(sess)
+	mux.RUnlock()
+	if err != nil {
+		log.Printf("Failed to marshal session, id: %s, error: %v", sess.ID(), err)
+		return
+	}
+
+	if s.cache != nil {
+		s.setCache(ctx, sess.ID(), data, sess.Timeout())
+	}
+
+	if s.docs == nil {
+		return // Don't save to DocStore
+	}
+	s.saveDoc(ctx, sess.ID(), &Entity{
+		Expires: sess.Accessed().Add(sess.Timeout()),
+		Value:   data,
+	})
+}
+
+// saveDoc saves a session entity to the DocStore, asynchronously if asyncDocSave is set
+// and the store is not closed (Close does not wait for saves started after it).
+func (s *cloudStore) saveDoc(ctx context.Context, id string, e *Entity) {
+	if s.asyncDocSave {
+		s.savesMux.Lock()
+		if !s.closed {
+			s.saves.Add(1)
+			s.savesMux.Unlock()
+			go func() {
+				defer s.saves.Done()
+				// The request context might be cancelled by the time we get here:
+				s.saveToDocStore(context.Background(), id, e)
+			}()
+			return
+		}
+		s.savesMux.Unlock()
+	}
+	s.saveToDocStore(ctx, id, e)
+}
+
+// saveToDocStore saves a session entity to the DocStore in the caller's goroutine.
+func (s *cloudStore) saveToDocStore(ctx context.Context, id string, e *Entity) {
+	err := s.retry(func() error {
+		return s.docs.Put(ctx, s.entityName, id, e)
+	})
+	if err != nil {
+		log.Printf("Failed to save session to doc store, id: %s, error: %v", id, err)
+	}
+}
+
+// Remove is to implement Store.Remove().
+func (s *cloudStore) Remove(sess session.Session) {
+	s.RemoveContext(context.Background(), sess)
+}
+
+// RemoveContext is to implement session.ContextStore.RemoveContext().
+func (s *cloudStore) RemoveContext(ctx context.Context, sess session.Session) {
+	if s.cache != nil {
+		err := s.retry(func() error {
+			return s.cache.Delete(ctx, s.keyPrefix+sess.ID())
+		})
+		if err != nil {
+			log.Printf("Failed to remove session from cache, id: %s, error: %v", sess.ID(), err)
+		}
+	}
+	if s.docs != nil {
+		err := s.retry(func() error {
+			return s.docs.Delete(ctx, s.entityName, sess.ID())
+		})
+		if err != nil {
+			log.Printf("Failed to remove session from doc store, id: %s, error: %v", sess.ID(), err)
+		}
+	}
+}
+
+// Close is to implement Store.Close().
+// It stops the purge job and waits for pending asynchronous saves.
+// Sessions saved after Close are saved synchronously.
+func (s *cloudStore) Close() {
+	if s.stopPurger != nil {
+		s.stopPurger()
+	}
+	s.savesMux.Lock()
+	s.closed = true
+	s.savesMux.Unlock()
+	s.saves.Wait()
+}
+
+// purge deletes expired sessions from the DocStore in batches until there are no more,
+// or until purgeMaxDuration elapses.
+// Returns true if all expired sessions were deleted.
+func (s *cloudStore) purge(ctx context.Context) (completed bool, err error) {
+	if s.docs == nil {
+		return true, nil
+	}
+	now := s.clock.Now()
+	deadline := time.Now().Add(s.purgeMaxDuration)
+
+	for {
+		var ids []string
+		if err = s.retry(func() (err error) {
+			ids, err = s.docs.Expired(ctx, s.entityName, now, purgeBatchSize)
+			return
+		}); err != nil {
+			return false, err
+		}
+		if len(ids) == 0 {
+			// We're done, no more expired sessions
+			return true, nil
+		}
+
+		if err = s.docs.Delete(ctx, s.entityName, ids...); err != nil {
+			return false, err
+		}
+
+		if time.Now().After(deadline) {
+			// Our time is up, return
+			return false, nil
+		}
+		// We have time to continue
+	}
+}
+
+// PurgeExpiredSessFunc returns a request handler function which deletes expired sessions
+// from the DocStore of the specified store, which must be a store created by this package.
+//
+// It may be registered to a path which then can be called periodically by a cron job, in which case the
+// background purge job of the store may be disabled (see StoreOptions.PurgeInterval).
+// The handler stops after StoreOptions.PurgeMaxDuration even if there are more expired sessions.
+//
+// The response of the handler func is a JSON text telling if the handler was able to delete all expired sessions,
+// or that it was finished early due to the time. Example of a response where all expired sessions were deleted:
+//
+//	{"completed":true}
+func PurgeExpiredSessFunc(st session.Store) http.HandlerFunc {
+	s := st.(*cloudStore)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		completed, err := s.purge(r.Context())
+		if err != nil {
+			log.Printf("Failed to purge expired sessions: %v", err)
+			http.Error(w, "Failed to purge expired sessions!", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"completed":%t}`, completed)
+	}
+}
@@ -0,0 +1,218 @@
+package cloudstore
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+
+	"github.com/go-osin/session"
+	"github.com/go-osin/session/clocktest"
+	"github.com/go-osin/session/sessiontest"
+)
+
+// flakyDocStore is a DocStore which fails the next failNext operations.
+type flakyDocStore struct {
+	MemDocStore
+
+	mux      sync.Mutex
+	failNext int
+}
+
+var errUnavailable = errors.New("unavailable")
+
+func (d *flakyDocStore) fail() error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.failNext > 0 {
+		d.failNext--
+		return errUnavailable
+	}
+	return nil
+}
+
+func (d *flakyDocStore) Get(ctx context.Context, kind, id string) (*Entity, error) {
+	if err := d.fail(); err != nil {
+		return nil, err
+	}
+	return d.MemDocStore.Get(ctx, kind, id)
+}
+
+func (d *flakyDocStore) Put(ctx context.Context, kind, id string, e *Entity) error {
+	if err := d.fail(); err != nil {
+		return err
+	}
+	return d.MemDocStore.Put(ctx, kind, id, e)
+}
+
+func TestCloudStore(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	cache, docs := &MemCache{}, &MemDocStore{}
+	st := NewStoreOptions(&StoreOptions{Cache: cache, DocStore: docs, KeyPrefix: "sess:"})
+	defer st.Close()
+
+	eq(nil, st.Load("asdf"))
+
+	s := session.NewSessionOptions(&session.SessOptions{
+		CAttrs:  map[string]interface{}{"user": "bob"},
+		Timeout: time.Hour,
+	})
+	s.Set("count", 1)
+	st.Save(s)
+
+	_, err := cache.Get(context.Background(), "sess:"+s.ID())
+	eq(nil, err)
+	eq(1, docs.Len(defaultEntityName))
+
+	check := func(s2 session.Session) {
+		neq(nil, s2)
+		eq(s.ID(), s2.ID())
+		eq("bob", s2.Getp("user"))
+		eq(1, s2.Get("count"))
+		eq(time.Hour, s2.Timeout())
+		eq(s.Created().UnixNano(), s2.Created().UnixNano())
+	}
+	check(st.Load(s.ID()))
+
+	// Cache loses the session, it is loaded from the DocStore and put back into the cache:
+	cache.Flush()
+	check(st.Load(s.ID()))
+	_, err = cache.Get(context.Background(), "sess:"+s.ID())
+	eq(nil, err)
+
+	st.Remove(s)
+	eq(nil, st.Load(s.ID()))
+	eq(0, docs.Len(defaultEntityName))
+}
+
+func TestCloudStoreSingleTier(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	cache := &MemCache{}
+	st := NewStoreOptions(&StoreOptions{Cache: cache})
+	s := session.NewSession()
+	st.Save(s)
+	eq(s.ID(), st.Load(s.ID()).ID())
+	cache.Flush()
+	eq(nil, st.Load(s.ID()))
+	st.Close()
+
+	docs := &MemDocStore{}
+	st = NewStoreOptions(&StoreOptions{DocStore: docs, EntityName: "mysess"})
+	defer st.Close()
+	st.Save(s)
+	eq(1, docs.Len("mysess"))
+	eq(s.ID(), st.Load(s.ID()).ID())
+}
+
+func TestCloudStoreAsyncDocSave(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	docs := &MemDocStore{}
+	st := NewStoreOptions(&StoreOptions{Cache: &MemCache{}, DocStore: docs, AsyncDocSave: true})
+	for i := 0; i < 10; i++ {
+		st.Save(session.NewSession())
+	}
+	st.Close() // Waits for pending saves
+	eq(10, docs.Len(defaultEntityName))
+
+	// Saves concurrent with and after Close:
+	docs = &MemDocStore{}
+	st = NewStoreOptions(&StoreOptions{DocStore: docs, AsyncDocSave: true})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st.Save(session.NewSession())
+		}()
+	}
+	st.Close()
+	wg.Wait()
+	st.Save(session.NewSession()) // Saved synchronously
+	eq(11, docs.Len(defaultEntityName))
+}
+
+func TestCloudStoreRetries(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	docs := &flakyDocStore{}
+	st := NewStoreOptions(&StoreOptions{DocStore: docs, Retries: 3})
+	defer st.Close()
+
+	s := session.NewSession()
+	docs.failNext = 2
+	st.Save(s)
+	eq(1, docs.Len(defaultEntityName))
+
+	docs.failNext = 3
+	eq(nil, st.Load(s.ID()))
+	eq(s.ID(), st.Load(s.ID()).ID())
+}
+
+func TestCloudStoreExpired(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	clock := clocktest.New(time.Now())
+	docs := &MemDocStore{}
+	st := NewStoreOptions(&StoreOptions{DocStore: docs, PurgeInterval: -1, Clock: clock})
+	defer st.Close()
+
+	s := session.NewSessionOptions(&session.SessOptions{Timeout: 10 * time.Millisecond, Clock: clock})
+	st.Save(s)
+	clock.Advance(20 * time.Millisecond)
+	eq(nil, st.Load(s.ID()))
+	eq(0, docs.Len(defaultEntityName))
+}
+
+func TestPurgeExpiredSessFunc(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	clock := clocktest.New(time.Now())
+	docs := &MemDocStore{}
+	st := NewStoreOptions(&StoreOptions{DocStore: docs, PurgeInterval: -1, Clock: clock})
+	defer st.Close()
+
+	for i := 0; i < purgeBatchSize+5; i++ {
+		st.Save(session.NewSessionOptions(&session.SessOptions{Timeout: 10 * time.Millisecond, Clock: clock}))
+	}
+	live := session.NewSessionOptions(&session.SessOptions{Timeout: time.Hour, Clock: clock})
+	st.Save(live)
+	clock.Advance(20 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	PurgeExpiredSessFunc(st)(rec, httptest.NewRequest("GET", "/purge", nil))
+	eq(`{"completed":true}`, rec.Body.String())
+	eq(1, docs.Len(defaultEntityName))
+	eq(live.ID(), st.Load(live.ID()).ID())
+}
+
+func TestCloudStorePurger(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	clock := clocktest.New(time.Now())
+	docs := &MemDocStore{}
+	st := NewStoreOptions(&StoreOptions{DocStore: docs, PurgeInterval: 10 * time.Millisecond, Clock: clock})
+	defer st.Close()
+
+	st.Save(session.NewSessionOptions(&session.SessOptions{Timeout: 10 * time.Millisecond, Clock: clock}))
+	clock.Advance(50 * time.Millisecond)
+	eq(0, docs.Len(defaultEntityName))
+}
+
+func TestCloudStoreConformance(t *testing.T) {
+	clock := clocktest.New(time.Now())
+	sessiontest.Run(t, &sessiontest.Options{
+		NewStore: func(t *testing.T) session.Store {
+			return NewStoreOptions(&StoreOptions{Cache: &MemCache{Clock: clock}, DocStore: &MemDocStore{}, PurgeInterval: 10 * time.Millisecond, Clock: clock})
+		},
+		Timeout:     400 * time.Millisecond,
+		ExpiryDelay: 50 * time.Millisecond,
+		Clock:       clock,
+	})
+}
@@ -0,0 +1,156 @@
+package cloudstore
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-osin/session"
+)
+
+// MemCache is an in-memory Cache implementation, to be used in tests and local development.
+// The zero value is ready to use.
+type MemCache struct {
+	// Clock to expire items by; nil means session.SystemClock.
+	Clock session.Clock
+
+	mux   sync.Mutex
+	items map[string]memCacheItem
+}
+
+type memCacheItem struct {
+	value   []byte
+	expires time.Time // Zero means no expiration
+}
+
+// now returns the current time of the clock of the cache.
+func (c *MemCache) now() time.Time {
+	if c.Clock == nil {
+		return session.SystemClock.Now()
+	}
+	return c.Clock.Now()
+}
+
+// Get is to implement Cache.Get().
+func (c *MemCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	item, ok := c.items[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !item.expires.IsZero() && c.now().After(item.expires) {
+		delete(c.items, key)
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), item.value...), nil
+}
+
+// Set is to implement Cache.Set().
+func (c *MemCache) Set(ctx context.Context, key string, value []byte, exp time.Duration) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.items == nil {
+		c.items = make(map[string]memCacheItem)
+	}
+	item := memCacheItem{value: append([]byte(nil), value...)}
+	if exp > 0 {
+		item.expires = c.now().Add(exp)
+	}
+	c.items[key] = item
+	return nil
+}
+
+// Delete is to implement Cache.Delete().
+func (c *MemCache) Delete(ctx context.Context, key string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	delete(c.items, key)
+	return nil
+}
+
+// Flush removes all items from the cache, simulating the cache losing its content.
+func (c *MemCache) Flush() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.items = nil
+}
+
+// MemDocStore is an in-memory DocStore implementation, to be used in tests and local development.
+// The zero value is ready to use.
+type MemDocStore struct {
+	mux   sync.Mutex
+	kinds map[string]map[string]Entity
+}
+
+// Get is to implement DocStore.Get().
+func (d *MemDocStore) Get(ctx context.Context, kind, id string) (*Entity, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	e, ok := d.kinds[kind][id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	e.Value = append([]byte(nil), e.Value...)
+	return &e, nil
+}
+
+// Put is to implement DocStore.Put().
+func (d *MemDocStore) Put(ctx context.Context, kind, id string, e *Entity) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if d.kinds == nil {
+		d.kinds = make(map[string]map[string]Entity)
+	}
+	if d.kinds[kind] == nil {
+		d.kinds[kind] = make(map[string]Entity)
+	}
+	d.kinds[kind][id] = Entity{Expires: e.Expires, Value: append([]byte(nil), e.Value...)}
+	return nil
+}
+
+// Delete is to implement DocStore.Delete().
+func (d *MemDocStore) Delete(ctx context.Context, kind string, ids ...string) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	for _, id := range ids {
+		delete(d.kinds[kind], id)
+	}
+	return nil
+}
+
+// Expired is to implement DocStore.Expired().
+// Returned ids are ordered by expiration time.
+func (d *MemDocStore) Expired(ctx context.Context, kind string, before time.Time, limit int) ([]string, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	var ids []string
+	for id, e := range d.kinds[kind] {
+		if e.Expires.Before(before) {
+			ids = append(ids, id)
+		}
+	}
+	entities := d.kinds[kind]
+	sort.Slice(ids, func(i, j int) bool { return entities[ids[i]].Expires.Before(entities[ids[j]].Expires) })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
+}
+
+// Len returns the number of entities of the specified kind.
+func (d *MemDocStore) Len(kind string) int {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	return len(d.kinds[kind])
+}
@@ -0,0 +1,368 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// CBOR is a Codec that uses the CBOR format (RFC 8949).
+//
+// Unlike JSON, integers decode into integers and times keep their nanoseconds (they are encoded
+// as RFC 3339 strings with tag 0, and keep their offset). Values of types other than
+// nil, bool, int, float64, string, []byte, time.Time, []interface{} and map[string]interface{} stored
+// in interfaces (e.g. session attributes) are encoded with a type hint so they decode into the same type;
+// their types must be registered with RegisterType. Type hints use tag 27 (object with type name)
+// on an array of the type name and the value.
+// Structs are encoded as maps of their exported fields (keyed by their json names if tagged),
+// so payloads are readable from other languages.
+var CBOR = Codec{Marshal: cborMarshal, Unmarshal: cborUnmarshal}
+
+// CBOR major types.
+const (
+	cborUint = iota
+	cborNegInt
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+// CBOR tags.
+const (
+	cborTagTime      = 0  // RFC 3339 date/time string
+	cborTagEpochTime = 1  // Epoch-based date/time
+	cborTagHinted    = 27 // Serialised object with type name and constructor arguments
+)
+
+// cborIndefinite is the additional information of indefinite length items.
+const cborIndefinite = 31
+
+func cborMarshal(v interface{}) ([]byte, error) {
+	e := &cborEncoder{}
+	if err := encodeValue(e, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func cborUnmarshal(data []byte, v interface{}) error {
+	d := &cborDecoder{data: data}
+	src, err := d.value(0)
+	if err != nil {
+		return err
+	}
+	if d.pos != len(data) {
+		return errors.New("codec: trailing data after CBOR value")
+	}
+	return decodeInto(v, src)
+}
+
+// cborEncoder encodes values in the CBOR format.
+type cborEncoder struct {
+	buf []byte
+}
+
+// encodeHead encodes the head of a data item: its major type and argument.
+func (e *cborEncoder) encodeHead(major byte, arg uint64) {
+	major <<= 5
+	switch {
+	case arg < 24:
+		e.buf = append(e.buf, major|byte(arg))
+	case arg <= math.MaxUint8:
+		e.buf = append(e.buf, major|24, byte(arg))
+	case arg <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, major|25), uint16(arg))
+	case arg <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, major|26), uint32(arg))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, major|27), arg)
+	}
+}
+
+func (e *cborEncoder) encodeNil() { e.buf = append(e.buf, 0xf6) }
+
+func (e *cborEncoder) encodeBool(b bool) {
+	if b {
+		e.buf = append(e.buf, 0xf5)
+	} else {
+		e.buf = append(e.buf, 0xf4)
+	}
+}
+
+func (e *cborEncoder) encodeInt(i int64) {
+	if i >= 0 {
+		e.encodeHead(cborUint, uint64(i))
+	} else {
+		e.encodeHead(cborNegInt, uint64(^i)) // -1 - i
+	}
+}
+
+func (e *cborEncoder) encodeUint(u uint64) { e.encodeHead(cborUint, u) }
+
+func (e *cborEncoder) encodeFloat(f float64, bits int) {
+	if bits == 32 {
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xfa), math.Float32bits(float32(f)))
+		return
+	}
+	e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xfb), math.Float64bits(f))
+}
+
+func (e *cborEncoder) encodeString(s string) {
+	e.encodeHead(cborText, uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *cborEncoder) encodeBytes(b []byte) {
+	e.encodeHead(cborBytes, uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *cborEncoder) encodeArrayLen(n int) { e.encodeHead(cborArray, uint64(n)) }
+
+func (e *cborEncoder) encodeMapLen(n int) { e.encodeHead(cborMap, uint64(n)) }
+
+func (e *cborEncoder) encodeTime(t time.Time) {
+	e.encodeHead(cborTag, cborTagTime)
+	e.encodeString(t.Format(time.RFC3339Nano))
+}
+
+func (e *cborEncoder) encodeHinted(name string, value func(e encoder) error) error {
+	e.encodeHead(cborTag, cborTagHinted)
+	e.encodeArrayLen(2)
+	e.encodeString(name)
+	return value(e)
+}
+
+// errCBORShort is returned when CBOR data ends unexpectedly.
+var errCBORShort = errors.New("codec: unexpected end of CBOR data")
+
+// errCBORBreak is returned by value when it reads the "break" stop code of indefinite length items.
+var errCBORBreak = errors.New("codec: unexpected CBOR break")
+
+// cborDecoder decodes CBOR data.
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// read returns the next n bytes.
+func (d *cborDecoder) read(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errCBORShort
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// head decodes the head of a data item: its major type, additional information and argument.
+func (d *cborDecoder) head() (major, info byte, arg uint64, err error) {
+	b, err := d.read(1)
+	if err != nil {
+		return
+	}
+	major, info = b[0]>>5, b[0]&0x1f
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		if b, err = d.read(1 << (info - 24)); err != nil {
+			return
+		}
+		for _, c := range b {
+			arg = arg<<8 | uint64(c)
+		}
+	case info == cborIndefinite:
+		// Indefinite length or break
+	default:
+		err = fmt.Errorf("codec: invalid CBOR additional information: %d", info)
+	}
+	return
+}
+
+// value decodes the next value; depth is the nesting depth of the value.
+func (d *cborDecoder) value(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errMaxDepth
+	}
+	major, info, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if info == cborIndefinite && (major == cborUint || major == cborNegInt || major == cborTag) {
+		return nil, fmt.Errorf("codec: invalid indefinite length CBOR major type: %d", major)
+	}
+
+	switch major {
+	case cborUint:
+		if arg > math.MaxInt64 {
+			return arg, nil
+		}
+		return int64(arg), nil
+	case cborNegInt:
+		if arg > math.MaxInt64 {
+			return nil, fmt.Errorf("codec: CBOR integer overflows int64: -1-%d", arg)
+		}
+		return -1 - int64(arg), nil
+	case cborBytes, cborText:
+		var b []byte
+		if info == cborIndefinite {
+			// Concatenation of definite length chunks of the same major type
+			for {
+				chunk, err := d.value(depth + 1)
+				if err == errCBORBreak {
+					break
+				}
+				if err != nil {
+					return nil, err
+				}
+				switch c := chunk.(type) {
+				case []byte:
+					if major != cborBytes {
+						return nil, errors.New("codec: invalid CBOR string chunk")
+					}
+					b = append(b, c...)
+				case string:
+					if major != cborText {
+						return nil, errors.New("codec: invalid CBOR string chunk")
+					}
+					b = append(b, c...)
+				default:
+					return nil, errors.New("codec: invalid CBOR string chunk")
+				}
+			}
+		} else {
+			if b, err = d.read(arg); err != nil {
+				return nil, err
+			}
+		}
+		if major == cborText {
+			return string(b), nil
+		}
+		return append([]byte{}, b...), nil
+	case cborArray:
+		if info != cborIndefinite && arg > uint64(len(d.data)-d.pos) {
+			return nil, errCBORShort // Each element takes at least 1 byte
+		}
+		var a []interface{}
+		for i := uint64(0); info == cborIndefinite || i < arg; i++ {
+			v, err := d.value(depth + 1)
+			if err == errCBORBreak && info == cborIndefinite {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		if a == nil {
+			a = []interface{}{}
+		}
+		return a, nil
+	case cborMap:
+		if info != cborIndefinite && arg > uint64(len(d.data)-d.pos)/2 {
+			return nil, errCBORShort // Each pair takes at least 2 bytes
+		}
+		m := rawMap{}
+		for i := uint64(0); info == cborIndefinite || i < arg; i++ {
+			k, err := d.value(depth + 1)
+			if err == errCBORBreak && info == cborIndefinite {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, mapEntry{k, v})
+		}
+		return m, nil
+	case cborTag:
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return cborTagged(arg, v)
+	}
+
+	// Major type 7: simple values and floats
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23: // null, undefined
+		return nil, nil
+	case 25:
+		return halfToFloat(uint16(arg)), nil
+	case 26:
+		return float64(math.Float32frombits(uint32(arg))), nil
+	case 27:
+		return math.Float64frombits(arg), nil
+	case cborIndefinite:
+		return nil, errCBORBreak
+	}
+	return nil, fmt.Errorf("codec: unsupported CBOR simple value: %d", info)
+}
+
+// cborTagged returns the value of tagged data item v.
+// Unknown tags are ignored (v is returned).
+func cborTagged(tag uint64, v interface{}) (interface{}, error) {
+	switch tag {
+	case cborTagTime:
+		s, ok := v.(string)
+		if !ok {
+			return nil, errors.New("codec: invalid CBOR date/time string")
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	case cborTagEpochTime:
+		switch t := v.(type) {
+		case int64:
+			return time.Unix(t, 0), nil
+		case uint64:
+			return nil, errors.New("codec: CBOR epoch time out of range")
+		case float64:
+			sec, frac := math.Modf(t)
+			return time.Unix(int64(sec), int64(frac*1e9)), nil
+		}
+		return nil, errors.New("codec: invalid CBOR epoch time")
+	case cborTagHinted:
+		if a, ok := v.([]interface{}); ok && len(a) == 2 {
+			if name, ok := a[0].(string); ok {
+				return hinted{name, a[1]}, nil
+			}
+		}
+		return nil, errors.New("codec: invalid CBOR type hint")
+	}
+	return v, nil
+}
+
+// halfToFloat converts an IEEE 754 half-precision float to float64.
+func halfToFloat(h uint16) float64 {
+	exp, mant := int(h>>10&0x1f), float64(h&0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
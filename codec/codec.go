@@ -8,15 +8,19 @@ import (
 
 var (
 	// Gob is a Codec that uses the gob package.
-	Gob = Codec{gobMarshal, gobUnmarshal}
+	Gob = Codec{Marshal: gobMarshal, Unmarshal: gobUnmarshal}
 	// JSON is a Codec that uses the json package.
-	JSON = Codec{json.Marshal, json.Unmarshal}
+	JSON = Codec{Marshal: json.Marshal, Unmarshal: json.Unmarshal}
 )
 
 // Codec a codec
 type Codec struct {
 	Marshal   func(interface{}) ([]byte, error)
 	Unmarshal func([]byte, interface{}) error
+
+	// UnmarshalID is like Unmarshal, but for the payload of the session specified by its id;
+	// codecs binding payloads to session IDs (see Encrypt) check it. Optional, may be nil.
+	UnmarshalID func(data []byte, id string, v interface{}) error
 }
 
 func gobMarshal(v interface{}) ([]byte, error) {
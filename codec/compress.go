@@ -0,0 +1,166 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Flags of compressed payloads.
+const (
+	flagGzip flags = 1 << iota
+	flagFlate
+
+	flagsCompressed = flagGzip | flagFlate
+)
+
+// Algorithm is a compression algorithm.
+type Algorithm int
+
+// Compression algorithms.
+const (
+	// Gzip compresses with the gzip format (compress/gzip).
+	Gzip Algorithm = iota
+
+	// Flate compresses with the raw DEFLATE format (compress/flate);
+	// it has less overhead than Gzip (no header and checksum).
+	Flate
+)
+
+// CompressOptions defines options that may be passed when creating a new compressing Codec.
+// All fields are optional; default value will be used for any field that has the zero value.
+type CompressOptions struct {
+	// Compression algorithm; default value is Gzip.
+	Algorithm Algorithm
+
+	// Compression level, see the constants of the compress/flate package;
+	// default value is 0 which means flate.DefaultCompression (flate.NoCompression is not supported).
+	Level int
+
+	// Payloads smaller than this many bytes are not compressed; default value is 1024.
+	Threshold int
+}
+
+// Compress returns a Codec which compresses payloads marshalled by c that are at least as big as the threshold.
+// o may be nil, in which case default options are used (see CompressOptions).
+//
+// Compressed payloads are wrapped in an envelope (see Envelope) with a flag telling the algorithm;
+// if c produces enveloped payloads, the flag is added to their envelope.
+// Payloads below the threshold (or which would not get smaller) are left as c produced them,
+// so Unmarshal also reads uncompressed payloads written before compression was enabled.
+// Unmarshal decompresses payloads of any algorithm, regardless of the algorithm used for writing.
+func Compress(c Codec, o *CompressOptions) Codec {
+	if o == nil {
+		o = &CompressOptions{}
+	}
+	alg, level, threshold := o.Algorithm, o.Level, o.Threshold
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	if threshold <= 0 {
+		threshold = 1024
+	}
+
+	// unmarshal decompresses data if needed, and unmarshals it with inner.
+	unmarshal := func(data []byte, v interface{}, inner func([]byte, interface{}) error) error {
+		h, payload, ok := parseHeader(data)
+		if !ok || h.flags&flagsCompressed == 0 {
+			return inner(data, v)
+		}
+		payload, err := decompress(h.flags, payload)
+		if err != nil {
+			return err
+		}
+		h.flags &^= flagsCompressed
+		if h.codec == 0 && h.flags == 0 {
+			// c does not produce enveloped payloads
+			return inner(payload, v)
+		}
+		return inner(h.bytes(payload), v)
+	}
+
+	cc := Codec{
+		Marshal: func(v interface{}) ([]byte, error) {
+			data, err := c.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			h, payload, ok := parseHeader(data)
+			if !ok {
+				h, payload = header{version: Version}, data
+			}
+			if len(payload) < threshold {
+				return data, nil
+			}
+			compressed, flag, err := compress(alg, level, payload)
+			if err != nil {
+				return nil, err
+			}
+			if len(compressed) >= len(payload) {
+				return data, nil
+			}
+			h.flags |= flag
+			return h.bytes(compressed), nil
+		},
+		Unmarshal: func(data []byte, v interface{}) error {
+			return unmarshal(data, v, c.Unmarshal)
+		},
+	}
+	if c.UnmarshalID != nil {
+		cc.UnmarshalID = func(data []byte, id string, v interface{}) error {
+			return unmarshal(data, v, func(data []byte, v interface{}) error {
+				return c.UnmarshalID(data, id, v)
+			})
+		}
+	}
+	return cc
+}
+
+// compress compresses data with the specified algorithm and level, and returns the flag of the algorithm.
+func compress(alg Algorithm, level int, data []byte) ([]byte, flags, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var flag flags
+	var err error
+	switch alg {
+	case Gzip:
+		w, err = gzip.NewWriterLevel(&buf, level)
+		flag = flagGzip
+	case Flate:
+		w, err = flate.NewWriter(&buf, level)
+		flag = flagFlate
+	default:
+		err = fmt.Errorf("codec: unknown compression algorithm: %d", alg)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, 0, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), flag, nil
+}
+
+// decompress decompresses data compressed with the algorithm specified by f.
+func decompress(f flags, data []byte) ([]byte, error) {
+	var r io.ReadCloser
+	switch f & flagsCompressed {
+	case flagGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	case flagFlate:
+		r = flate.NewReader(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("codec: invalid compression flags: %#x", f)
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
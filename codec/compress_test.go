@@ -0,0 +1,53 @@
+package codec
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/icza/mighty"
+)
+
+func TestCompress(t *testing.T) {
+	eq := mighty.Eq(t)
+	deq := mighty.Deq(t)
+
+	small := &testSess{IDF: "id1", AttrsF: map[string]interface{}{"a": "x"}}
+	large := &testSess{IDF: "id2", AttrsF: map[string]interface{}{"a": strings.Repeat("cart item ", 1000)}}
+
+	for _, inner := range []Codec{JSON, Envelope(IDJSON, nil)} {
+		for _, alg := range []Algorithm{Gzip, Flate} {
+			c := Compress(inner, &CompressOptions{Algorithm: alg, Threshold: 100})
+
+			// Small payloads are left alone:
+			data, err := c.Marshal(small)
+			eq(nil, err)
+			plain, err := inner.Marshal(small)
+			eq(nil, err)
+			eq(string(plain), string(data))
+
+			data, err = c.Marshal(large)
+			eq(nil, err)
+			plain, err = inner.Marshal(large)
+			eq(nil, err)
+			eq(true, len(data) < len(plain)/10)
+			eq(byte(magic), data[0])
+			eq(true, flags(data[3])&flagsCompressed != 0)
+
+			var out testSess
+			eq(nil, c.Unmarshal(data, &out))
+			deq(large, &out)
+
+			// Uncompressed payloads can be read (written before enabling compression):
+			out = testSess{}
+			eq(nil, c.Unmarshal(plain, &out))
+			deq(large, &out)
+
+			// Any algorithm can be read:
+			data, err = Compress(inner, &CompressOptions{Algorithm: 1 - alg}).Marshal(large)
+			eq(nil, err)
+			out = testSess{}
+			eq(nil, c.Unmarshal(data, &out))
+			deq(large, &out)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package codec
+
+import (
+	"encoding/gob"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Properties checked by Check.
+const (
+	PropSessionFields   = "session fields"     // ID, creation and access times, timeout
+	PropTimeNanos       = "time nanoseconds"   // Session times keep their nanoseconds
+	PropStrings         = "strings"            // String attributes
+	PropUnicode         = "unicode"            // Unicode attribute names and values
+	PropLargeValues     = "large values"       // A 1 MB attribute value
+	PropBool            = "bool"               // Bool attributes
+	PropInt             = "int"                // Int attributes stay int
+	PropSizedInts       = "sized ints"         // int8..int64, uint8..uint64 attributes keep their types and extreme values
+	PropFloat64         = "float64"            // Float64 attributes
+	PropFloat32         = "float32"            // Float32 attributes stay float32
+	PropBytes           = "bytes"              // []byte attributes
+	PropTime            = "time"               // time.Time attributes (the same instant)
+	PropDuration        = "duration"           // time.Duration attributes stay time.Duration
+	PropTypedSlices     = "typed slices"       // []string and []int attributes keep their types
+	PropTypedMaps       = "typed maps"         // map[string]string attributes keep their type
+	PropNested          = "nested"             // []interface{} and map[string]interface{} attributes
+	PropStructs         = "structs"            // Registered struct attributes keep their types
+	PropNilValues       = "nil values"         // Attributes with nil value are kept
+	PropNilMaps         = "nil maps"           // nil attribute maps stay nil
+	PropEmptyMaps       = "empty maps"         // Empty attribute maps stay empty (non-nil)
+	PropUnregisteredErr = "unregistered error" // Marshaling unregistered struct attributes fails
+)
+
+// ConformItem is a struct type used by Check as an attribute value.
+// Its pointer type is registered with gob and RegisterType as "codec.ConformItem" when Check is first called
+// (so programs not calling Check don't have it registered).
+type ConformItem struct {
+	Name  string
+	Count int
+}
+
+// registerConformItem is used to register ConformItem once.
+var registerConformItem sync.Once
+
+// conformSess has the same marshalled form as the sessions of the session package.
+type conformSess struct {
+	IDF       string                 `json:"id"`
+	CreatedF  time.Time              `json:"created"`
+	AccessedF time.Time              `json:"accessed"`
+	CAttrsF   map[string]interface{} `json:"cattrs"`
+	AttrsF    map[string]interface{} `json:"attrs"`
+	TimeoutF  time.Duration          `json:"timeout"`
+}
+
+// ID returns the ID of the session, used by Encrypt.
+func (s *conformSess) ID() string { return s.IDF }
+
+// conformCase is a session round-tripped to check a property.
+type conformCase struct {
+	name  string
+	attrs map[string]interface{}
+	// check reports if the property is preserved; default is deep equality of the attributes.
+	check func(in, out *conformSess) bool
+}
+
+var conformTime = time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)
+
+var conformCases = []conformCase{
+	{name: PropSessionFields, attrs: map[string]interface{}{"a": "b"}, check: func(in, out *conformSess) bool {
+		return in.IDF == out.IDF && in.CreatedF.Unix() == out.CreatedF.Unix() &&
+			in.AccessedF.Unix() == out.AccessedF.Unix() && in.TimeoutF == out.TimeoutF
+	}},
+	{name: PropTimeNanos, attrs: map[string]interface{}{"a": "b"}, check: func(in, out *conformSess) bool {
+		return in.CreatedF.Equal(out.CreatedF) && in.AccessedF.Equal(out.AccessedF)
+	}},
+	{name: PropStrings, attrs: map[string]interface{}{"s": "value", "empty": ""}},
+	{name: PropUnicode, attrs: map[string]interface{}{"ключ": "значение", "键 ✓": "值 🙂", "a\x00b": "c\td"}},
+	{name: PropLargeValues, attrs: map[string]interface{}{"large": strings.Repeat("0123456789abcdef", 1<<16)}},
+	{name: PropBool, attrs: map[string]interface{}{"t": true, "f": false}},
+	{name: PropInt, attrs: map[string]interface{}{"i": 1, "neg": -100000, "max": math.MaxInt}},
+	{name: PropSizedInts, attrs: map[string]interface{}{
+		"int8": int8(math.MinInt8), "int16": int16(math.MinInt16), "int32": int32(math.MinInt32), "int64": int64(math.MinInt64),
+		"uint8": uint8(math.MaxUint8), "uint16": uint16(math.MaxUint16), "uint32": uint32(math.MaxUint32), "uint64": uint64(math.MaxUint64),
+	}},
+	{name: PropFloat64, attrs: map[string]interface{}{"f": 1.1, "tiny": math.SmallestNonzeroFloat64, "neg": -1e300}},
+	{name: PropFloat32, attrs: map[string]interface{}{"f": float32(2.5)}},
+	{name: PropBytes, attrs: map[string]interface{}{"b": []byte{0, 1, 0xff}}},
+	{name: PropTime, attrs: map[string]interface{}{"t": conformTime}, check: func(in, out *conformSess) bool {
+		t, ok := out.AttrsF["t"].(time.Time)
+		return ok && t.Equal(conformTime)
+	}},
+	{name: PropDuration, attrs: map[string]interface{}{"d": time.Minute}},
+	{name: PropTypedSlices, attrs: map[string]interface{}{"strs": []string{"a", "b"}, "ints": []int{1, 2}}},
+	{name: PropTypedMaps, attrs: map[string]interface{}{"m": map[string]string{"a": "b"}}},
+	{name: PropNested, attrs: map[string]interface{}{
+		"list": []interface{}{"a", true, []interface{}{"b"}},
+		"map":  map[string]interface{}{"a": "b", "m": map[string]interface{}{"c": false}},
+	}},
+	{name: PropStructs, attrs: map[string]interface{}{"item": &ConformItem{Name: "x", Count: 2}}},
+	{name: PropNilValues, attrs: map[string]interface{}{"nil": nil, "a": "b"}},
+	{name: PropNilMaps, attrs: nil, check: func(in, out *conformSess) bool {
+		return out.AttrsF == nil && out.CAttrsF == nil
+	}},
+	{name: PropEmptyMaps, attrs: map[string]interface{}{}, check: func(in, out *conformSess) bool {
+		return out.AttrsF != nil && len(out.AttrsF) == 0
+	}},
+}
+
+// Property is a property of a codec checked by Check.
+type Property struct {
+	Name      string // Name of the property, one of the Prop constants
+	Preserved bool   // Tells if the codec preserves the property
+	Err       error  // Error marshaling or unmarshaling the session, if any
+}
+
+// Report is the result of Check.
+type Report struct {
+	Properties []Property // Checked properties, in the order of the Prop constants
+}
+
+// Preserved tells if the property with the given name is preserved.
+func (r *Report) Preserved(name string) bool {
+	for _, p := range r.Properties {
+		if p.Name == name {
+			return p.Preserved
+		}
+	}
+	return false
+}
+
+// String returns a human readable form of the report, one property per line.
+func (r *Report) String() string {
+	var sb strings.Builder
+	for _, p := range r.Properties {
+		fmt.Fprintf(&sb, "%-20s %t", p.Name, p.Preserved)
+		if p.Err != nil {
+			fmt.Fprintf(&sb, " (%v)", p.Err)
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// Check is a conformance helper that round-trips sessions through c, and reports which properties
+// (listed by the Prop constants) c preserves.
+// Sessions have the same marshalled form as the sessions of the session package,
+// with diverse attribute types, nil and empty maps, unicode names and large values.
+//
+// Check registers no types (except ConformItem), so codecs requiring type registration (e.g. Gob)
+// don't preserve attributes of types not registered by you (e.g. with session.RegisterType) or by the codec.
+//
+// Check is useful in tests of custom codecs and codec wrappers, e.g.:
+//
+//	r := codec.Check(myCodec)
+//	if !r.Preserved(codec.PropTime) {
+//		t.Errorf("time attributes not preserved:\n%s", r)
+//	}
+func Check(c Codec) *Report {
+	registerConformItem.Do(func() {
+		gob.RegisterName("codec.ConformItem", &ConformItem{})
+		RegisterType("codec.ConformItem", &ConformItem{})
+	})
+
+	r := &Report{}
+	for _, cc := range conformCases {
+		p := Property{Name: cc.name}
+		in := &conformSess{
+			IDF:       "conform-id",
+			CreatedF:  conformTime,
+			AccessedF: conformTime.Add(time.Minute + time.Nanosecond),
+			AttrsF:    cc.attrs,
+			TimeoutF:  30 * time.Minute,
+		}
+		if cc.attrs != nil {
+			in.CAttrsF = map[string]interface{}{"c": "d"}
+		}
+		out := &conformSess{}
+		data, err := c.Marshal(in)
+		if err == nil {
+			err = c.Unmarshal(data, out)
+		}
+		if p.Err = err; err == nil {
+			if cc.check != nil {
+				p.Preserved = cc.check(in, out)
+			} else {
+				p.Preserved = reflect.DeepEqual(in.AttrsF, out.AttrsF)
+			}
+		}
+		r.Properties = append(r.Properties, p)
+	}
+
+	// Unregistered struct in an attribute:
+	p := Property{Name: PropUnregisteredErr}
+	_, err := c.Marshal(&conformSess{IDF: "conform-id", AttrsF: map[string]interface{}{"s": struct{ A int }{}}})
+	p.Preserved = err != nil
+	r.Properties = append(r.Properties, p)
+
+	return r
+}
@@ -0,0 +1,46 @@
+package codec
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/icza/mighty"
+)
+
+func TestCheck(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	kr, err := NewKeyring(1, map[KeyID][]byte{1: make([]byte, 16)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gobLost := []string{PropTime, PropDuration, PropTypedMaps, PropNested} // Unregistered with gob
+	for _, c := range []struct {
+		name  string
+		c     Codec
+		wLost []string // Expected properties not preserved
+	}{
+		{"gob", Gob, gobLost},
+		{"json", JSON, []string{PropInt, PropSizedInts, PropFloat32, PropBytes, PropTime, PropDuration,
+			PropTypedSlices, PropTypedMaps, PropStructs, PropUnregisteredErr}},
+		{"msgpack", MsgPack, nil},
+		{"cbor", CBOR, nil},
+		{"envelope", Envelope(IDGob, nil), gobLost},
+		{"wrapped", Encrypt(Compress(Envelope(IDMsgPack, nil), nil), kr, nil), nil},
+	} {
+		r := Check(c.c)
+		var lost []string
+		for _, p := range r.Properties {
+			if !p.Preserved {
+				lost = append(lost, p.Name)
+			}
+		}
+		if !reflect.DeepEqual(c.wLost, lost) {
+			t.Errorf("[%s] Expected lost: %v, got:\n%s", c.name, c.wLost, r)
+		}
+		eq(true, r.Preserved(PropUnicode))
+		eq(len(conformCases)+1, len(r.Properties))
+	}
+	eq(false, Check(MsgPack).Preserved("unknown"))
+}
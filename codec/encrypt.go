@@ -0,0 +1,198 @@
+package codec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// flagEncrypted is the flag of encrypted payloads (following the compression flags).
+const flagEncrypted flags = 1 << 2
+
+// KeyID identifies a key of a Keyring.
+type KeyID byte
+
+// Keyring holds the encryption keys used by Encrypt.
+// One of the keys is the primary key which is used to encrypt;
+// all keys can be used to decrypt, so keys can be rotated without losing existing payloads.
+type Keyring struct {
+	primary KeyID
+	aeads   map[KeyID]cipher.AEAD
+}
+
+// NewKeyring returns a new Keyring with the specified keys, encrypting with the key of the primary ID.
+// Keys must be AES keys: 16, 24 or 32 bytes long (to select AES-128, AES-192 or AES-256).
+//
+// To rotate keys, add a new key and make it the primary key; payloads encrypted with the old key
+// are re-encrypted with the new key when they are saved next time. The old key may be removed
+// when all payloads encrypted with it expired.
+func NewKeyring(primary KeyID, keys map[KeyID][]byte) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("codec: no key with primary id %d", primary)
+	}
+	kr := &Keyring{primary: primary, aeads: make(map[KeyID]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("codec: invalid key with id %d: %v", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		kr.aeads[id] = aead
+	}
+	return kr, nil
+}
+
+// EncryptOptions defines options that may be passed when creating a new encrypting Codec.
+// All fields are optional; default value will be used for any field that has the zero value.
+type EncryptOptions struct {
+	// Tells if payloads which are not encrypted are to be unmarshalled (e.g. written before encryption was enabled);
+	// default value is false which means unmarshalling unencrypted payloads fails.
+	// Enable it only for the time of migrating to encryption, as it allows anyone with write access
+	// to the storage to inject sessions.
+	AllowPlaintext bool
+}
+
+var (
+	// ErrDecrypt is returned when an encrypted payload cannot be decrypted (e.g. it was tampered with).
+	ErrDecrypt = errors.New("codec: decryption failed")
+
+	// ErrPlaintext is returned when unmarshalling a payload which is not encrypted.
+	ErrPlaintext = errors.New("codec: payload is not encrypted")
+)
+
+// Encrypt returns a Codec which encrypts payloads marshalled by c with AES-GCM, using the primary key of kr.
+// o may be nil, in which case default options are used (see EncryptOptions).
+//
+// The session ID is used as associated data: if the marshalled value has an ID() string method (like Session),
+// the payload is authenticated with the ID. UnmarshalID (used by stores via session.UnmarshalSession())
+// authenticates the payload with the ID of the session being loaded, so an encrypted payload presented as the payload
+// of another session fails to decrypt. The ID is also stored with the payload so Unmarshal can decrypt it
+// without knowing the ID, but Unmarshal does not bind the payload to any session.
+// Other values are encrypted without an ID. Notably the attribute fields of redicache's hash layout are encrypted
+// individually without the session ID, so with that layout someone with write access to Redis can move an attribute
+// field from one session to another undetected; use the blob layout if this matters.
+//
+// Encrypted payloads are wrapped in an envelope (see Envelope) with a flag telling they are encrypted;
+// if c produces enveloped payloads, the flag is added to their envelope.
+// Encrypted payloads are not compressible, so if compression is used, Encrypt should wrap Compress and not the other way:
+//
+//	codec.Encrypt(codec.Compress(codec.Envelope(codec.IDJSON, nil), nil), kr, nil)
+func Encrypt(c Codec, kr *Keyring, o *EncryptOptions) Codec {
+	if o == nil {
+		o = &EncryptOptions{}
+	}
+	allowPlaintext := o.AllowPlaintext
+
+	// unmarshal decrypts data if it is encrypted, authenticating it with id if not nil
+	// (else with the ID stored in the payload), and unmarshals it with c.
+	unmarshal := func(data []byte, v interface{}, id *string) error {
+		h, payload, ok := parseHeader(data)
+		if !ok || h.flags&flagEncrypted == 0 {
+			if !allowPlaintext {
+				return ErrPlaintext
+			}
+			return c.Unmarshal(data, v)
+		}
+		payload, err := kr.open(h, payload, id)
+		if err != nil {
+			return err
+		}
+		h.flags &^= flagEncrypted
+		if h.codec == 0 && h.flags == 0 {
+			// c does not produce enveloped payloads
+			return c.Unmarshal(payload, v)
+		}
+		return c.Unmarshal(h.bytes(payload), v)
+	}
+
+	return Codec{
+		Marshal: func(v interface{}) ([]byte, error) {
+			data, err := c.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			var id string
+			if ider, ok := v.(interface{ ID() string }); ok {
+				id = ider.ID()
+			}
+			h, payload, ok := parseHeader(data)
+			if !ok {
+				h, payload = header{version: Version}, data
+			}
+			h.flags |= flagEncrypted
+			return kr.seal(h, id, payload)
+		},
+		Unmarshal: func(data []byte, v interface{}) error {
+			return unmarshal(data, v, nil)
+		},
+		UnmarshalID: func(data []byte, id string, v interface{}) error {
+			return unmarshal(data, v, &id)
+		},
+	}
+}
+
+// seal encrypts payload with the primary key.
+// The result is the envelope header followed by the key ID, the length of the session ID (uvarint),
+// the session ID, the nonce and the ciphertext.
+// The header and the session ID are authenticated as associated data.
+func (kr *Keyring) seal(h header, id string, payload []byte) ([]byte, error) {
+	aead := kr.aeads[kr.primary]
+
+	data := h.bytes(nil)
+	data = append(data, byte(kr.primary))
+	data = binary.AppendUvarint(data, uint64(len(id)))
+	data = append(data, id...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	ad := associatedData(h, id)
+	data = append(data, nonce...)
+	return aead.Seal(data, nonce, payload, ad), nil
+}
+
+// open decrypts payload sealed by seal (without the envelope header h).
+// The payload is authenticated with id if it is not nil, else with the session ID stored in the payload.
+func (kr *Keyring) open(h header, payload []byte, id *string) ([]byte, error) {
+	if len(payload) < 1 {
+		return nil, ErrDecrypt
+	}
+	aead, ok := kr.aeads[KeyID(payload[0])]
+	if !ok {
+		return nil, fmt.Errorf("codec: unknown key id %d", payload[0])
+	}
+	payload = payload[1:]
+
+	n, size := binary.Uvarint(payload)
+	if size <= 0 || uint64(len(payload)-size) < n {
+		return nil, ErrDecrypt
+	}
+	if id == nil {
+		stored := string(payload[size : size+int(n)])
+		id = &stored
+	}
+	payload = payload[size+int(n):]
+
+	if len(payload) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce, ciphertext := payload[:aead.NonceSize()], payload[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, associatedData(h, *id))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+// associatedData returns the associated data of a payload: the envelope header and the session ID.
+func associatedData(h header, id string) []byte {
+	return append(h.bytes(nil), id...)
+}
@@ -0,0 +1,86 @@
+package codec
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/icza/mighty"
+)
+
+func (s *testSess) ID() string { return s.IDF }
+
+func TestEncrypt(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+	deq := mighty.Deq(t)
+
+	key1, key2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+	kr1, err := NewKeyring(1, map[KeyID][]byte{1: key1})
+	eq(nil, err)
+
+	in := &testSess{IDF: "id1", AttrsF: map[string]interface{}{"secret": "p4ssw0rd"}}
+	c := Encrypt(Envelope(IDJSON, nil), kr1, nil)
+	data, err := c.Marshal(in)
+	eq(nil, err)
+	eq(false, bytes.Contains(data, []byte("p4ssw0rd")))
+	eq(flagEncrypted, flags(data[3]))
+
+	var out testSess
+	eq(nil, c.Unmarshal(data, &out))
+	deq(in, &out)
+
+	// Tampering is detected, including the session ID:
+	for _, i := range []int{2, 3, headerLen + 2, len(data) - 1} {
+		bad := append([]byte(nil), data...)
+		bad[i] ^= 1
+		neq(nil, c.Unmarshal(bad, &out))
+	}
+	eq(ErrDecrypt, c.Unmarshal(data[:len(data)-1], &out))
+
+	// Bound to the expected session ID:
+	out = testSess{}
+	eq(nil, c.UnmarshalID(data, "id1", &out))
+	deq(in, &out)
+	eq(ErrDecrypt, c.UnmarshalID(data, "id2", &out))
+	eq(ErrDecrypt, Compress(c, nil).UnmarshalID(data, "id2", &out))
+
+	// Plaintext:
+	plain, err := Envelope(IDJSON, nil).Marshal(in)
+	eq(nil, err)
+	eq(ErrPlaintext, c.Unmarshal(plain, &out))
+	out = testSess{}
+	eq(nil, Encrypt(Envelope(IDJSON, nil), kr1, &EncryptOptions{AllowPlaintext: true}).Unmarshal(plain, &out))
+	deq(in, &out)
+
+	// Rotation: old payloads can be read, new ones are written with the new key:
+	kr2, err := NewKeyring(2, map[KeyID][]byte{1: key1, 2: key2})
+	eq(nil, err)
+	c2 := Encrypt(Envelope(IDJSON, nil), kr2, nil)
+	out = testSess{}
+	eq(nil, c2.Unmarshal(data, &out))
+	deq(in, &out)
+	data2, err := c2.Marshal(&out)
+	eq(nil, err)
+	eq(byte(2), data2[headerLen])
+	neq(nil, c.Unmarshal(data2, &out)) // Unknown key
+
+	// Over compression and over a codec without envelope:
+	large := &testSess{IDF: "id2", AttrsF: map[string]interface{}{"a": strings.Repeat("x", 2000)}}
+	for _, inner := range []Codec{Compress(Envelope(IDGob, nil), nil), Gob} {
+		c := Encrypt(inner, kr2, nil)
+		data, err := c.Marshal(large)
+		eq(nil, err)
+		out = testSess{}
+		eq(nil, c.Unmarshal(data, &out))
+		deq(large, &out)
+	}
+}
+
+func TestNewKeyring(t *testing.T) {
+	neq := mighty.Neq(t)
+
+	_, err := NewKeyring(1, map[KeyID][]byte{2: make([]byte, 16)})
+	neq(nil, err)
+	_, err = NewKeyring(1, map[KeyID][]byte{1: make([]byte, 10)})
+	neq(nil, err)
+}
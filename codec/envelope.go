@@ -0,0 +1,145 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ID identifies a Codec in the envelope of marshalled payloads.
+type ID byte
+
+// IDs of the codecs of this package.
+const (
+	// IDGob is the ID of the Gob codec.
+	IDGob ID = 1
+	// IDJSON is the ID of the JSON codec.
+	IDJSON ID = 2
+	// IDMsgPack is the ID of the MsgPack codec.
+	IDMsgPack ID = 3
+	// IDCBOR is the ID of the CBOR codec.
+	IDCBOR ID = 4
+)
+
+const (
+	// magic is the first byte of enveloped payloads.
+	// It can't start gob (a message length) or JSON (a value after optional whitespace) data,
+	// so payloads written without an envelope can be told apart.
+	magic = 0xC5
+
+	// Version is the envelope format version written by this package.
+	Version = 1
+
+	// headerLen is the length of the envelope header: magic, version, codec ID and flags.
+	headerLen = 4
+)
+
+// flags tells the transformations applied to the payload of an envelope.
+type flags byte
+
+// header is the header of an envelope.
+type header struct {
+	version byte
+	codec   ID
+	flags   flags
+}
+
+// bytes returns the header followed by payload.
+func (h header) bytes(payload []byte) []byte {
+	data := make([]byte, 0, headerLen+len(payload))
+	data = append(data, magic, h.version, byte(h.codec), byte(h.flags))
+	return append(data, payload...)
+}
+
+// parseHeader parses the envelope header of data.
+// ok is false if data is not enveloped (e.g. it was written without an envelope).
+func parseHeader(data []byte) (h header, payload []byte, ok bool) {
+	if len(data) < headerLen || data[0] != magic || data[1] == 0 || data[1] > Version {
+		return header{}, nil, false
+	}
+	return header{version: data[1], codec: ID(data[2]), flags: flags(data[3])}, data[headerLen:], true
+}
+
+var (
+	rmux     sync.RWMutex     // mutex to synchronize access to registry
+	registry = map[ID]Codec{} // Registered codecs
+)
+
+func init() {
+	Register(IDGob, Gob)
+	Register(IDJSON, JSON)
+	Register(IDMsgPack, MsgPack)
+	Register(IDCBOR, CBOR)
+}
+
+// Register registers a codec with an id, so enveloped payloads written with it can be unmarshalled.
+// IDs below 64 are reserved for the codecs of this package.
+// It panics if id is 0 or if a codec is already registered with id.
+func Register(id ID, c Codec) {
+	rmux.Lock()
+	defer rmux.Unlock()
+
+	if id == 0 {
+		panic("codec: Register with 0 id")
+	}
+	if _, ok := registry[id]; ok {
+		panic(fmt.Sprintf("codec: Register called twice for id %d", id))
+	}
+	registry[id] = c
+}
+
+// Lookup returns the codec registered with id.
+func Lookup(id ID) (c Codec, ok bool) {
+	rmux.RLock()
+	defer rmux.RUnlock()
+
+	c, ok = registry[id]
+	return
+}
+
+// ErrNoEnvelope is returned when unmarshalling a payload without an envelope and no legacy codec is specified.
+var ErrNoEnvelope = errors.New("codec: payload has no envelope")
+
+// Envelope returns a Codec which marshals with the codec registered with id write, wrapping payloads in an envelope:
+// a magic byte, the envelope format version, the ID of the codec and flags of applied transformations.
+//
+// Unmarshal uses the codec whose ID is in the envelope, so payloads written with any registered codec can be read.
+// Payloads without an envelope (written before switching to enveloped payloads) are unmarshalled with legacy;
+// if legacy is nil, ErrNoEnvelope is returned for them.
+//
+// This allows migrating the codec of a store without downtime: e.g. to migrate a store from gob to JSON,
+// use Envelope(IDJSON, &Gob) as its codec; sessions are rewritten with JSON on their next save.
+// It panics if no codec is registered with id write.
+func Envelope(write ID, legacy *Codec) Codec {
+	wc, ok := Lookup(write)
+	if !ok {
+		panic(fmt.Sprintf("codec: no codec registered with id %d", write))
+	}
+
+	return Codec{
+		Marshal: func(v interface{}) ([]byte, error) {
+			payload, err := wc.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			return header{version: Version, codec: write}.bytes(payload), nil
+		},
+		Unmarshal: func(data []byte, v interface{}) error {
+			h, payload, ok := parseHeader(data)
+			if !ok {
+				if legacy == nil {
+					return ErrNoEnvelope
+				}
+				return legacy.Unmarshal(data, v)
+			}
+			if h.flags != 0 {
+				return fmt.Errorf("codec: unsupported envelope flags: %#x", h.flags)
+			}
+			c, ok := Lookup(h.codec)
+			if !ok {
+				return fmt.Errorf("codec: no codec registered with id %d", h.codec)
+			}
+			return c.Unmarshal(payload, v)
+		},
+	}
+}
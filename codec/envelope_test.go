@@ -0,0 +1,73 @@
+package codec
+
+import (
+	"testing"
+
+	"github.com/icza/mighty"
+)
+
+type testSess struct {
+	IDF    string
+	AttrsF map[string]interface{}
+}
+
+func TestEnvelope(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+	deq := mighty.Deq(t)
+
+	in := &testSess{IDF: "id1", AttrsF: map[string]interface{}{"a": "x"}}
+
+	// Migration from gob to JSON:
+	old, err := Gob.Marshal(in)
+	eq(nil, err)
+	c := Envelope(IDJSON, &Gob)
+
+	var out testSess
+	eq(nil, c.Unmarshal(old, &out))
+	deq(in, &out)
+
+	data, err := c.Marshal(in)
+	eq(nil, err)
+	eq(byte(magic), data[0])
+	eq(byte(Version), data[1])
+	eq(byte(IDJSON), data[2])
+	eq(byte('{'), data[headerLen])
+	out = testSess{}
+	eq(nil, c.Unmarshal(data, &out))
+	deq(in, &out)
+
+	// Payloads of any registered codec can be read:
+	data, err = Envelope(IDGob, nil).Marshal(in)
+	eq(nil, err)
+	out = testSess{}
+	eq(nil, c.Unmarshal(data, &out))
+	deq(in, &out)
+
+	// Legacy payloads without legacy codec:
+	eq(ErrNoEnvelope, Envelope(IDJSON, nil).Unmarshal(old, &out))
+
+	// Unregistered codec and unknown flags:
+	neq(nil, c.Unmarshal([]byte{magic, Version, 200, 0, '{', '}'}, &out))
+	neq(nil, c.Unmarshal([]byte{magic, Version, byte(IDJSON), 0x80, '{', '}'}, &out))
+}
+
+func TestRegister(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	panics := func(f func()) (p bool) {
+		defer func() { p = recover() != nil }()
+		f()
+		return
+	}
+
+	eq(true, panics(func() { Register(0, JSON) }))
+	eq(true, panics(func() { Register(IDJSON, JSON) }))
+	eq(true, panics(func() { Envelope(201, nil) }))
+
+	Register(202, JSON)
+	c, ok := Lookup(202)
+	eq(true, ok)
+	data, err := c.Marshal(1)
+	eq(nil, err)
+	eq("1", string(data))
+}
@@ -0,0 +1,395 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// MsgPack is a Codec that uses the MessagePack format (https://msgpack.org).
+//
+// Unlike JSON, integers decode into integers and times keep their nanoseconds (they are encoded
+// with the timestamp extension type, and decode in the local time zone). Values of types other than
+// nil, bool, int, float64, string, []byte, time.Time, []interface{} and map[string]interface{} stored
+// in interfaces (e.g. session attributes) are encoded with a type hint so they decode into the same type;
+// their types must be registered with RegisterType. Type hints use the extension type 27, whose data
+// is a MessagePack array of the type name and the value.
+// Structs are encoded as maps of their exported fields (keyed by their json names if tagged),
+// so payloads are readable from other languages.
+var MsgPack = Codec{Marshal: msgpackMarshal, Unmarshal: msgpackUnmarshal}
+
+// MessagePack extension types.
+const (
+	msgpackExtTime   = -1 // Timestamp extension type, defined by the spec
+	msgpackExtHinted = 27 // Type hint
+)
+
+func msgpackMarshal(v interface{}) ([]byte, error) {
+	e := &msgpackEncoder{}
+	if err := encodeValue(e, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func msgpackUnmarshal(data []byte, v interface{}) error {
+	d := &msgpackDecoder{data: data}
+	src, err := d.value(0)
+	if err != nil {
+		return err
+	}
+	if d.pos != len(data) {
+		return errors.New("codec: trailing data after MessagePack value")
+	}
+	return decodeInto(v, src)
+}
+
+// msgpackEncoder encodes values in the MessagePack format.
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) encodeNil() { e.buf = append(e.buf, 0xc0) }
+
+func (e *msgpackEncoder) encodeBool(b bool) {
+	if b {
+		e.buf = append(e.buf, 0xc3)
+	} else {
+		e.buf = append(e.buf, 0xc2)
+	}
+}
+
+func (e *msgpackEncoder) encodeInt(i int64) {
+	switch {
+	case i >= 0:
+		e.encodeUint(uint64(i))
+	case i >= -32:
+		e.buf = append(e.buf, byte(i)) // Negative fixint
+	case i >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xd2), uint32(i))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xd3), uint64(i))
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(u uint64) {
+	switch {
+	case u <= 0x7f:
+		e.buf = append(e.buf, byte(u)) // Positive fixint
+	case u <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xce), uint32(u))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xcf), u)
+	}
+}
+
+func (e *msgpackEncoder) encodeFloat(f float64, bits int) {
+	if bits == 32 {
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xca), math.Float32bits(float32(f)))
+		return
+	}
+	e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xcb), math.Float64bits(f))
+}
+
+// encodeLen encodes a length with the smallest of the fix, 8, 16 and 32-bit formats.
+// fix is the fix format (0 if there is none), fixMax is the max length it can hold;
+// code8 is the 8-bit format (0 if there is none), the 16 and 32-bit formats follow it.
+func (e *msgpackEncoder) encodeLen(n int, fix byte, fixMax int, code8 byte) {
+	switch {
+	case n <= fixMax:
+		e.buf = append(e.buf, fix|byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		e.buf = append(e.buf, code8, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, code8+1), uint16(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, code8+2), uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	e.encodeLen(len(s), 0xa0, 31, 0xd9)
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) encodeBytes(b []byte) {
+	e.encodeLen(len(b), 0, -1, 0xc4)
+	e.buf = append(e.buf, b...)
+}
+
+func (e *msgpackEncoder) encodeArrayLen(n int) {
+	switch {
+	case n <= 15:
+		e.buf = append(e.buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xdc), uint16(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xdd), uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) encodeMapLen(n int) {
+	switch {
+	case n <= 15:
+		e.buf = append(e.buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xde), uint16(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xdf), uint32(n))
+	}
+}
+
+// encodeExt encodes an extension value.
+func (e *msgpackEncoder) encodeExt(typ int8, data []byte) {
+	switch len(data) {
+	case 1:
+		e.buf = append(e.buf, 0xd4)
+	case 2:
+		e.buf = append(e.buf, 0xd5)
+	case 4:
+		e.buf = append(e.buf, 0xd6)
+	case 8:
+		e.buf = append(e.buf, 0xd7)
+	case 16:
+		e.buf = append(e.buf, 0xd8)
+	default:
+		e.encodeLen(len(data), 0, -1, 0xc7)
+	}
+	e.buf = append(e.buf, byte(typ))
+	e.buf = append(e.buf, data...)
+}
+
+func (e *msgpackEncoder) encodeTime(t time.Time) {
+	sec, nsec := t.Unix(), uint64(t.Nanosecond())
+	switch {
+	case sec>>34 == 0 && nsec == 0 && sec <= math.MaxUint32:
+		e.encodeExt(msgpackExtTime, binary.BigEndian.AppendUint32(nil, uint32(sec))) // timestamp 32
+	case sec>>34 == 0:
+		e.encodeExt(msgpackExtTime, binary.BigEndian.AppendUint64(nil, nsec<<34|uint64(sec))) // timestamp 64
+	default:
+		data := binary.BigEndian.AppendUint32(nil, uint32(nsec)) // timestamp 96
+		e.encodeExt(msgpackExtTime, binary.BigEndian.AppendUint64(data, uint64(sec)))
+	}
+}
+
+func (e *msgpackEncoder) encodeHinted(name string, value func(e encoder) error) error {
+	e2 := &msgpackEncoder{}
+	e2.encodeArrayLen(2)
+	e2.encodeString(name)
+	if err := value(e2); err != nil {
+		return err
+	}
+	e.encodeExt(msgpackExtHinted, e2.buf)
+	return nil
+}
+
+// errMsgpackShort is returned when MessagePack data ends unexpectedly.
+var errMsgpackShort = errors.New("codec: unexpected end of MessagePack data")
+
+// msgpackDecoder decodes MessagePack data.
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+// read returns the next n bytes.
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// readUint reads an n-byte (1, 2, 4 or 8) big-endian unsigned integer.
+func (d *msgpackDecoder) readUint(n int) (uint64, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// value decodes the next value; depth is the nesting depth of the value.
+func (d *msgpackDecoder) value(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errMaxDepth
+	}
+	b, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+
+	switch {
+	case c <= 0x7f: // Positive fixint
+		return int64(c), nil
+	case c >= 0xe0: // Negative fixint
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80: // Fixmap
+		return d.mapValue(int(c&0x0f), depth)
+	case c&0xf0 == 0x90: // Fixarray
+		return d.array(int(c&0x0f), depth)
+	case c&0xe0 == 0xa0: // Fixstr
+		s, err := d.read(int(c & 0x1f))
+		return string(s), err
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6: // bin
+		n, err := d.readUint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.read(int(n))
+		return append([]byte(nil), b...), err
+	case 0xc7, 0xc8, 0xc9: // ext
+		n, err := d.readUint(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.ext(int(n), depth)
+	case 0xca:
+		u, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.readUint(8)
+		return math.Float64frombits(u), err
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint
+		u, err := d.readUint(1 << (c - 0xcc))
+		if u > math.MaxInt64 {
+			return u, err
+		}
+		return int64(u), err
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int
+		n := 1 << (c - 0xd0)
+		u, err := d.readUint(n)
+		// Sign-extend:
+		shift := 64 - 8*uint(n)
+		return int64(u<<shift) >> shift, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext
+		return d.ext(1<<(c-0xd4), depth)
+	case 0xd9, 0xda, 0xdb: // str
+		n, err := d.readUint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.read(int(n))
+		return string(s), err
+	case 0xdc, 0xdd: // array
+		n, err := d.readUint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n), depth)
+	case 0xde, 0xdf: // map
+		n, err := d.readUint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapValue(int(n), depth)
+	}
+	return nil, fmt.Errorf("codec: invalid MessagePack format: %#x", c)
+}
+
+// array decodes the n elements of an array.
+func (d *msgpackDecoder) array(n int, depth int) (interface{}, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort // Each element takes at least 1 byte
+	}
+	a := make([]interface{}, n)
+	for i := range a {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		a[i] = v
+	}
+	return a, nil
+}
+
+// mapValue decodes the n key-value pairs of a map.
+func (d *msgpackDecoder) mapValue(n int, depth int) (interface{}, error) {
+	if n > (len(d.data)-d.pos)/2 {
+		return nil, errMsgpackShort // Each pair takes at least 2 bytes
+	}
+	m := make(rawMap, n)
+	for i := range m {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		m[i] = mapEntry{k, v}
+	}
+	return m, nil
+}
+
+// ext decodes an extension value with n bytes of data.
+func (d *msgpackDecoder) ext(n int, depth int) (interface{}, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+	typ := int8(b[0])
+	data, err := d.read(n)
+	if err != nil {
+		return nil, err
+	}
+
+	switch typ {
+	case msgpackExtTime:
+		switch n {
+		case 4:
+			return time.Unix(int64(binary.BigEndian.Uint32(data)), 0), nil
+		case 8:
+			u := binary.BigEndian.Uint64(data)
+			return time.Unix(int64(u&(1<<34-1)), int64(u>>34)), nil
+		case 12:
+			return time.Unix(int64(binary.BigEndian.Uint64(data[4:])), int64(binary.BigEndian.Uint32(data))), nil
+		}
+		return nil, fmt.Errorf("codec: invalid MessagePack timestamp length: %d", n)
+	case msgpackExtHinted:
+		d2 := &msgpackDecoder{data: data}
+		v, err := d2.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if a, ok := v.([]interface{}); ok && len(a) == 2 && d2.pos == len(data) {
+			if name, ok := a[0].(string); ok {
+				return hinted{name, a[1]}, nil
+			}
+		}
+		return nil, errors.New("codec: invalid MessagePack type hint")
+	}
+	return nil, fmt.Errorf("codec: unsupported MessagePack extension type: %d", typ)
+}
@@ -0,0 +1,528 @@
+package codec
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains the reflection based encoding and decoding shared by the MsgPack and CBOR codecs.
+//
+// Values are encoded by their kinds: structs as maps of their exported fields (keyed by their json names if tagged),
+// pointers as the pointed values. Values stored in interfaces (e.g. session attributes) are decoded by what is encoded
+// into "natural" types: nil, bool, int, float64, string, []byte, time.Time, []interface{} and map[string]interface{}.
+// Values of other types stored in interfaces are encoded with a type hint (the name of their type), so they decode
+// into the same type; the type must be registered with RegisterType (common types are registered by this package).
+
+var (
+	tmux        sync.RWMutex                // mutex to synchronize access to typesByName and namesByType
+	typesByName = map[string]reflect.Type{} // Registered types by their names
+	namesByType = map[reflect.Type]string{} // Names of registered types
+
+	fieldCache sync.Map // Cached fields of struct types, map[reflect.Type][]field
+)
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+
+	// naturalTypes are the types which are encoded without type hints when stored in interfaces.
+	naturalTypes = map[reflect.Type]bool{
+		reflect.TypeOf(false):                    true,
+		reflect.TypeOf(0):                        true,
+		reflect.TypeOf(0.0):                      true,
+		reflect.TypeOf(""):                       true,
+		reflect.TypeOf([]byte(nil)):              true,
+		timeType:                                 true,
+		reflect.TypeOf([]interface{}(nil)):       true,
+		reflect.TypeOf(map[string]interface{}{}): true,
+	}
+)
+
+func init() {
+	for _, v := range []interface{}{
+		int8(0), int16(0), int32(0), int64(0), uint(0), uint8(0), uint16(0), uint32(0), uint64(0), float32(0),
+		time.Duration(0), []string(nil), []int(nil), map[string]string(nil),
+	} {
+		RegisterType(reflect.TypeOf(v).String(), v)
+	}
+}
+
+// RegisterType registers the type of value under name, so values of the type stored in interfaces
+// (e.g. session attributes) are encoded with a type hint by the MsgPack and CBOR codecs, and decode into the same type.
+// Pointer and non-pointer types are different types, register the one stored in the interfaces.
+// Names are part of the encoded data, and so they must be stable and unique;
+// the names of the types registered by this package are the names of the types, e.g. "int64" and "time.Duration".
+//
+// Values of unregistered struct types (and pointers to them) can't be marshalled in interfaces.
+// It panics if name or the type of value is already registered differently.
+func RegisterType(name string, value interface{}) {
+	t := reflect.TypeOf(value)
+	if t == nil {
+		panic("codec: RegisterType with nil value")
+	}
+
+	tmux.Lock()
+	defer tmux.Unlock()
+
+	if t2, ok := typesByName[name]; ok && t2 != t {
+		panic(fmt.Sprintf("codec: registering duplicate types for %q: %v != %v", name, t2, t))
+	}
+	if n, ok := namesByType[t]; ok && n != name {
+		panic(fmt.Sprintf("codec: registering duplicate names for %v: %q != %q", t, n, name))
+	}
+	typesByName[name] = t
+	namesByType[t] = name
+}
+
+// typeByName returns the type registered under name.
+func typeByName(name string) (t reflect.Type, ok bool) {
+	tmux.RLock()
+	defer tmux.RUnlock()
+
+	t, ok = typesByName[name]
+	return
+}
+
+// nameOfType returns the name t is registered under.
+func nameOfType(t reflect.Type) (name string, ok bool) {
+	tmux.RLock()
+	defer tmux.RUnlock()
+
+	name, ok = namesByType[t]
+	return
+}
+
+// field describes an encoded struct field.
+type field struct {
+	name  string // Encoded name
+	index int    // Index of the field in the struct
+}
+
+// fieldsOf returns the encoded fields of a struct type.
+func fieldsOf(t reflect.Type) []field {
+	if fs, ok := fieldCache.Load(t); ok {
+		return fs.([]field)
+	}
+
+	var fs []field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue // Unexported
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			tagName := strings.Split(tag, ",")[0]
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name = tagName
+			}
+		}
+		fs = append(fs, field{name: name, index: i})
+	}
+	fieldCache.Store(t, fs)
+	return fs
+}
+
+// encoder is implemented by the wire formats.
+type encoder interface {
+	encodeNil()
+	encodeBool(b bool)
+	encodeInt(i int64)
+	encodeUint(u uint64)
+	encodeFloat(f float64, bits int)
+	encodeString(s string)
+	encodeBytes(b []byte)
+	encodeArrayLen(n int) // Followed by n values
+	encodeMapLen(n int)   // Followed by n key-value pairs
+	encodeTime(t time.Time)
+
+	// encodeHinted encodes a value with a type hint; value must encode the value with the passed encoder.
+	encodeHinted(name string, value func(e encoder) error) error
+}
+
+// encodeValue encodes v.
+func encodeValue(e encoder, v reflect.Value) error {
+	if !v.IsValid() {
+		e.encodeNil()
+		return nil
+	}
+	if v.Type() == timeType {
+		e.encodeTime(v.Interface().(time.Time))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		return encodeIface(e, v)
+	case reflect.Ptr:
+		if v.IsNil() {
+			e.encodeNil()
+			return nil
+		}
+		return encodeValue(e, v.Elem())
+	case reflect.Bool:
+		e.encodeBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.encodeFloat(v.Float(), 32)
+	case reflect.Float64:
+		e.encodeFloat(v.Float(), 64)
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.encodeNil()
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.encodeBytes(v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		e.encodeArrayLen(v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeValue(e, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			e.encodeNil()
+			return nil
+		}
+		keys := v.MapKeys()
+		if v.Type().Key().Kind() == reflect.String {
+			// Deterministic output
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		}
+		e.encodeMapLen(len(keys))
+		for _, k := range keys {
+			if err := encodeValue(e, k); err != nil {
+				return err
+			}
+			if err := encodeValue(e, v.MapIndex(k)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fs := fieldsOf(v.Type())
+		e.encodeMapLen(len(fs))
+		for _, f := range fs {
+			e.encodeString(f.name)
+			if err := encodeValue(e, v.Field(f.index)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("codec: unsupported type: %v", v.Type())
+	}
+	return nil
+}
+
+// encodeIface encodes v which is an interface, adding a type hint if its dynamic type is not natural.
+func encodeIface(e encoder, v reflect.Value) error {
+	if v.IsNil() {
+		e.encodeNil()
+		return nil
+	}
+	elem := v.Elem()
+	t := elem.Type()
+	if naturalTypes[t] {
+		return encodeValue(e, elem)
+	}
+	if name, ok := nameOfType(t); ok {
+		return e.encodeHinted(name, func(e encoder) error { return encodeValue(e, elem) })
+	}
+	if t.Kind() == reflect.Struct || t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct {
+		return fmt.Errorf("codec: type not registered: %v", t)
+	}
+	return encodeValue(e, elem) // Decodes into a natural type
+}
+
+// Values decoded by the wire formats are nil, bool, int64 (integers that fit into it), uint64 (other integers),
+// float64, string, []byte, time.Time, []interface{}, rawMap and hinted.
+
+// rawMap is a decoded map.
+type rawMap []mapEntry
+
+// mapEntry is a key-value pair of a decoded map.
+type mapEntry struct {
+	k, v interface{}
+}
+
+// hinted is a decoded value with a type hint.
+type hinted struct {
+	name string
+	v    interface{}
+}
+
+// maxDepth is the max nesting depth of decoded values.
+const maxDepth = 1000
+
+// errMaxDepth is returned when decoding values nested deeper than maxDepth.
+var errMaxDepth = fmt.Errorf("codec: max nesting depth of %d exceeded", maxDepth)
+
+// decodeInto stores the decoded value src in the value pointed to by v.
+func decodeInto(v interface{}, src interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("codec: unmarshal into non-pointer or nil: %T", v)
+	}
+	return assign(rv.Elem(), src)
+}
+
+// assign stores the decoded value src in dst.
+func assign(dst reflect.Value, src interface{}) error {
+	if h, ok := src.(hinted); ok && dst.Kind() != reflect.Interface {
+		src = h.v // Type is given by dst
+	}
+	if src == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+	mismatch := func() error {
+		return fmt.Errorf("codec: cannot decode %T into %v", src, dst.Type())
+	}
+	overflow := func() error {
+		return fmt.Errorf("codec: %v overflows %v", src, dst.Type())
+	}
+
+	if dst.Type() == timeType {
+		t, ok := src.(time.Time)
+		if !ok {
+			return mismatch()
+		}
+		dst.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Interface:
+		var nv reflect.Value
+		if h, ok := src.(hinted); ok {
+			t, ok := typeByName(h.name)
+			if !ok {
+				return fmt.Errorf("codec: type not registered: %q", h.name)
+			}
+			nv = reflect.New(t).Elem()
+			if err := assign(nv, h.v); err != nil {
+				return err
+			}
+		} else {
+			n, err := natural(src)
+			if err != nil {
+				return err
+			}
+			nv = reflect.ValueOf(n)
+		}
+		if !nv.Type().AssignableTo(dst.Type()) {
+			return fmt.Errorf("codec: %v is not assignable to %v", nv.Type(), dst.Type())
+		}
+		dst.Set(nv)
+	case reflect.Ptr:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return assign(dst.Elem(), src)
+	case reflect.Bool:
+		b, ok := src.(bool)
+		if !ok {
+			return mismatch()
+		}
+		dst.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch s := src.(type) {
+		case int64:
+			if dst.OverflowInt(s) {
+				return overflow()
+			}
+			dst.SetInt(s)
+		case uint64:
+			return overflow() // Decoders only produce uint64 for values not fitting into int64
+		default:
+			return mismatch()
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		switch s := src.(type) {
+		case int64:
+			if s < 0 || dst.OverflowUint(uint64(s)) {
+				return overflow()
+			}
+			dst.SetUint(uint64(s))
+		case uint64:
+			if dst.OverflowUint(s) {
+				return overflow()
+			}
+			dst.SetUint(s)
+		default:
+			return mismatch()
+		}
+	case reflect.Float32, reflect.Float64:
+		switch s := src.(type) {
+		case float64:
+			dst.SetFloat(s)
+		case int64:
+			dst.SetFloat(float64(s))
+		case uint64:
+			dst.SetFloat(float64(s))
+		default:
+			return mismatch()
+		}
+	case reflect.String:
+		s, ok := src.(string)
+		if !ok {
+			return mismatch()
+		}
+		dst.SetString(s)
+	case reflect.Slice:
+		if b, ok := src.([]byte); ok && dst.Type().Elem().Kind() == reflect.Uint8 {
+			dst.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+		a, ok := src.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		sv := reflect.MakeSlice(dst.Type(), len(a), len(a))
+		for i, e := range a {
+			if err := assign(sv.Index(i), e); err != nil {
+				return err
+			}
+		}
+		dst.Set(sv)
+	case reflect.Array:
+		a, ok := src.([]interface{})
+		if !ok || len(a) != dst.Len() {
+			return mismatch()
+		}
+		for i, e := range a {
+			if err := assign(dst.Index(i), e); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		m, ok := src.(rawMap)
+		if !ok {
+			return mismatch()
+		}
+		mv := reflect.MakeMapWithSize(dst.Type(), len(m))
+		kt, vt := dst.Type().Key(), dst.Type().Elem()
+		for _, e := range m {
+			k, v := reflect.New(kt).Elem(), reflect.New(vt).Elem()
+			if err := assign(k, e.k); err != nil {
+				return err
+			}
+			if err := assign(v, e.v); err != nil {
+				return err
+			}
+			mv.SetMapIndex(k, v)
+		}
+		dst.Set(mv)
+	case reflect.Struct:
+		m, ok := src.(rawMap)
+		if !ok {
+			return mismatch()
+		}
+		fs := fieldsOf(dst.Type())
+		for _, e := range m {
+			name, ok := e.k.(string)
+			if !ok {
+				return mismatch()
+			}
+			for _, f := range fs {
+				if f.name == name {
+					if err := assign(dst.Field(f.index), e.v); err != nil {
+						return err
+					}
+					break
+				}
+			}
+			// Unknown fields are ignored
+		}
+	default:
+		return mismatch()
+	}
+	return nil
+}
+
+// natural converts a decoded value to a natural type.
+func natural(src interface{}) (interface{}, error) {
+	switch s := src.(type) {
+	case int64:
+		if s >= math.MinInt && s <= math.MaxInt {
+			return int(s), nil
+		}
+		return s, nil
+	case uint64:
+		if s <= math.MaxInt {
+			return int(s), nil
+		}
+		return s, nil
+	case []interface{}:
+		a := make([]interface{}, len(s))
+		for i, e := range s {
+			v, err := natural(e)
+			if err != nil {
+				return nil, err
+			}
+			a[i] = v
+		}
+		return a, nil
+	case rawMap:
+		// map[string]interface{} if all keys are strings, else map[interface{}]interface{}
+		m := make(map[string]interface{}, len(s))
+		for _, e := range s {
+			k, ok := e.k.(string)
+			if !ok {
+				return naturalAnyMap(s)
+			}
+			v, err := natural(e.v)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = v
+		}
+		return m, nil
+	case hinted:
+		var v interface{}
+		if err := assign(reflect.ValueOf(&v).Elem(), src); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	return src, nil
+}
+
+// naturalAnyMap converts a decoded map to map[interface{}]interface{}.
+func naturalAnyMap(s rawMap) (interface{}, error) {
+	m := make(map[interface{}]interface{}, len(s))
+	for _, e := range s {
+		k, err := natural(e.k)
+		if err != nil {
+			return nil, err
+		}
+		if b, ok := k.([]byte); ok {
+			k = string(b) // Byte slices are not comparable
+		}
+		if k != nil && !reflect.TypeOf(k).Comparable() {
+			return nil, fmt.Errorf("codec: invalid map key type: %T", k)
+		}
+		v, err := natural(e.v)
+		if err != nil {
+			return nil, err
+		}
+		m[k] = v
+	}
+	return m, nil
+}
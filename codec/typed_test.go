@@ -0,0 +1,171 @@
+package codec
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+)
+
+type testItem struct {
+	Name  string
+	Count int
+}
+
+type testFullSess struct {
+	IDF      string                 `json:"id"`
+	CreatedF time.Time              `json:"created"`
+	AttrsF   map[string]interface{} `json:"attrs"`
+	TimeoutF time.Duration          `json:"timeout"`
+	Ignored  string                 `json:"-"`
+}
+
+func init() {
+	RegisterType("codec.testItem", &testItem{})
+}
+
+func TestTypedCodecs(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+	deq := mighty.Deq(t)
+
+	created := time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	in := &testFullSess{
+		IDF:      "id1",
+		CreatedF: created,
+		AttrsF: map[string]interface{}{
+			"int":     1,
+			"neg":     -100000,
+			"int64":   int64(math.MinInt64),
+			"uint64":  uint64(math.MaxUint64),
+			"int8":    int8(-3),
+			"float":   1.5,
+			"float32": float32(2.5),
+			"str":     "ünicode ✓",
+			"long":    strings.Repeat("x", 70000),
+			"bytes":   []byte{1, 2, 3},
+			"time":    created.Add(time.Hour),
+			"dur":     time.Minute,
+			"strs":    []string{"a", "b"},
+			"list":    []interface{}{1, "a", nil},
+			"map":     map[string]interface{}{"nested": true},
+			"item":    &testItem{Name: "x", Count: 2},
+			"nilitem": (*testItem)(nil),
+			"nil":     nil,
+		},
+		TimeoutF: 30 * time.Minute,
+		Ignored:  "ignored",
+	}
+
+	for _, c := range []Codec{MsgPack, CBOR} {
+		data, err := c.Marshal(in)
+		eq(nil, err)
+
+		var out testFullSess
+		eq(nil, c.Unmarshal(data, &out))
+		eq("id1", out.IDF)
+		eq(true, created.Equal(out.CreatedF))
+		eq(30*time.Minute, out.TimeoutF)
+		eq("", out.Ignored)
+		for name, v := range in.AttrsF {
+			if name != "time" { // Location may differ
+				deq(v, out.AttrsF[name])
+			}
+		}
+		eq(len(in.AttrsF), len(out.AttrsF))
+		eq(true, in.AttrsF["time"].(time.Time).Equal(out.AttrsF["time"].(time.Time)))
+
+		// Deterministic:
+		data2, err := c.Marshal(in)
+		eq(nil, err)
+		eq(string(data), string(data2))
+
+		// Unregistered structs can't be marshalled in interfaces:
+		_, err = c.Marshal(map[string]interface{}{"a": struct{ A int }{}})
+		neq(nil, err)
+
+		// Corrupt data:
+		for i := 0; i < len(data) && i < 200; i++ {
+			c.Unmarshal(data[:i], &out) // Must not panic
+		}
+		neq(nil, c.Unmarshal(data[:len(data)-1], &out))
+		neq(nil, c.Unmarshal(append(data, 0), &out))
+	}
+}
+
+func TestMsgPackWire(t *testing.T) {
+	eq := mighty.Eq(t)
+	deq := mighty.Deq(t)
+
+	data, err := MsgPack.Marshal(map[string]interface{}{"a": 1, "b": []interface{}{-1, "x", true, nil}})
+	eq(nil, err)
+	deq([]byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0x94, 0xff, 0xa1, 'x', 0xc3, 0xc0}, data)
+
+	data, err = MsgPack.Marshal(time.Unix(1, 0))
+	eq(nil, err)
+	deq([]byte{0xd6, 0xff, 0, 0, 0, 1}, data)
+
+	var v interface{}
+	eq(nil, MsgPack.Unmarshal([]byte{0xd1, 0xfc, 0x18}, &v)) // int16 -1000
+	eq(-1000, v)
+	eq(nil, MsgPack.Unmarshal([]byte{0xdc, 0, 1, 0xcc, 200}, &v)) // array16 of uint8
+	deq([]interface{}{200}, v)
+}
+
+func TestCBORWire(t *testing.T) {
+	eq := mighty.Eq(t)
+	deq := mighty.Deq(t)
+
+	// Examples of RFC 8949 Appendix A:
+	for _, c := range []struct {
+		v    interface{}
+		data []byte
+	}{
+		{1000000, []byte{0x1a, 0x00, 0x0f, 0x42, 0x40}},
+		{-1000, []byte{0x39, 0x03, 0xe7}},
+		{uint64(18446744073709551615), []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{1.1, []byte{0xfb, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a}},
+		{"ü", []byte{0x62, 0xc3, 0xbc}},
+		{[]interface{}{1, []interface{}{2, 3}}, []byte{0x82, 0x01, 0x82, 0x02, 0x03}},
+		{map[string]interface{}{"a": 1}, []byte{0xa1, 0x61, 0x61, 0x01}},
+	} {
+		data, err := CBOR.Marshal(c.v)
+		eq(nil, err)
+		deq(c.data, data)
+		var v interface{}
+		eq(nil, CBOR.Unmarshal(c.data, &v))
+		deq(c.v, v)
+	}
+
+	for _, c := range []struct {
+		data []byte
+		v    interface{}
+	}{
+		{[]byte{0xf9, 0x3c, 0x00}, 1.0},  // Half float
+		{[]byte{0xf9, 0xc4, 0x00}, -4.0}, // Half float
+		{[]byte{0x9f, 0x01, 0x82, 0x02, 0x03, 0xff}, []interface{}{1, []interface{}{2, 3}}},        // Indefinite array
+		{[]byte{0xbf, 0x61, 0x61, 0x01, 0xff}, map[string]interface{}{"a": 1}},                     // Indefinite map
+		{[]byte{0x7f, 0x65, 's', 't', 'r', 'e', 'a', 0x64, 'm', 'i', 'n', 'g', 0xff}, "streaming"}, // Indefinite string
+		{[]byte{0xc1, 0x1a, 0x51, 0x4b, 0x67, 0xb0}, time.Unix(1363896240, 0)},                     // Epoch time
+	} {
+		var v interface{}
+		eq(nil, CBOR.Unmarshal(c.data, &v))
+		deq(c.v, v)
+	}
+}
+
+func TestRegisterType(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	panics := func(f func()) (p bool) {
+		defer func() { p = recover() != nil }()
+		f()
+		return
+	}
+
+	RegisterType("codec.testItem", &testItem{}) // Same registration is allowed
+	eq(true, panics(func() { RegisterType("codec.testItem", testItem{}) }))
+	eq(true, panics(func() { RegisterType("other", &testItem{}) }))
+	eq(true, panics(func() { RegisterType("nil", nil) }))
+}
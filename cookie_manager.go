@@ -7,6 +7,7 @@ A secure, cookie based session Manager implementation.
 package session
 
 import (
+	"context"
 	"net/http"
 	"time"
 )
@@ -20,6 +21,10 @@ type CookieManager struct {
 	cookieSecure     bool   // Tells if session ID cookies are to be sent only over HTTPS
 	cookieMaxAgeSec  int    // Max age for session ID cookies in seconds
 	cookiePath       string // Cookie path to use
+
+	metrics Metrics     // Metrics to report to
+	tracer  Tracer      // Tracer to create spans with
+	idGen   IDGenerator // Generator of new sessions, incoming session IDs are validated against its format
 }
 
 // CookieMngrOptions defines options that may be passed when creating a new CookieManager.
@@ -32,11 +37,30 @@ type CookieMngrOptions struct {
 	// default value is false (only HTTPS)
 	AllowHTTP bool
 
-	// Max age for session ID cookies; default value is 30 days
+	// Max age for session ID cookies; default value is 30 days.
+	// Cookies with a max age are re-issued each time the session is saved, and by the middleware
+	// on each request with a loaded session (see ReissueCookie()), so they expire max age
+	// after the last request (not after the session was created).
 	CookieMaxAge time.Duration
 
 	// Cookie path to use; default value is the root: "/"
 	CookiePath string
+
+	// Metrics to report manager operations to; default value is NopMetrics.
+	Metrics Metrics
+
+	// Tracer to create spans around manager operations with; default value is NopTracer.
+	Tracer Tracer
+
+	// ID generator of the sessions, incoming session IDs are validated against its format
+	// before the store is touched. The middleware creates new sessions with this generator
+	// (see CookieManager.NewSession()); sessions created otherwise must use the same generator
+	// (see SessOptions.IDGen), else their IDs are rejected.
+	// Default value is the default generator of sessions, which generates IDs like RandomIDGen(18),
+	// but accepts any URL-safe base64 encoded ID up to 256 chars, so sessions created with other
+	// SessOptions.IDLength values (or with IDs of the same format set in SessOptions.IDF) are not rejected.
+	// Set RandomIDGen(18) (or the generator of the sessions) to validate the format strictly.
+	IDGen IDGenerator
 }
 
 // Pointer to zero value of CookieMngrOptions to be reused for efficiency.
@@ -55,6 +79,9 @@ func NewCookieManagerOptions(store Store, o *CookieMngrOptions) Manager {
 		cookieSecure:     !o.AllowHTTP,
 		sessIDCookieName: o.SessIDCookieName,
 		cookiePath:       o.CookiePath,
+		metrics:          o.Metrics,
+		tracer:           o.Tracer,
+		idGen:            o.IDGen,
 	}
 
 	if m.sessIDCookieName == "" {
@@ -66,53 +93,129 @@ func NewCookieManagerOptions(store Store, o *CookieMngrOptions) Manager {
 	if m.cookiePath == "" {
 		m.cookiePath = "/"
 	}
+	if m.metrics == nil {
+		m.metrics = NopMetrics
+	}
+	if m.tracer == nil {
+		m.tracer = NopTracer
+	}
+	if m.idGen == nil {
+		m.idGen = defaultIDGen
+	}
 
 	return m
 }
 
 // Load is to implement Manager.Load().
+// The context of the request is passed to the Store if it implements ContextStore.
 func (m *CookieManager) Load(r *http.Request) Session {
+	ctx, span := m.tracer.Start(r.Context(), "session.Manager.Load")
+	defer span.End()
+
 	c, err := r.Cookie(m.sessIDCookieName)
 	if err != nil {
+		span.SetAttr(AttrHit, false)
+		m.count("load", "miss")
 		return nil
 	}
+	if !m.idGen.Valid(c.Value) {
+		span.SetAttr(AttrHit, false)
+		m.count("load", "invalid")
+		return nil
+	}
+	span.SetAttr(AttrSessionIDHash, SessionIDHash(c.Value))
 
-	return m.store.Load(c.Value)
+	sess := loadContext(ctx, m.store, c.Value)
+	span.SetAttr(AttrHit, sess != nil)
+	m.count("load", loadResult(sess))
+	return sess
 }
 
 // Save is to implement Manager.Save().
 func (m *CookieManager) Save(sess Session, w http.ResponseWriter) {
-	// HttpOnly: do not allow non-HTTP access to it (like javascript) to prevent stealing it...
-	// Secure: only send it over HTTPS
-	// MaxAge: to specify the max age of the cookie in seconds, else it's a session cookie and gets deleted after the browser is closed.
+	m.SaveContext(context.Background(), sess, w)
+}
+
+// SaveContext is to implement ContextManager.SaveContext().
+// The session ID cookie is only added to the response if the session is new (see Session.State()),
+// else the client already has it; except persistent cookies (see CookieMngrOptions.CookieMaxAge),
+// which are added on each save so their expiration slides. The state of the session is set to StateLoaded.
+func (m *CookieManager) SaveContext(ctx context.Context, sess Session, w http.ResponseWriter) {
+	ctx, span := m.tracer.Start(ctx, "session.Manager.Save")
+	defer span.End()
+	span.SetAttr(AttrSessionIDHash, SessionIDHash(sess.ID()))
+
+	if sess.State() == StateNew || m.cookieMaxAgeSec > 0 {
+		m.setCookie(sess, w)
+	}
 
+	saveContext(ctx, m.store, sess)
+	sess.SetState(StateLoaded)
+	m.count("save", "ok")
+}
+
+// Remove is to implement Manager.Remove().
+func (m *CookieManager) Remove(sess Session, w http.ResponseWriter) {
+	m.RemoveContext(context.Background(), sess, w)
+}
+
+// RemoveContext is to implement ContextManager.RemoveContext().
+// The state of the session is set to StateDestroyed.
+func (m *CookieManager) RemoveContext(ctx context.Context, sess Session, w http.ResponseWriter) {
+	ctx, span := m.tracer.Start(ctx, "session.Manager.Remove")
+	defer span.End()
+	span.SetAttr(AttrSessionIDHash, SessionIDHash(sess.ID()))
+
+	// Set the cookie with empty value and 0 max age
 	c := http.Cookie{
 		Name:     m.sessIDCookieName,
-		Value:    sess.ID(),
+		Value:    "",
 		Path:     m.cookiePath,
 		HttpOnly: true,
 		Secure:   m.cookieSecure,
-		MaxAge:   m.cookieMaxAgeSec,
+		MaxAge:   -1, // MaxAge<0 means delete cookie now, equivalently 'Max-Age: 0'
 	}
 	http.SetCookie(w, &c)
 
-	m.store.Save(sess)
+	removeContext(ctx, m.store, sess)
+	sess.SetState(StateDestroyed)
+	m.count("remove", "ok")
 }
 
-// Remove is to implement Manager.Remove().
-func (m *CookieManager) Remove(sess Session, w http.ResponseWriter) {
-	// Set the cookie with empty value and 0 max age
+// ReissueCookie adds the session ID cookie to the response again if it is persistent
+// (see CookieMngrOptions.CookieMaxAge), so its expiration slides; the session itself is not saved.
+// The middleware calls it for loaded sessions which were not modified.
+func (m *CookieManager) ReissueCookie(sess Session, w http.ResponseWriter) {
+	if m.cookieMaxAgeSec > 0 {
+		m.setCookie(sess, w)
+	}
+}
+
+// setCookie adds the session ID cookie of sess to the response.
+func (m *CookieManager) setCookie(sess Session, w http.ResponseWriter) {
+	// HttpOnly: do not allow non-HTTP access to it (like javascript) to prevent stealing it...
+	// Secure: only send it over HTTPS
+	// MaxAge: to specify the max age of the cookie in seconds, else it's a session cookie and gets deleted after the browser is closed.
+
 	c := http.Cookie{
 		Name:     m.sessIDCookieName,
-		Value:    "",
+		Value:    sess.ID(),
 		Path:     m.cookiePath,
 		HttpOnly: true,
 		Secure:   m.cookieSecure,
-		MaxAge:   -1, // MaxAge<0 means delete cookie now, equivalently 'Max-Age: 0'
+		MaxAge:   m.cookieMaxAgeSec,
 	}
 	http.SetCookie(w, &c)
+}
+
+// NewSession returns a new session with the ID generator of the manager.
+func (m *CookieManager) NewSession() Session {
+	return NewSessionOptions(&SessOptions{IDGen: m.idGen})
+}
 
-	m.store.Remove(sess)
+// count reports a manager operation to the metrics.
+func (m *CookieManager) count(op, result string) {
+	m.metrics.Counter(MetricManagerOps, 1, Labels{"manager": "cookie", "op": op, "result": result})
 }
 
 // Close is to implement Manager.Close().
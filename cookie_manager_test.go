@@ -1,6 +1,9 @@
 package session
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -25,3 +28,101 @@ func TestCookieManager(t *testing.T) {
 	eq(int(o.CookieMaxAge/time.Second), cmgr.CookieMaxAgeSec())
 	eq(o.CookiePath, cmgr.CookiePath())
 }
+
+func TestCookieManagerState(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	mgr := NewCookieManagerOptions(NewInMemStore(), &CookieMngrOptions{AllowHTTP: true})
+	defer mgr.Close()
+
+	// Only new sessions get a cookie:
+	s := NewSession()
+	rec := httptest.NewRecorder()
+	mgr.Save(s, rec)
+	cookies := rec.Result().Cookies()
+	eq(1, len(cookies))
+	eq(s.ID(), cookies[0].Value)
+	eq(StateLoaded, s.State())
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	s2 := mgr.Load(r)
+	neq(nil, s2)
+	eq(StateLoaded, s2.State())
+	s2.Set("a", 1)
+	eq(StateModified, s2.State())
+
+	rec = httptest.NewRecorder()
+	mgr.Save(s2, rec)
+	eq(0, len(rec.Result().Cookies()))
+	eq(StateLoaded, s2.State())
+
+	rec = httptest.NewRecorder()
+	mgr.Remove(s2, rec)
+	eq(1, len(rec.Result().Cookies()))
+	eq(StateDestroyed, s2.State())
+	eq(nil, mgr.Load(r))
+}
+
+func TestCookieManagerPersistentCookie(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	mgr := NewCookieManagerOptions(NewInMemStore(), &CookieMngrOptions{AllowHTTP: true, CookieMaxAge: time.Hour})
+	defer mgr.Close()
+
+	s := NewSession()
+	mgr.Save(s, httptest.NewRecorder())
+	eq(StateLoaded, s.State())
+
+	// Re-issued on save, so the expiration slides:
+	s.Set("a", 1)
+	rec := httptest.NewRecorder()
+	mgr.Save(s, rec)
+	cookies := rec.Result().Cookies()
+	eq(1, len(cookies))
+	eq(s.ID(), cookies[0].Value)
+	eq(3600, cookies[0].MaxAge)
+}
+
+func TestCookieManagerIDValidation(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	st := &countingStore{Store: NewInMemStore()}
+	mgr := NewCookieManagerOptions(st, &CookieMngrOptions{AllowHTTP: true, IDGen: UUIDv4})
+	defer mgr.Close()
+
+	load := func(id string) Session {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "sessid", Value: id})
+		return mgr.Load(r)
+	}
+
+	s := mgr.(*CookieManager).NewSession()
+	eq(true, UUIDv4.Valid(s.ID()))
+	mgr.Save(s, httptest.NewRecorder())
+	eq(s, load(s.ID()))
+	eq(1, st.loads)
+
+	// Malformed IDs don't reach the store:
+	eq(nil, load("malformed"))
+	eq(nil, load(NewSession().ID()))
+	eq(1, st.loads)
+
+	// Any URL-safe base64 ID is accepted by default, e.g. of sessions created with other lengths:
+	mgr = NewCookieManagerOptions(st, &CookieMngrOptions{AllowHTTP: true})
+	for _, s := range []Session{NewSession(), NewSessionOptions(&SessOptions{IDLength: 32})} {
+		mgr.Save(s, httptest.NewRecorder())
+		eq(s, load(s.ID()))
+	}
+	eq(3, st.loads)
+	eq(nil, load(""))
+	eq(nil, load(NewSession().ID()+"x"))
+	eq(nil, load(strings.Repeat("a", 300)))
+	eq(nil, load("no spaces"))
+	eq(3, st.loads)
+
+	// Strict validation:
+	mgr = NewCookieManagerOptions(st, &CookieMngrOptions{AllowHTTP: true, IDGen: RandomIDGen(18)})
+	eq(nil, load(NewSessionOptions(&SessOptions{IDLength: 32}).ID()))
+	eq(3, st.loads)
+}
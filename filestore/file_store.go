@@ -0,0 +1,496 @@
+/*
+
+Package filestore provides a session store implementation persisting sessions to files in a local directory.
+
+Each session is stored in its own file, written atomically (to a temporary file which is renamed).
+The file name is derived from the session ID, the last modification time of the file is the last accessed
+time of the session, and the file content is a small header (holding the session timeout) followed by
+the session marshalled with the codec of the store.
+
+The store keeps an in-memory expiry index of the sessions (built when the store is created), so the
+session cleaner only touches expired sessions, with the same Timeout() based semantics as the in-memory store.
+A background compaction periodically rebuilds the index and removes leftover temporary and foreign files.
+
+Sessions are not cached in memory: Load() always reads the session from its file, so changes made to a
+session are only persisted when the session is saved again (the session middleware does this automatically).
+
+*/
+
+package filestore
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-osin/session"
+	"github.com/go-osin/session/codec"
+)
+
+// File-backed session Store implementation.
+type fileStore struct {
+	dir   string      // Directory of the session files
+	codec codec.Codec // Codec used to marshal and unmarshal a Session to a byte slice
+
+	mux     *sync.Mutex          // mutex to synchronize access to expires, heap and removed, and renaming and removing session files
+	expires map[string]time.Time // Expiration times of sessions mapped from ID
+	heap    expiryHeap           // Min-heap of expiration times; may contain stale entries
+	removed map[string]bool      // Sessions removed during a compaction scan, nil if no scan is in progress
+
+	clock session.Clock // Clock to decide session timeouts and to run the session cleaner and compaction with
+	stops []func()      // Functions to stop the session cleaner and compaction
+}
+
+// StoreOptions defines options that may be passed when creating a new file session Store.
+// All fields are optional; default value will be used for any field that has the zero value.
+type StoreOptions struct {
+	// Directory to store session files in; it is created if it does not exist.
+	// Default value is the "sessions" folder in the temporary directory of the OS.
+	Dir string
+
+	// Codec used to marshal and unmarshal a Session to a byte slice;
+	// default value is codec.Gob (attribute types must be registered with gob.Register()).
+	Codec *codec.Codec
+
+	// Session cleaner check interval, default is 10 seconds.
+	SessCleanerInterval time.Duration
+
+	// Compaction interval, default is 10 minutes.
+	CompactionInterval time.Duration
+
+	// Clock to decide session timeouts and to run the session cleaner and compaction with;
+	// default value is session.SystemClock.
+	Clock session.Clock
+}
+
+// Pointer to zero value of StoreOptions to be reused for efficiency.
+var zeroStoreOptions = new(StoreOptions)
+
+// Suffix of session files, and prefix of temporary files.
+const (
+	fileSuffix = ".sess"
+	tmpPrefix  = ".tmp-"
+)
+
+// magic identifies session files, it is followed by the session timeout (int64 nanoseconds, big endian).
+var magic = []byte("GOSS")
+
+// Length of the header of session files.
+var headerLen = len(magic) + 8
+
+// Max length of session IDs, so file names do not exceed the usual 255 bytes limit of file systems.
+const maxIDLength = 180
+
+// NewStore returns a new, file session Store with the default options.
+// Default values of options are listed in the StoreOptions type.
+func NewStore() session.Store {
+	return NewStoreOptions(zeroStoreOptions)
+}
+
+// NewStoreOptions returns a new, file session Store with the specified options.
+// The expiry index is built from the existing session files (expired ones are removed).
+// The returned Store has an automatic session cleaner and compaction which run
+// in their own goroutine.
+func NewStoreOptions(o *StoreOptions) session.Store {
+	s := &fileStore{
+		dir:     o.Dir,
+		mux:     &sync.Mutex{},
+		expires: make(map[string]time.Time),
+		clock:   o.Clock,
+	}
+	if s.clock == nil {
+		s.clock = session.SystemClock
+	}
+	if s.dir == "" {
+		s.dir = filepath.Join(os.TempDir(), "sessions")
+	}
+	if o.Codec != nil {
+		s.codec = *o.Codec
+	} else {
+		s.codec = codec.Gob
+	}
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		log.Printf("Failed to create session directory: %s, error: %v", s.dir, err)
+	}
+	s.compact(s.clock.Now())
+
+	cleanerInterval := o.SessCleanerInterval
+	if cleanerInterval == 0 {
+		cleanerInterval = 10 * time.Second
+	}
+	compactionInterval := o.CompactionInterval
+	if compactionInterval == 0 {
+		compactionInterval = 10 * time.Minute
+	}
+
+	s.every(cleanerInterval, s.sweep)
+	s.every(compactionInterval, s.compact)
+
+	return s
+}
+
+// every calls f with the current time periodically until the store is closed.
+func (s *fileStore) every(interval time.Duration, f func(now time.Time)) {
+	s.stops = append(s.stops, s.clock.Every(interval, func() { f(s.clock.Now()) }))
+}
+
+// path returns the path of the file of the session specified by its id.
+func (s *fileStore) path(id string) string {
+	return filepath.Join(s.dir, base64.RawURLEncoding.EncodeToString([]byte(id))+fileSuffix)
+}
+
+// idFromName returns the session ID from a session file name.
+func idFromName(name string) (string, bool) {
+	if !strings.HasSuffix(name, fileSuffix) {
+		return "", false
+	}
+	id, err := base64.RawURLEncoding.DecodeString(strings.TrimSuffix(name, fileSuffix))
+	if err != nil {
+		return "", false
+	}
+	return string(id), true
+}
+
+// readTimeout reads the session timeout from the header of a session file.
+func readTimeout(path string) (time.Duration, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, headerLen)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return 0, err
+	}
+	return parseHeader(hdr)
+}
+
+// parseHeader parses the header of a session file, returns the session timeout.
+func parseHeader(data []byte) (time.Duration, error) {
+	if len(data) < headerLen || !bytes.Equal(data[:len(magic)], magic) {
+		return 0, errors.New("not a session file")
+	}
+	return time.Duration(binary.BigEndian.Uint64(data[len(magic):headerLen])), nil
+}
+
+// setExpires sets the expiration time of a session in the index.
+// Must be called with s.mux held.
+func (s *fileStore) setExpires(id string, exp time.Time) {
+	s.expires[id] = exp
+	heap.Push(&s.heap, expiryEntry{id: id, expires: exp})
+
+	// Every access adds an entry, rebuild the heap if it has too many stale entries:
+	if len(s.heap) > 2*len(s.expires)+1024 {
+		s.rebuildHeapLocked()
+	}
+}
+
+// rebuildHeapLocked rebuilds the heap from the expiration times, dropping stale entries.
+// Must be called with s.mux held.
+func (s *fileStore) rebuildHeapLocked() {
+	s.heap = make(expiryHeap, 0, len(s.expires))
+	for id, exp := range s.expires {
+		s.heap = append(s.heap, expiryEntry{id: id, expires: exp})
+	}
+	heap.Init(&s.heap)
+}
+
+// Load is to implement Store.Load().
+// A new Session value is returned on each call, read from the session file.
+func (s *fileStore) Load(id string) session.Session {
+	if id == "" || len(id) > maxIDLength {
+		return nil
+	}
+
+	s.mux.Lock()
+	exp, ok := s.expires[id]
+	s.mux.Unlock()
+	if !ok {
+		return nil
+	}
+	now := s.clock.Now()
+	if now.After(exp) {
+		s.removeExpired(id, now)
+		return nil
+	}
+
+	path := s.path(id)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Failed to read session file, id: %s, error: %v", id, err)
+		return nil
+	}
+	timeout, err := parseHeader(data)
+	if err != nil {
+		log.Printf("Invalid session file, id: %s, error: %v", id, err)
+		return nil
+	}
+	o, err := session.UnmarshalSession(s.codec, data[headerLen:], id)
+	if err != nil {
+		log.Printf("Failed to unmarshal session, id: %s, error: %v", id, err)
+		return nil
+	}
+	o.Timeout = timeout // Of the header
+	o.Clock, o.State = s.clock, session.StateLoaded
+	ss := session.NewSessionOptions(o)
+	ss.Access()
+
+	// Record the access:
+	if err := os.Chtimes(path, ss.Accessed(), ss.Accessed()); err != nil {
+		log.Printf("Failed to touch session file, id: %s, error: %v", id, err)
+	}
+	s.mux.Lock()
+	if _, ok := s.expires[id]; ok { // Might have been removed concurrently
+		s.setExpires(id, ss.Accessed().Add(timeout))
+	}
+	s.mux.Unlock()
+
+	return ss
+}
+
+// Save is to implement Store.Save().
+func (s *fileStore) Save(sess session.Session) {
+	id := sess.ID()
+	if id == "" || len(id) > maxIDLength {
+		log.Printf("Invalid session id for file store: %q", id)
+		return
+	}
+	tmp, err := s.write(sess)
+	if err == nil {
+		// Rename under the lock so the session cleaner can't remove the new file based on the old expiration time:
+		s.mux.Lock()
+		if err = os.Rename(tmp, s.path(id)); err == nil {
+			s.setExpires(id, sess.Accessed().Add(sess.Timeout()))
+		}
+		s.mux.Unlock()
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to save session to file, id: %s, error: %v", id, err)
+	}
+}
+
+// write writes the session into a temporary file, to be renamed to the session file.
+func (s *fileStore) write(sess session.Session) (tmp string, err error) {
+	// Marshal the session value itself (its exported fields), holding its read lock:
+	mux := sess.Mutex()
+	mux.RLock()
+	payload, err := s.codec.Marshal(sess)
+	mux.RUnlock()
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile(s.dir, tmpPrefix)
+	if err != nil {
+		return "", err
+	}
+	tmp = f.Name()
+
+	hdr := make([]byte, headerLen)
+	copy(hdr, magic)
+	binary.BigEndian.PutUint64(hdr[len(magic):], uint64(sess.Timeout()))
+	_, err = f.Write(hdr)
+	if err == nil {
+		_, err = f.Write(payload)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, sess.Accessed(), sess.Accessed())
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// Remove is to implement Store.Remove().
+func (s *fileStore) Remove(sess session.Session) {
+	s.remove(sess.ID())
+}
+
+// remove removes the session specified by its id.
+func (s *fileStore) remove(id string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	delete(s.expires, id) // Heap entry becomes stale, will be skipped
+	s.removeFileLocked(id)
+}
+
+// removeExpired removes the session specified by its id if it is still expired at now
+// (it might have been saved again since its expiration was checked).
+func (s *fileStore) removeExpired(id string, now time.Time) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if exp, ok := s.expires[id]; ok && !now.After(exp) {
+		return
+	}
+	log.Println("Session timed out:", id)
+	delete(s.expires, id)
+	s.removeFileLocked(id)
+}
+
+// removeFileLocked removes the file of the session specified by its id,
+// and records the removal if a compaction scan is in progress.
+// Must be called with s.mux held.
+func (s *fileStore) removeFileLocked(id string) {
+	if s.removed != nil {
+		s.removed[id] = true
+	}
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove session file, id: %s, error: %v", id, err)
+	}
+}
+
+// sweep removes sessions that have timed out at the specified time.
+// Thanks to the expiry index, only sessions whose expiration time has passed are touched.
+func (s *fileStore) sweep(now time.Time) {
+	var expired []string
+
+	s.mux.Lock()
+	for len(s.heap) > 0 && now.After(s.heap[0].expires) {
+		e := heap.Pop(&s.heap).(expiryEntry)
+		if exp, ok := s.expires[e.id]; ok && exp.Equal(e.expires) {
+			expired = append(expired, e.id)
+		}
+		// Else the entry is stale: the session was accessed or removed since.
+	}
+	s.mux.Unlock()
+
+	// Files are removed one by one (not holding the lock for all), re-checking the expiration
+	// as sessions might be saved again meanwhile:
+	for _, id := range expired {
+		s.removeExpired(id, now)
+	}
+}
+
+// compact rebuilds the expiry index from the session files (dropping stale heap entries),
+// removes expired session files, and leftover temporary and foreign files.
+func (s *fileStore) compact(now time.Time) {
+	s.mux.Lock()
+	s.removed = map[string]bool{} // Record removals during the scan
+	s.mux.Unlock()
+	defer func() {
+		s.mux.Lock()
+		s.removed = nil
+		s.mux.Unlock()
+	}()
+
+	if expires, ok := s.scan(now); ok {
+		s.replaceIndex(expires, now)
+	}
+}
+
+// scan reads the expiration times of sessions from the session files,
+// removes expired session files, and leftover temporary and foreign files.
+func (s *fileStore) scan(now time.Time) (expires map[string]time.Time, ok bool) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("Failed to read session directory: %s, error: %v", s.dir, err)
+		return nil, false
+	}
+
+	expires = make(map[string]time.Time, len(infos))
+	for _, fi := range infos {
+		if fi.IsDir() {
+			continue
+		}
+		path := filepath.Join(s.dir, fi.Name())
+		if strings.HasPrefix(fi.Name(), tmpPrefix) {
+			// Temporary file of an interrupted write, or of a write in progress:
+			if now.Sub(fi.ModTime()) > time.Minute {
+				os.Remove(path)
+			}
+			continue
+		}
+		id, ok := idFromName(fi.Name())
+		if !ok {
+			continue // Not ours, leave it alone
+		}
+		timeout, err := readTimeout(path)
+		if err != nil {
+			log.Printf("Removing invalid session file: %s, error: %v", path, err)
+			os.Remove(path)
+			continue
+		}
+		exp := fi.ModTime().Add(timeout)
+		if now.After(exp) {
+			s.removeExpired(id, now) // Unless saved again since the file was read
+			continue
+		}
+		expires[id] = exp
+	}
+	return expires, true
+}
+
+// replaceIndex replaces the expiry index with the expiration times read by scan at the specified time.
+func (s *fileStore) replaceIndex(expires map[string]time.Time, now time.Time) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	// Sessions removed since the scan must not be added back (unless saved again, see below):
+	for id := range s.removed {
+		delete(expires, id)
+	}
+	// Sessions might have been saved or accessed since the scan (even sessions not scanned),
+	// keep the later expiration times:
+	for id, exp := range s.expires {
+		if e, ok := expires[id]; ok && exp.After(e) || !ok && !now.After(exp) {
+			expires[id] = exp
+		}
+	}
+	s.expires = expires
+	s.rebuildHeapLocked()
+}
+
+// Close is to implement Store.Close().
+func (s *fileStore) Close() {
+	for _, stop := range s.stops {
+		stop()
+	}
+}
+
+// expiryEntry is an entry of expiryHeap.
+type expiryEntry struct {
+	id      string
+	expires time.Time
+}
+
+// expiryHeap is a min-heap of expiry entries ordered by expiration time.
+// It implements heap.Interface.
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].expires.Before(h[j].expires) }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiryEntry)) }
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
@@ -0,0 +1,174 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+
+	"github.com/go-osin/session"
+	"github.com/go-osin/session/clocktest"
+	"github.com/go-osin/session/sessiontest"
+)
+
+func TestFileStore(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	dir := t.TempDir()
+	clock := clocktest.New(time.Now())
+	st := NewStoreOptions(&StoreOptions{Dir: dir, Clock: clock})
+	defer st.Close()
+
+	eq(nil, st.Load("asdf"))
+
+	s := session.NewSessionOptions(&session.SessOptions{
+		CAttrs:  map[string]interface{}{"user": "bob"},
+		Timeout: time.Hour,
+		Clock:   clock,
+	})
+	s.Set("count", 1)
+	st.Save(s)
+
+	clock.Advance(10 * time.Millisecond)
+	s2 := st.Load(s.ID())
+	neq(nil, s2)
+	eq(s.ID(), s2.ID())
+	eq("bob", s2.Getp("user"))
+	eq(1, s2.Get("count"))
+	eq(time.Hour, s2.Timeout())
+	eq(s.Created().UnixNano(), s2.Created().UnixNano())
+	neq(s2.Accessed(), s2.Created())
+
+	st.Remove(s)
+	eq(nil, st.Load(s.ID()))
+	_, err := os.Stat(st.(*fileStore).path(s.ID()))
+	eq(true, os.IsNotExist(err))
+}
+
+func TestFileStoreSessCleaner(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	dir := t.TempDir()
+	clock := clocktest.New(time.Now())
+	st := NewStoreOptions(&StoreOptions{Dir: dir, SessCleanerInterval: 10 * time.Millisecond, Clock: clock})
+	defer st.Close()
+
+	s := session.NewSessionOptions(&session.SessOptions{Timeout: 50 * time.Millisecond, Clock: clock})
+	st.Save(s)
+	eq(s.ID(), st.Load(s.ID()).ID())
+
+	clock.Advance(30 * time.Millisecond)
+	eq(s.ID(), st.Load(s.ID()).ID()) // Access extends the timeout
+
+	clock.Advance(40 * time.Millisecond)
+	_, err := os.Stat(st.(*fileStore).path(s.ID()))
+	eq(nil, err)
+
+	clock.Advance(20 * time.Millisecond) // Timed out, the cleaner runs
+	_, err = os.Stat(st.(*fileStore).path(s.ID()))
+	eq(true, os.IsNotExist(err))
+	eq(nil, st.Load(s.ID()))
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	dir := t.TempDir()
+	clock := clocktest.New(time.Now())
+	st := NewStoreOptions(&StoreOptions{Dir: dir, Clock: clock})
+	s1 := session.NewSessionOptions(&session.SessOptions{Clock: clock})
+	s2 := session.NewSessionOptions(&session.SessOptions{Timeout: 20 * time.Millisecond, Clock: clock})
+	st.Save(s1)
+	st.Save(s2)
+	st.Close()
+
+	// Leftover temporary file of an interrupted write, and a foreign file:
+	tmp := filepath.Join(dir, tmpPrefix+"123")
+	eq(nil, ioutil.WriteFile(tmp, []byte("x"), 0600))
+	old := clock.Now().Add(-time.Hour)
+	eq(nil, os.Chtimes(tmp, old, old))
+	foreign := filepath.Join(dir, "readme.txt")
+	eq(nil, ioutil.WriteFile(foreign, []byte("x"), 0600))
+
+	clock.Advance(30 * time.Millisecond) // Let s2 expire
+
+	st = NewStoreOptions(&StoreOptions{Dir: dir, Clock: clock})
+	defer st.Close()
+
+	eq(s1.ID(), st.Load(s1.ID()).ID())
+	eq(nil, st.Load(s2.ID()))
+	_, err := os.Stat(st.(*fileStore).path(s2.ID()))
+	eq(true, os.IsNotExist(err))
+	_, err = os.Stat(tmp)
+	eq(true, os.IsNotExist(err))
+	_, err = os.Stat(foreign)
+	eq(nil, err)
+}
+
+func TestFileStoreSaveDuringCompaction(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	st := NewStoreOptions(&StoreOptions{Dir: t.TempDir()}).(*fileStore)
+	defer st.Close()
+
+	s1, s3 := session.NewSession(), session.NewSession()
+	st.Save(s1)
+	st.Save(s3)
+
+	// Sessions saved and removed between scanning the directory and replacing the index (like compact does):
+	now := time.Now()
+	st.mux.Lock()
+	st.removed = map[string]bool{}
+	st.mux.Unlock()
+	expires, ok := st.scan(now)
+	eq(true, ok)
+	s2 := session.NewSession()
+	st.Save(s2)
+	s1.Access()
+	st.Save(s1)
+	st.Remove(s3)
+	st.replaceIndex(expires, now)
+
+	st.mux.Lock()
+	eq(s1.Accessed().Add(s1.Timeout()), st.expires[s1.ID()]) // The later expiration is kept
+	_, ok = st.expires[s3.ID()]
+	eq(false, ok) // Removed session is not added back
+	st.mux.Unlock()
+	neq(nil, st.Load(s1.ID()))
+	neq(nil, st.Load(s2.ID()))
+}
+
+func TestFileStoreSaveExpired(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	clock := clocktest.New(time.Now())
+	st := NewStoreOptions(&StoreOptions{Dir: t.TempDir(), Clock: clock}).(*fileStore)
+	defer st.Close()
+
+	s := session.NewSessionOptions(&session.SessOptions{Timeout: time.Minute, Clock: clock})
+	st.Save(s)
+
+	// Expired session saved again after the session cleaner found it expired, but before it removed the file:
+	clock.Advance(2 * time.Minute)
+	s.Access()
+	st.Save(s)
+	st.removeExpired(s.ID(), clock.Now())
+	neq(nil, st.Load(s.ID()))
+	_, err := os.Stat(st.path(s.ID()))
+	eq(nil, err)
+}
+
+func TestFileStoreConformance(t *testing.T) {
+	clock := clocktest.New(time.Now())
+	sessiontest.Run(t, &sessiontest.Options{
+		NewStore: func(t *testing.T) session.Store {
+			return NewStoreOptions(&StoreOptions{Dir: t.TempDir(), SessCleanerInterval: 10 * time.Millisecond, Clock: clock})
+		},
+		Timeout:     400 * time.Millisecond,
+		ExpiryDelay: 10 * time.Millisecond,
+		Clock:       clock,
+	})
+}
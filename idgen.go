@@ -0,0 +1,251 @@
+/*
+
+Session ID generators.
+
+*/
+
+package session
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// IDGenerator generates session IDs, and validates the format of incoming ones.
+type IDGenerator interface {
+	// NewID returns a new, unique session ID.
+	// It panics if it fails to read random bytes (e.g. entropy is unavailable),
+	// as sessions must not be created with predictable IDs.
+	NewID() string
+
+	// Valid tells if id has the format of IDs returned by NewID.
+	// Managers use it to reject malformed IDs before touching the store.
+	Valid(id string) bool
+}
+
+// randReader is the source of random bytes of the ID generators.
+var randReader io.Reader = rand.Reader
+
+// randBytes fills b with random bytes read from randReader.
+// It panics if reading fails.
+func randBytes(b []byte) {
+	if _, err := io.ReadFull(randReader, b); err != nil {
+		panic(fmt.Sprintf("session: failed to read random bytes for session ID: %v", err))
+	}
+}
+
+// RandomIDGen returns an IDGenerator generating IDs of length random bytes, encoded with
+// URL-safe base64; the length of IDs is length multiplied by 4/3 chars (rounded up to a multiple of 4).
+// The default generator generates IDs like RandomIDGen(18) (see SessOptions.IDGen and CookieMngrOptions.IDGen),
+// but unlike RandomIDGen(18), it accepts IDs of any length as valid.
+// Lengths less than 16 bytes are not recommended; RandomIDGen panics if length is not positive.
+func RandomIDGen(length int) IDGenerator {
+	if length <= 0 {
+		panic("session: non-positive ID length")
+	}
+	return randomIDGen(length)
+}
+
+// defaultIDGen is the default ID generator.
+var defaultIDGen IDGenerator = defaultGen{randomIDGen(18)}
+
+// maxIDLength is the max length of IDs accepted by the default ID generator.
+const maxIDLength = 256
+
+// defaultGen is the default IDGenerator: it generates IDs of its randomIDGen, and accepts any
+// URL-safe base64 encoded ID not longer than maxIDLength, so IDs of sessions created with other
+// lengths (see SessOptions.IDLength) or before IDs were validated remain valid.
+type defaultGen struct {
+	randomIDGen
+}
+
+// Valid is to implement IDGenerator.Valid().
+func (defaultGen) Valid(id string) bool {
+	if id == "" || len(id) > maxIDLength {
+		return false
+	}
+	_, err := base64.URLEncoding.DecodeString(id)
+	return err == nil
+}
+
+// timedIDGen is implemented by ID generators embedding a timestamp in IDs, so sessions can pass
+// the time of their clock (see SessOptions.Clock).
+type timedIDGen interface {
+	// newID returns a new ID with the timestamp now.
+	newID(now time.Time) string
+}
+
+// newID returns a new ID of g, embedding the timestamp now if g supports it.
+func newID(g IDGenerator, now time.Time) string {
+	if tg, ok := g.(timedIDGen); ok {
+		return tg.newID(now)
+	}
+	return g.NewID()
+}
+
+// randomIDGen is the IDGenerator of random bytes encoded with URL-safe base64.
+type randomIDGen int
+
+// NewID is to implement IDGenerator.NewID().
+func (g randomIDGen) NewID() string {
+	r := make([]byte, g)
+	randBytes(r)
+	return base64.URLEncoding.EncodeToString(r)
+}
+
+// Valid is to implement IDGenerator.Valid().
+func (g randomIDGen) Valid(id string) bool {
+	if len(id) != base64.URLEncoding.EncodedLen(int(g)) {
+		return false
+	}
+	_, err := base64.URLEncoding.DecodeString(id)
+	return err == nil
+}
+
+// UUIDv4 is an IDGenerator generating random UUIDs (RFC 9562 version 4)
+// in their canonical, lowercase textual form, e.g. "f47ac10b-58cc-4372-a567-0e02b2c3d479".
+var UUIDv4 IDGenerator = uuidGen(4)
+
+// UUIDv7 is an IDGenerator generating time-ordered UUIDs (RFC 9562 version 7):
+// a millisecond Unix timestamp followed by random bits, in their canonical, lowercase textual form.
+// IDs generated in later milliseconds sort after earlier ones, which suits B-tree indexed stores.
+// The timestamp is taken from the clock of the session (see SessOptions.Clock), SystemClock when NewID is called directly.
+var UUIDv7 IDGenerator = uuidGen(7)
+
+// uuidGen is the IDGenerator of UUIDs of the given version.
+type uuidGen byte
+
+// NewID is to implement IDGenerator.NewID().
+func (g uuidGen) NewID() string {
+	return g.newID(SystemClock.Now())
+}
+
+// newID is to implement timedIDGen.newID().
+func (g uuidGen) newID(now time.Time) string {
+	var u [16]byte
+	randBytes(u[:])
+	if g == 7 {
+		putMillis48(u[:], now)
+	}
+	u[6] = u[6]&0x0f | byte(g)<<4 // Version
+	u[8] = u[8]&0x3f | 0x80       // Variant: RFC 9562
+
+	b := make([]byte, 36)
+	hex.Encode(b[0:8], u[0:4])
+	hex.Encode(b[9:13], u[4:6])
+	hex.Encode(b[14:18], u[6:8])
+	hex.Encode(b[19:23], u[8:10])
+	hex.Encode(b[24:], u[10:])
+	b[8], b[13], b[18], b[23] = '-', '-', '-', '-'
+	return string(b)
+}
+
+// Valid is to implement IDGenerator.Valid().
+func (g uuidGen) Valid(id string) bool {
+	if len(id) != 36 || id[14] != '0'+byte(g) || !strings.ContainsRune("89ab", rune(id[19])) {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		switch c := id[i]; i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ULID is an IDGenerator generating ULIDs: a millisecond Unix timestamp followed by 80 random bits,
+// encoded with Crockford's base32 into 26 chars, e.g. "01ARZ3NDEKTSV4RRFFQ69G5FAV".
+// IDs generated in later milliseconds sort after earlier ones.
+// The timestamp is taken from the clock of the session (see SessOptions.Clock), SystemClock when NewID is called directly.
+var ULID IDGenerator = ulidGen{}
+
+// crockford is the alphabet of Crockford's base32 encoding.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidGen is the IDGenerator of ULIDs.
+type ulidGen struct{}
+
+// NewID is to implement IDGenerator.NewID().
+func (g ulidGen) NewID() string {
+	return g.newID(SystemClock.Now())
+}
+
+// newID is to implement timedIDGen.newID().
+func (ulidGen) newID(now time.Time) string {
+	var u [16]byte
+	randBytes(u[6:])
+	putMillis48(u[:], now)
+
+	// 128 bits in 26 chars of 5 bits, the first char holds the top 3 bits only:
+	hi, lo := binary.BigEndian.Uint64(u[:8]), binary.BigEndian.Uint64(u[8:])
+	b := make([]byte, 26)
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(b)
+}
+
+// Valid is to implement IDGenerator.Valid().
+func (ulidGen) Valid(id string) bool {
+	if len(id) != 26 || id[0] > '7' { // First char above '7' would overflow 128 bits
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if strings.IndexByte(crockford, id[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// putMillis48 puts the Unix time of t in milliseconds into the first 6 bytes of b (big endian).
+func putMillis48(b []byte, t time.Time) {
+	ms := uint64(t.UnixMilli())
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+}
+
+// PrefixedIDGen returns an IDGenerator generating IDs of g with prefix prepended,
+// e.g. to embed the shard or region owning the session: PrefixedIDGen("eu1.", UUIDv7).
+// IDs are valid if they have the prefix and the rest is valid for g.
+func PrefixedIDGen(prefix string, g IDGenerator) IDGenerator {
+	return &prefixedIDGen{prefix: prefix, g: g}
+}
+
+// prefixedIDGen is the IDGenerator of prefixed IDs.
+type prefixedIDGen struct {
+	prefix string      // Prefix of the IDs
+	g      IDGenerator // Generator of the rest of the IDs
+}
+
+// NewID is to implement IDGenerator.NewID().
+func (p *prefixedIDGen) NewID() string {
+	return p.prefix + p.g.NewID()
+}
+
+// newID is to implement timedIDGen.newID().
+func (p *prefixedIDGen) newID(now time.Time) string {
+	return p.prefix + newID(p.g, now)
+}
+
+// Valid is to implement IDGenerator.Valid().
+func (p *prefixedIDGen) Valid(id string) bool {
+	return strings.HasPrefix(id, p.prefix) && p.g.Valid(id[len(p.prefix):])
+}
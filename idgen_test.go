@@ -0,0 +1,108 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/go-osin/session/clocktest"
+	"github.com/icza/mighty"
+)
+
+func TestIDGenerators(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	for _, c := range []struct {
+		name    string
+		g       IDGenerator
+		length  int
+		invalid []string
+	}{
+		{"random", RandomIDGen(18), 24, []string{"", "short", strings.Repeat("a", 23) + "!", strings.Repeat("a", 25)}},
+		{"uuidv4", UUIDv4, 36, []string{"", "f47ac10b-58cc-7372-a567-0e02b2c3d479", "f47ac10b-58cc-4372-c567-0e02b2c3d479",
+			"F47AC10B-58CC-4372-A567-0E02B2C3D479", "f47ac10b058cc-4372-a567-0e02b2c3d479"}},
+		{"uuidv7", UUIDv7, 36, []string{"", "f47ac10b-58cc-4372-a567-0e02b2c3d479", "0190a5c8-3b1e-7f4e-8g2d-4e3b2a1c0d9f"}},
+		{"ulid", ULID, 26, []string{"", "01ARZ3NDEKTSV4RRFFQ69G5FA", "81ARZ3NDEKTSV4RRFFQ69G5FAV", "01ARZ3NDEKTSV4RRFFQ69G5FAU"}},
+		{"prefixed", PrefixedIDGen("eu1.", ULID), 30, []string{"01ARZ3NDEKTSV4RRFFQ69G5FAV", "us1.01ARZ3NDEKTSV4RRFFQ69G5FAV", "eu1.x"}},
+	} {
+		ids := map[string]bool{}
+		for i := 0; i < 100; i++ {
+			id := c.g.NewID()
+			eq(c.length, len(id))
+			eq(true, c.g.Valid(id))
+			ids[id] = true
+		}
+		eq(100, len(ids)) // Unique
+		for _, id := range c.invalid {
+			if c.g.Valid(id) {
+				t.Errorf("[%s] Expected invalid: %q", c.name, id)
+			}
+		}
+	}
+
+	eq(true, UUIDv4.Valid("f47ac10b-58cc-4372-a567-0e02b2c3d479"))
+	eq(true, ULID.Valid("01ARZ3NDEKTSV4RRFFQ69G5FAV"))
+	eq(true, strings.HasPrefix(PrefixedIDGen("eu1.", UUIDv4).NewID(), "eu1."))
+
+	// Time-ordered generators:
+	clock := clocktest.New(time.Now())
+	for _, g := range []IDGenerator{UUIDv7, ULID} {
+		var ids []string
+		for i := 0; i < 3; i++ {
+			ids = append(ids, NewSessionOptions(&SessOptions{IDGen: g, Clock: clock}).ID())
+			clock.Advance(time.Millisecond)
+		}
+		eq(true, sort.StringsAreSorted(ids))
+	}
+}
+
+func TestIDGeneratorEntropy(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	defer func(r io.Reader) { randReader = r }(randReader)
+	randReader = iotest.ErrReader(errors.New("no entropy"))
+
+	for _, g := range []IDGenerator{RandomIDGen(18), UUIDv4, UUIDv7, ULID} {
+		func() {
+			defer func() {
+				r := recover()
+				eq(true, r != nil)
+				eq(true, strings.Contains(r.(string), "no entropy"))
+			}()
+			g.NewID()
+		}()
+	}
+}
+
+func TestRandomIDGenLength(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	for _, length := range []int{0, -1} {
+		func() {
+			defer func() { eq(true, recover() != nil) }()
+			RandomIDGen(length)
+		}()
+	}
+}
+
+func TestSessOptionsIDGen(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	s := NewSessionOptions(&SessOptions{IDGen: UUIDv4})
+	eq(true, UUIDv4.Valid(s.ID()))
+	s = NewSessionOptions(&SessOptions{IDGen: UUIDv4, IDF: "given"})
+	eq("given", s.ID())
+
+	// Timestamps of IDs are taken from the clock of the session:
+	clock := clocktest.New(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	ms := clock.Now().UnixMilli() // 0x016f6435cc88
+	s = NewSessionOptions(&SessOptions{IDGen: UUIDv7, Clock: clock})
+	eq(fmt.Sprintf("%08x-%04x", ms>>16, ms&0xffff), s.ID()[:13])
+	s = NewSessionOptions(&SessOptions{IDGen: PrefixedIDGen("eu1.", ULID), Clock: clock})
+	eq("eu1.01DXJ3BK48", s.ID()[:14])
+}
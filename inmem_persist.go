@@ -0,0 +1,479 @@
+/*
+
+Snapshot and journal persistence of the in-memory session store.
+
+Snapshot and journal files are sequences of records. A record is an operation byte
+followed by the uvarint length of the payload and the payload itself.
+Payload of a save record is the session marshalled with the codec of the store,
+payload of a remove record is the session ID, payload of an access record is the access time
+(Unix nanoseconds, 8 bytes big endian) followed by the session ID.
+
+*/
+
+package session
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-osin/session/codec"
+)
+
+// Operations of persistence records.
+const (
+	recSave   byte = 's'
+	recRemove byte = 'r'
+	recAccess byte = 'a'
+)
+
+// maxRecordSize is the max payload size of a persistence record accepted when reading.
+const maxRecordSize = 64 << 20
+
+// inMemPersister persists the sessions of an inMemStore into a snapshot file and an optional journal file.
+type inMemPersister struct {
+	snapshotPath string      // Path of the snapshot file
+	journalPath  string      // Path of the journal file, empty if journal is disabled
+	codec        codec.Codec // Codec used to marshal and unmarshal sessions
+	clock        Clock       // Clock of restored sessions
+
+	snapMux sync.Mutex // mutex to serialize snapshots
+
+	jmux     sync.Mutex    // mutex to synchronize access to the journal
+	journal  *os.File      // Journal file, nil if journal is disabled or is closed
+	jw       *bufio.Writer // Buffered writer of the journal
+	jpending bool          // Tells if there are journal writes not yet synced to disk
+}
+
+// newInMemPersister returns a new inMemPersister for the store options, nil if persistence is not enabled.
+func newInMemPersister(o *InMemStoreOptions, shard string) *inMemPersister {
+	if o.SnapshotPath == "" {
+		return nil
+	}
+	p := &inMemPersister{snapshotPath: o.SnapshotPath, clock: clockOrSystem(o.Clock)}
+	if shard != "" {
+		p.snapshotPath += "." + shard
+	}
+	if o.Journal {
+		p.journalPath = p.snapshotPath + ".journal"
+	}
+	if o.Codec != nil {
+		p.codec = *o.Codec
+	} else {
+		p.codec = codec.Gob
+	}
+	return p
+}
+
+// marshal marshals a session into a payload of a save record.
+func (p *inMemPersister) marshal(sess Session) ([]byte, error) {
+	rec := &sessionImpl{
+		IDF:       sess.ID(),
+		CreatedF:  sess.Created(),
+		AccessedF: sess.Accessed(),
+		AttrsF:    sess.Values(),
+		TimeoutF:  sess.Timeout(),
+	}
+	if si, ok := sess.(*sessionImpl); ok {
+		rec.CAttrsF = si.CAttrsF
+	}
+	return p.codec.Marshal(rec)
+}
+
+// unmarshal unmarshals a session from a payload of a save record.
+func (p *inMemPersister) unmarshal(data []byte) (*sessionImpl, error) {
+	sess := &sessionImpl{}
+	if err := p.codec.Unmarshal(data, sess); err != nil {
+		return nil, err
+	}
+	// Mutex is not marshaled, so create a new one:
+	sess.mux = &sync.RWMutex{}
+	sess.codec = &p.codec
+	sess.clock = p.clock
+	sess.stateF = StateLoaded
+	if sess.AttrsF == nil {
+		sess.AttrsF = make(map[string]interface{})
+	}
+	return sess, nil
+}
+
+// writeRecord writes a persistence record to w.
+func writeRecord(w io.Writer, op byte, payload []byte) error {
+	var hdr [1 + binary.MaxVarintLen64]byte
+	hdr[0] = op
+	n := binary.PutUvarint(hdr[1:], uint64(len(payload)))
+	if _, err := w.Write(hdr[:1+n]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readRecords reads persistence records from the file specified by its path, and calls f with each.
+// A missing file is not an error. A truncated last record (e.g. due to a crash while writing it) is ignored.
+func readRecords(path string, f func(op byte, payload []byte)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil // Truncated record
+		}
+		if size > maxRecordSize {
+			return fmt.Errorf("invalid record size: %d", size)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil // Truncated record
+		}
+		f(op, payload)
+	}
+}
+
+// snapshotPaths returns the paths of the snapshot files of the store with the specified snapshot path,
+// of any layout of the store: the path itself (store without shards) and the path with a shard number appended
+// (sharded store, with any number of shards). Paths of which only the journal file exists are included.
+func snapshotPaths(path string) []string {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to list session snapshots of %s: %v", path, err)
+		}
+		return nil
+	}
+
+	base := filepath.Base(path)
+	var paths []string
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".journal")
+		if name != base {
+			shard := strings.TrimPrefix(name, base+".")
+			if shard == name || shard == "" || strings.Trim(shard, "0123456789") != "" {
+				continue
+			}
+		}
+		if !seen[name] {
+			seen[name] = true
+			paths = append(paths, filepath.Join(filepath.Dir(path), name))
+		}
+	}
+	return paths
+}
+
+// restore reads sessions from the specified snapshot files and their journal files, and calls add with each
+// session which has not yet expired at the specified time, in the order they were saved.
+func (p *inMemPersister) restore(paths []string, now time.Time, add func(sess *sessionImpl)) {
+	sessions := make(map[string]*sessionImpl)
+	var order []string
+
+	apply := func(op byte, payload []byte) {
+		switch op {
+		case recSave:
+			sess, err := p.unmarshal(payload)
+			if err != nil {
+				log.Printf("Failed to restore session: %v", err)
+				return
+			}
+			if sessions[sess.IDF] == nil {
+				order = append(order, sess.IDF)
+			}
+			sessions[sess.IDF] = sess
+		case recRemove:
+			delete(sessions, string(payload))
+		case recAccess:
+			if len(payload) < 8 {
+				return
+			}
+			if sess := sessions[string(payload[8:])]; sess != nil {
+				sess.AccessedF = time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+			}
+		}
+	}
+
+	for _, path := range paths {
+		if err := readRecords(path, apply); err != nil {
+			log.Printf("Failed to read session snapshot %s: %v", path, err)
+		}
+		// Journal is read even if it is disabled now: it may hold writes of a crashed run which had it enabled.
+		if err := readRecords(path+".journal", apply); err != nil {
+			log.Printf("Failed to read session journal %s: %v", path+".journal", err)
+		}
+	}
+
+	restored := 0
+	for _, id := range order {
+		sess := sessions[id]
+		if sess == nil || now.Sub(sess.AccessedF) > sess.TimeoutF {
+			continue // Removed or expired
+		}
+		add(sess)
+		restored++
+	}
+	log.Printf("Sessions restored from %v: %d", paths, restored)
+}
+
+// startPersisters restores persisted sessions into the shards of a store (a single shard if the store
+// is not sharded), routing each session to its shard by shard(), and starts the persisters of the shards.
+// Sessions are restored from the files of any layout of the store (see snapshotPaths()), so changing the number
+// of shards between restarts does not lose sessions. Files not used by the current layout are removed
+// once the restored sessions are saved into the snapshots of the shards.
+func startPersisters(o *InMemStoreOptions, shards []*inMemStore, shard func(id string) *inMemStore) {
+	paths := snapshotPaths(o.SnapshotPath)
+	shards[0].persister.restore(paths, shards[0].clock.Now(), func(sess *sessionImpl) {
+		shard(sess.IDF).addLocked(sess) // No need locking, store is not yet published
+	})
+
+	used := make(map[string]bool)
+	var failed bool
+	for _, s := range shards {
+		used[s.persister.snapshotPath] = true
+		if s.persister.journalPath == "" {
+			removeFile(s.persister.snapshotPath + ".journal") // Compacted into the snapshot
+		}
+		if err := s.startPersister(o); err != nil {
+			log.Printf("Failed to save session snapshot: %v", err)
+			failed = true
+		}
+	}
+	if failed {
+		return // Keep the files of other layouts, they may hold sessions not in the snapshots
+	}
+	for _, path := range paths {
+		if !used[path] {
+			removeFile(path)
+			removeFile(path + ".journal")
+		}
+	}
+}
+
+// removeFile removes the file specified by its path; a missing file is not an error.
+func removeFile(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove session file %s: %v", path, err)
+	}
+}
+
+// openJournal opens the journal file for appending.
+func (p *inMemPersister) openJournal() error {
+	if p.journalPath == "" {
+		return nil
+	}
+
+	p.jmux.Lock()
+	defer p.jmux.Unlock()
+
+	f, err := os.OpenFile(p.journalPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	p.journal, p.jw = f, bufio.NewWriter(f)
+	return nil
+}
+
+// journalSave writes a save record of the session to the journal.
+func (p *inMemPersister) journalSave(sess Session) {
+	if p.journalPath == "" {
+		return
+	}
+	payload, err := p.marshal(sess)
+	if err != nil {
+		log.Printf("Failed to marshal session to journal, id: %s, error: %v", sess.ID(), err)
+		return
+	}
+	p.journalWrite(recSave, payload)
+}
+
+// journalRemove writes a remove record of the session specified by its id to the journal.
+func (p *inMemPersister) journalRemove(id string) {
+	if p.journalPath == "" {
+		return
+	}
+	p.journalWrite(recRemove, []byte(id))
+}
+
+// journalAccess writes an access record of the session to the journal,
+// so sessions accessed since they were saved are not restored with their old access time.
+func (p *inMemPersister) journalAccess(sess Session) {
+	if p.journalPath == "" {
+		return
+	}
+	id := sess.ID()
+	payload := make([]byte, 8+len(id))
+	binary.BigEndian.PutUint64(payload, uint64(sess.Accessed().UnixNano()))
+	copy(payload[8:], id)
+	p.journalWrite(recAccess, payload)
+}
+
+// journalWrite writes a record to the journal.
+// The record is buffered, it is written to disk by syncJournal().
+func (p *inMemPersister) journalWrite(op byte, payload []byte) {
+	p.jmux.Lock()
+	defer p.jmux.Unlock()
+
+	if p.journal == nil {
+		return // Closed
+	}
+	if err := writeRecord(p.jw, op, payload); err != nil {
+		log.Printf("Failed to write session journal: %v", err)
+	}
+	p.jpending = true
+}
+
+// syncJournal flushes buffered journal records and syncs the journal file to disk.
+func (p *inMemPersister) syncJournal() {
+	p.jmux.Lock()
+	defer p.jmux.Unlock()
+
+	p.syncJournalLocked()
+}
+
+// syncJournalLocked is like syncJournal but must be called with p.jmux held.
+func (p *inMemPersister) syncJournalLocked() {
+	if p.journal == nil || !p.jpending {
+		return
+	}
+	err := p.jw.Flush()
+	if err == nil {
+		err = p.journal.Sync()
+	}
+	if err != nil {
+		log.Printf("Failed to sync session journal: %v", err)
+		return
+	}
+	p.jpending = false
+}
+
+// snapshot writes the sessions into a new snapshot file which atomically replaces the previous one,
+// and truncates the journal.
+// Writing into the store must be prevented by the caller until snapshot returns
+// (so no journal records get lost by truncation). Sessions may be accessed meanwhile,
+// access records written to the journal during the snapshot are kept.
+func (p *inMemPersister) snapshot(sessions map[string]Session) error {
+	p.snapMux.Lock()
+	defer p.snapMux.Unlock()
+
+	start, err := p.journalSize()
+	if err != nil {
+		return err
+	}
+
+	tmp := p.snapshotPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, sess := range sessions {
+		payload, merr := p.marshal(sess)
+		if merr != nil {
+			log.Printf("Failed to marshal session to snapshot, id: %s, error: %v", sess.ID(), merr)
+			continue
+		}
+		if err = writeRecord(w, recSave, payload); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, p.snapshotPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Snapshot contains everything but the records written since it started, the rest of the journal
+	// can be truncated:
+	p.jmux.Lock()
+	defer p.jmux.Unlock()
+
+	if p.journal == nil {
+		return nil
+	}
+	end, err := p.journalSizeLocked()
+	if err != nil {
+		return err
+	}
+	tail := make([]byte, end-start)
+	if _, err := p.journal.ReadAt(tail, start); err != nil {
+		return errors.New("failed to read journal: " + err.Error())
+	}
+	p.jw.Reset(p.journal)
+	p.jpending = false
+	if err := p.journal.Truncate(0); err != nil {
+		return errors.New("failed to truncate journal: " + err.Error())
+	}
+	if len(tail) > 0 {
+		p.jw.Write(tail)
+		p.jpending = true
+	}
+	return nil
+}
+
+// journalSize flushes buffered journal records and returns the size of the journal file,
+// 0 if the journal is disabled or is closed.
+func (p *inMemPersister) journalSize() (int64, error) {
+	p.jmux.Lock()
+	defer p.jmux.Unlock()
+
+	return p.journalSizeLocked()
+}
+
+// journalSizeLocked is like journalSize but must be called with p.jmux held.
+func (p *inMemPersister) journalSizeLocked() (int64, error) {
+	if p.journal == nil {
+		return 0, nil
+	}
+	if err := p.jw.Flush(); err != nil {
+		return 0, errors.New("failed to flush journal: " + err.Error())
+	}
+	fi, err := p.journal.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// closeJournal syncs and closes the journal file.
+func (p *inMemPersister) closeJournal() {
+	p.jmux.Lock()
+	defer p.jmux.Unlock()
+
+	p.syncJournalLocked()
+	if p.journal != nil {
+		p.journal.Close()
+		p.journal = nil
+	}
+}
@@ -0,0 +1,151 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-osin/session/clocktest"
+	"github.com/icza/mighty"
+)
+
+func TestInMemStoreSnapshot(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	clock := clocktest.New(time.Now())
+	path := filepath.Join(t.TempDir(), "sessions")
+	o := &InMemStoreOptions{SnapshotPath: path, Clock: clock}
+
+	st := NewInMemStoreOptions(o)
+	s1 := NewSessionOptions(&SessOptions{
+		CAttrs: map[string]interface{}{"user": "bob"},
+		Attrs:  map[string]interface{}{"count": 1},
+		Clock:  clock,
+	})
+	s2 := NewSessionOptions(&SessOptions{Timeout: 20 * time.Millisecond, Clock: clock})
+	s3 := NewSession()
+	st.Save(s1)
+	st.Save(s2)
+	st.Save(s3)
+	st.Remove(s3)
+	st.Close()
+
+	clock.Advance(30 * time.Millisecond) // Let s2 expire
+
+	st = NewInMemStoreOptions(o)
+	defer st.Close()
+
+	s := st.Load(s1.ID())
+	eq(true, s != nil)
+	eq("bob", s.Getp("user"))
+	eq(1, s.Get("count"))
+	eq(s1.Created().UnixNano(), s.Created().UnixNano())
+	eq(s1.Timeout(), s.Timeout())
+	eq(nil, st.Load(s2.ID())) // Expired
+	eq(nil, st.Load(s3.ID())) // Removed
+}
+
+func TestInMemStoreJournal(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	path := filepath.Join(t.TempDir(), "sessions")
+	o := &InMemStoreOptions{SnapshotPath: path, Journal: true, JournalSyncInterval: time.Hour}
+
+	st := NewInMemStoreOptions(o).(*inMemStore)
+	s1, s2 := NewSession(), NewSession()
+	st.Save(s1)
+	st.Save(s2)
+	st.Remove(s2)
+	s1.Set("a", "b")
+	st.Save(s1)
+	st.persister.syncJournal()
+
+	// Simulate a crash: stop the store without saving a snapshot
+	for _, stop := range st.stops {
+		stop()
+	}
+	st.persister.journal.Close()
+
+	fi, err := os.Stat(path + ".journal")
+	eq(nil, err)
+	eq(true, fi.Size() > 0)
+
+	st2 := NewInMemStoreOptions(o)
+	defer st2.Close()
+
+	s := st2.Load(s1.ID())
+	eq(true, s != nil)
+	eq("b", s.Get("a"))
+	eq(nil, st2.Load(s2.ID()))
+
+	// Journal is compacted into the snapshot on restore:
+	fi, err = os.Stat(path + ".journal")
+	eq(nil, err)
+	eq(int64(0), fi.Size())
+}
+
+func TestInMemStoreSnapshotShards(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	path := filepath.Join(t.TempDir(), "sessions")
+	exists := func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{SnapshotPath: path})
+	var ss []Session
+	for i := 0; i < 20; i++ {
+		s := NewSession()
+		st.Save(s)
+		ss = append(ss, s)
+	}
+	st.Close()
+
+	// Number of shards may change between restarts:
+	for _, shards := range []int{4, 2, 0} {
+		st = NewInMemStoreOptions(&InMemStoreOptions{SnapshotPath: path, Shards: shards})
+		for _, s := range ss {
+			if st.Load(s.ID()) == nil {
+				t.Errorf("Session not restored with %d shards: %s", shards, s.ID())
+			}
+		}
+		eq(len(ss), len(st.(Lister).IDs()))
+		st.Close()
+	}
+
+	// Files of other layouts are removed:
+	eq(true, exists(path))
+	for _, name := range []string{"0", "1", "2", "3"} {
+		eq(false, exists(path+"."+name))
+	}
+}
+
+func TestInMemStoreJournalAccess(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	clock := clocktest.New(time.Now())
+	path := filepath.Join(t.TempDir(), "sessions")
+	o := &InMemStoreOptions{SnapshotPath: path, Journal: true, Clock: clock}
+
+	st := NewInMemStoreOptions(o).(*inMemStore)
+	eq(3, clock.Tickers()) // Session cleaner, journal sync and snapshot (compaction) by default
+	s1 := NewSessionOptions(&SessOptions{Timeout: time.Minute, Clock: clock})
+	st.Save(s1)
+	clock.Advance(40 * time.Second)
+	eq(s1, st.Load(s1.ID()))
+	st.persister.syncJournal()
+
+	// Simulate a crash: stop the store without saving a snapshot
+	for _, stop := range st.stops {
+		stop()
+	}
+	st.persister.journal.Close()
+
+	// Timed out since the save, but not since the access:
+	clock.Advance(30 * time.Second)
+	st2 := NewInMemStoreOptions(o)
+	defer st2.Close()
+	eq(true, st2.Load(s1.ID()) != nil)
+}
@@ -0,0 +1,116 @@
+/*
+
+A sharded, in-memory session store implementation.
+
+*/
+
+package session
+
+import (
+	"context"
+	"strconv"
+)
+
+// Sharded, in-memory session Store implementation.
+// Sessions are split into multiple in-memory stores (shards) by the hash of their IDs,
+// each having its own lock and session cleaner, so concurrent operations on different
+// sessions rarely contend for the same lock.
+type shardedInMemStore struct {
+	shards []*inMemStore // The shards
+}
+
+// newShardedInMemStore returns a new, sharded in-memory session Store with the specified options.
+func newShardedInMemStore(o *InMemStoreOptions) *shardedInMemStore {
+	// A shard with a zero limit would be unlimited, so there must not be more shards than the limits:
+	n := o.Shards
+	if o.MaxSessions > 0 && o.MaxSessions < n {
+		n = o.MaxSessions
+	}
+	if o.MaxBytes > 0 && o.MaxBytes < int64(n) {
+		n = int(o.MaxBytes)
+	}
+
+	s := &shardedInMemStore{shards: make([]*inMemStore, n)}
+	for i := range s.shards {
+		// Limits are divided among shards so that their sum is the limit of the store:
+		so := *o
+		so.MaxSessions = int(shareOf(int64(o.MaxSessions), n, i))
+		so.MaxBytes = shareOf(o.MaxBytes, n, i)
+		s.shards[i] = newInMemStore(&so, strconv.Itoa(i))
+	}
+	if o.SnapshotPath != "" {
+		startPersisters(o, s.shards, s.shard)
+	}
+	return s
+}
+
+// shareOf returns the share of shard i of limit divided among n shards.
+func shareOf(limit int64, n, i int) int64 {
+	share := limit / int64(n)
+	if int64(i) < limit%int64(n) {
+		share++
+	}
+	return share
+}
+
+// shard returns the shard responsible for the session specified by its id.
+func (s *shardedInMemStore) shard(id string) *inMemStore {
+	// 32-bit FNV-1a, inlined to avoid allocation
+	h := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		h ^= uint32(id[i])
+		h *= 16777619
+	}
+	return s.shards[h%uint32(len(s.shards))]
+}
+
+// Load is to implement Store.Load().
+func (s *shardedInMemStore) Load(id string) Session {
+	return s.shard(id).Load(id)
+}
+
+// LoadContext is to implement ContextStore.LoadContext().
+func (s *shardedInMemStore) LoadContext(ctx context.Context, id string) Session {
+	return s.shard(id).LoadContext(ctx, id)
+}
+
+// Save is to implement Store.Save().
+func (s *shardedInMemStore) Save(sess Session) {
+	s.shard(sess.ID()).Save(sess)
+}
+
+// SaveContext is to implement ContextStore.SaveContext().
+func (s *shardedInMemStore) SaveContext(ctx context.Context, sess Session) {
+	s.shard(sess.ID()).SaveContext(ctx, sess)
+}
+
+// Remove is to implement Store.Remove().
+func (s *shardedInMemStore) Remove(sess Session) {
+	s.shard(sess.ID()).Remove(sess)
+}
+
+// RemoveContext is to implement ContextStore.RemoveContext().
+func (s *shardedInMemStore) RemoveContext(ctx context.Context, sess Session) {
+	s.shard(sess.ID()).RemoveContext(ctx, sess)
+}
+
+// IDs is to implement Lister.IDs().
+func (s *shardedInMemStore) IDs() []string {
+	var ids []string
+	for _, shard := range s.shards {
+		ids = append(ids, shard.IDs()...)
+	}
+	return ids
+}
+
+// Touch is to implement Toucher.Touch().
+func (s *shardedInMemStore) Touch(id string) bool {
+	return s.shard(id).Touch(id)
+}
+
+// Close is to implement Store.Close().
+func (s *shardedInMemStore) Close() {
+	for _, shard := range s.shards {
+		shard.Close()
+	}
+}
@@ -0,0 +1,110 @@
+package session
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-osin/session/clocktest"
+	"github.com/icza/mighty"
+)
+
+func TestShardedInMemStore(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	clock := clocktest.New(time.Now())
+	st := NewInMemStoreOptions(&InMemStoreOptions{Shards: 4, SessCleanerInterval: 10 * time.Millisecond, Clock: clock})
+	defer st.Close()
+
+	sst := st.(*shardedInMemStore)
+	eq(4, len(sst.shards))
+
+	eq(nil, st.Load("asdf"))
+
+	var ss []Session
+	for i := 0; i < 20; i++ {
+		s := NewSessionOptions(&SessOptions{Timeout: 30 * time.Millisecond, Clock: clock})
+		st.Save(s)
+		ss = append(ss, s)
+	}
+	// Sessions must be distributed among shards:
+	used := 0
+	for _, shard := range sst.shards {
+		if len(shard.sessions) > 0 {
+			used++
+		}
+	}
+	eq(true, used > 1)
+
+	var wg sync.WaitGroup
+	for _, s := range ss {
+		wg.Add(1)
+		go func(s Session) {
+			defer wg.Done()
+			eq(s, st.Load(s.ID()))
+		}(s)
+	}
+	wg.Wait()
+
+	st.Remove(ss[0])
+	eq(nil, st.Load(ss[0].ID()))
+
+	// Each shard has its own cleaner:
+	clock.Advance(80 * time.Millisecond)
+	for _, s := range ss {
+		eq(nil, st.Load(s.ID()))
+	}
+}
+
+func TestShardedInMemStoreLimits(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	for _, c := range []struct{ maxSessions, shards, expShards int }{
+		{10, 4, 4},
+		{10, 16, 10}, // Less sessions than shards
+	} {
+		st := NewInMemStoreOptions(&InMemStoreOptions{MaxSessions: c.maxSessions, Shards: c.shards}).(*shardedInMemStore)
+		eq(c.expShards, len(st.shards))
+		sum := 0
+		for _, shard := range st.shards {
+			sum += shard.maxSessions
+		}
+		eq(c.maxSessions, sum)
+
+		for i := 0; i < 3*c.maxSessions; i++ {
+			st.Save(NewSession())
+		}
+		eq(true, len(st.IDs()) <= c.maxSessions)
+		st.Close()
+	}
+}
+
+// benchmarkInMemStoreLoad benchmarks parallel loads of 1024 sessions.
+// Run with e.g. -cpu=1,2,4,8 to see how the store scales across GOMAXPROCS.
+func benchmarkInMemStoreLoad(b *testing.B, shards int) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Shards: shards})
+	defer st.Close()
+
+	ids := make([]string, 1024)
+	for i := range ids {
+		s := NewSession()
+		st.Save(s)
+		ids[i] = s.ID()
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			st.Load(ids[i%len(ids)])
+		}
+	})
+}
+
+func BenchmarkInMemStoreLoad(b *testing.B)          { benchmarkInMemStoreLoad(b, 1) }
+func BenchmarkShardedInMemStoreLoad16(b *testing.B) { benchmarkInMemStoreLoad(b, 16) }
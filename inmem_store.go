@@ -7,17 +7,34 @@ An in-memory session store implementation.
 package session
 
 import (
+	"context"
 	"log"
 	"sync"
 	"time"
+
+	"github.com/go-osin/session/codec"
 )
 
 // In-memory session Store implementation.
 type inMemStore struct {
-	sessions    map[string]Session // Map of sessions (mapped from ID)
-	mux         *sync.RWMutex      // mutex to synchronize access to sessions
-	ticker      *time.Ticker       // Ticker for the session cleaner
-	closeTicker chan struct{}      // Channel to signal close for the session cleaner
+	sessions map[string]Session // Map of sessions (mapped from ID)
+	expiry   *timeIndex         // Expiry index of sessions, so sweeps only touch expired sessions
+	mux      *sync.RWMutex      // mutex to synchronize access to sessions and expiry
+	clock    Clock              // Clock to run the session cleaner and periodic tasks with
+	stops    []func()           // Functions to stop the session cleaner and periodic tasks
+	metrics  Metrics            // Metrics to report to
+	tracer   Tracer             // Tracer to create spans with
+	shard    string             // Shard number if the store is a shard of a sharded store, used as a metric label
+
+	lru         *timeIndex                 // LRU index of sessions by last accessed time, nil if the number or size of sessions is not limited
+	maxSessions int                        // Max number of sessions, 0 means no limit
+	maxBytes    int64                      // Approximate max total size of sessions, 0 means no limit
+	sizeFunc    func(Session) int          // Function to estimate session sizes
+	sizes       map[string]int             // Estimated sizes of sessions (mapped from ID), nil if size is not limited
+	bytes       int64                      // Estimated total size of sessions
+	onEvict     func(Session, EvictReason) // Callback to call when a session is evicted, may be nil
+
+	persister *inMemPersister // Persister of sessions, nil if persistence is disabled
 }
 
 // InMemStoreOptions defines options that may be passed when creating a new in-memory Store.
@@ -25,6 +42,107 @@ type inMemStore struct {
 type InMemStoreOptions struct {
 	// Session cleaner check interval, default is 10 seconds.
 	SessCleanerInterval time.Duration
+
+	// Metrics to report store operations, cleaner sweeps and the number of live sessions to;
+	// default value is NopMetrics.
+	Metrics Metrics
+
+	// Tracer to create spans around store operations with; default value is NopTracer.
+	Tracer Tracer
+
+	// Number of shards to split sessions into to reduce lock contention under high load;
+	// default value is 1 (no sharding).
+	// Each shard has its own lock and its own session cleaner goroutine,
+	// sessions are assigned to shards by the hash of their IDs.
+	Shards int
+
+	// Maximum number of sessions to keep; default value is 0 which means no limit.
+	// If saving a new session exceeds the limit, least recently used sessions (by Session.Accessed()) are evicted.
+	// In case of a sharded store the limit is divided among the shards (the sum of their limits is the limit),
+	// each shard evicting from its own sessions, so the store may evict before reaching the limit as a whole.
+	// If the limit is less than Shards, the number of shards is reduced to the limit.
+	MaxSessions int
+
+	// Approximate maximum total size of sessions in bytes; default value is 0 which means no limit.
+	// If saving a session exceeds the limit, least recently used sessions (by Session.Accessed()) are evicted.
+	// Sessions are measured by SizeFunc when they are saved, changes made to sessions after that are not accounted for.
+	// In case of a sharded store the limit is divided among the shards like MaxSessions.
+	MaxBytes int64
+
+	// Function to estimate the size of a session in bytes, only used if MaxBytes is set;
+	// default value is EstimateSize.
+	SizeFunc func(sess Session) int
+
+	// Callback to call when a session is evicted due to timeout or due to the above limits;
+	// default value is nil (no callback).
+	// It is called after the store released its lock, so it may use the store.
+	OnEvict func(sess Session, reason EvictReason)
+
+	// Path of the file to save a snapshot of all sessions to when the store is closed (and periodically
+	// if SnapshotInterval is set), and to restore sessions from when the store is created;
+	// default value is the empty string which means sessions are not persisted.
+	// Already expired sessions are skipped on restore.
+	// In case of a sharded store each shard uses its own file: the shard number is appended to the path.
+	// Sessions are restored from the files of any number of shards, so Shards may be changed between restarts.
+	SnapshotPath string
+
+	// Interval to save snapshots periodically, only used if SnapshotPath is set; snapshots also compact the journal.
+	// Default value is 10 minutes if Journal is set, else 0 which means snapshot is only saved when the store is closed.
+	SnapshotInterval time.Duration
+
+	// Tells if saved and removed sessions are to be recorded in an append-only journal file between snapshots,
+	// so a crash loses at most the writes of the last JournalSyncInterval;
+	// only used if SnapshotPath is set. The path of the journal file is SnapshotPath with ".journal" appended.
+	// Accesses by Load() and Touch() are also recorded, so sessions are restored with their last access time.
+	// Note that changes made to sessions are only recorded when the session is saved again.
+	Journal bool
+
+	// Interval to sync journal writes to disk, which is the window of writes that may be lost in case of a crash;
+	// default value is 1 second.
+	JournalSyncInterval time.Duration
+
+	// Codec used to marshal and unmarshal sessions in snapshot and journal files;
+	// default value is codec.Gob (attribute types must be registered with gob.Register()).
+	Codec *codec.Codec
+
+	// Clock to decide session timeouts and to run the session cleaner and periodic tasks with;
+	// default value is SystemClock.
+	// Sessions saved to the store should be created with the same clock (see SessOptions.Clock).
+	Clock Clock
+}
+
+// EvictReason tells why a session was evicted from a Store.
+type EvictReason int
+
+// Eviction reasons.
+const (
+	// EvictTimeout means the session timed out.
+	EvictTimeout EvictReason = iota
+
+	// EvictMaxSessions means the max number of sessions was exceeded.
+	EvictMaxSessions
+
+	// EvictMaxBytes means the max total size of sessions was exceeded.
+	EvictMaxBytes
+)
+
+// String returns the name of the eviction reason, as used in metric labels.
+func (r EvictReason) String() string {
+	switch r {
+	case EvictTimeout:
+		return "timeout"
+	case EvictMaxSessions:
+		return "max_sessions"
+	case EvictMaxBytes:
+		return "max_bytes"
+	}
+	return "unknown"
+}
+
+// eviction is a session evicted from the store with the reason.
+type eviction struct {
+	sess   Session
+	reason EvictReason
 }
 
 // Pointer to zero value of InMemStoreOptions to be reused for efficiency.
@@ -42,10 +160,48 @@ func NewInMemStore() Store {
 // The returned Store has an automatic session cleaner which runs
 // in its own goroutine.
 func NewInMemStoreOptions(o *InMemStoreOptions) Store {
+	if o.Shards > 1 {
+		return newShardedInMemStore(o)
+	}
+	s := newInMemStore(o, "")
+	if s.persister != nil {
+		startPersisters(o, []*inMemStore{s}, func(id string) *inMemStore { return s })
+	}
+	return s
+}
+
+// newInMemStore returns a new, in-memory session Store with the specified options, ignoring o.Shards.
+// shard is the shard number if the store is a shard of a sharded store, else the empty string.
+// Persisted sessions are not restored, see startPersisters().
+func newInMemStore(o *InMemStoreOptions, shard string) *inMemStore {
 	s := &inMemStore{
 		sessions:    make(map[string]Session),
+		expiry:      newTimeIndex(expiresAt),
 		mux:         &sync.RWMutex{},
-		closeTicker: make(chan struct{}),
+		clock:       clockOrSystem(o.Clock),
+		metrics:     o.Metrics,
+		tracer:      o.Tracer,
+		maxSessions: o.MaxSessions,
+		maxBytes:    o.MaxBytes,
+		sizeFunc:    o.SizeFunc,
+		onEvict:     o.OnEvict,
+		shard:       shard,
+		persister:   newInMemPersister(o, shard),
+	}
+	if s.metrics == nil {
+		s.metrics = NopMetrics
+	}
+	if s.tracer == nil {
+		s.tracer = NopTracer
+	}
+	if s.maxSessions > 0 || s.maxBytes > 0 {
+		s.lru = newTimeIndex(accessedAt)
+	}
+	if s.maxBytes > 0 {
+		s.sizes = make(map[string]int)
+		if s.sizeFunc == nil {
+			s.sizeFunc = EstimateSize
+		}
 	}
 
 	interval := o.SessCleanerInterval
@@ -53,94 +209,307 @@ func NewInMemStoreOptions(o *InMemStoreOptions) Store {
 		interval = 10 * time.Second
 	}
 
-	go s.sessCleaner(interval)
+	s.stops = append(s.stops, s.clock.Every(interval, func() { s.sweep(s.clock.Now()) }))
 
 	return s
 }
 
-// sessCleaner periodically checks whether sessions have timed out
-// in an endless loop. If a session has timed out, removes it.
-// This method is to be started as a new goroutine.
-func (s *inMemStore) sessCleaner(interval time.Duration) {
-	ticker := time.NewTicker(interval)
-
-	for {
-		select {
-		case <-s.closeTicker:
-			// We are being shut down...
-			ticker.Stop()
-			return
-		case now := <-ticker.C:
-			// Do a sweep.
-			// Remove is very rare compared to the number of checks, so:
-			// "Quick" check with read-lock to see if there's anything to remove:
-			// Note: Session.Access() is called with s.mux, the same mutex we use
-			// when looking for timed-out sessions, so we're good.
-			needRemove := func() bool {
-				s.mux.RLock() // Read lock is enough
-				defer s.mux.RUnlock()
-
-				for _, sess := range s.sessions {
-					if now.Sub(sess.Accessed()) > sess.Timeout() {
-						return true
-					}
-				}
-				return false
-			}()
-			if !needRemove {
-				continue
-			}
-
-			// Remove required:
-			func() {
-				s.mux.Lock() // Read-write lock required
-				defer s.mux.Unlock()
-
-				for _, sess := range s.sessions {
-					if now.Sub(sess.Accessed()) > sess.Timeout() {
-						log.Println("Session timed out:", sess.ID())
-						delete(s.sessions, sess.ID())
-					}
-				}
-			}()
+// startPersister starts the persister of the store (after restoring sessions, see startPersisters()):
+// saves a snapshot of the restored sessions and starts the periodic snapshots and journal syncs.
+func (s *inMemStore) startPersister(o *InMemStoreOptions) error {
+	p := s.persister
+	s.evictLocked() // No need locking, store is not yet published
+
+	if err := p.openJournal(); err != nil {
+		log.Printf("Failed to open session journal: %v", err)
+	}
+	// Compact restored sessions into a new snapshot (this also truncates the journal):
+	err := p.snapshot(s.sessions)
+
+	snapshotInterval := o.SnapshotInterval
+	if snapshotInterval <= 0 && p.journalPath != "" {
+		snapshotInterval = 10 * time.Minute // The journal must be compacted periodically
+	}
+	if snapshotInterval > 0 {
+		s.stops = append(s.stops, s.clock.Every(snapshotInterval, func() { s.snapshot() }))
+	}
+	if p.journalPath != "" {
+		interval := o.JournalSyncInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		s.stops = append(s.stops, s.clock.Every(interval, p.syncJournal))
+	}
+	return err
+}
+
+// snapshot saves a snapshot of the sessions using the persister of the store.
+func (s *inMemStore) snapshot() {
+	// Read lock prevents writes during the snapshot, so no journal records are lost.
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	if err := s.persister.snapshot(s.sessions); err != nil {
+		log.Printf("Failed to save session snapshot: %v", err)
+	}
+}
+
+// sweep removes sessions that have timed out at the specified time.
+// Thanks to the expiry index, only sessions whose expiration time has passed are touched.
+func (s *inMemStore) sweep(now time.Time) {
+	start := time.Now()
+	defer func() {
+		s.metrics.Histogram(MetricCleanerSweep, time.Since(start).Seconds(), s.labels())
+	}()
+
+	// Remove is very rare compared to the number of checks, so:
+	// "Quick" check with read-lock to see if there's anything to remove:
+	needRemove := func() bool {
+		s.mux.RLock() // Read lock is enough
+		defer s.mux.RUnlock()
+
+		return s.expiry.due(now)
+	}()
+	if !needRemove {
+		return
+	}
+
+	// Remove (or at least reindex) required:
+	var evicted []eviction
+	func() {
+		s.mux.Lock() // Read-write lock required
+		defer s.mux.Unlock()
+
+		for _, sess := range s.expiry.popExpired(now) {
+			log.Println("Session timed out:", sess.ID())
+			s.removeLocked(sess.ID())
+			evicted = append(evicted, eviction{sess, EvictTimeout})
+		}
+		if len(evicted) > 0 {
+			s.metrics.Counter(MetricCleanerRemoved, float64(len(evicted)), s.labels())
+			s.metrics.Gauge(MetricStoreSessions, float64(len(s.sessions)), s.labels())
 		}
+	}()
+	s.notifyEvicted(evicted)
+}
+
+// addLocked adds the session to the maps and indices of the store.
+// Must be called with s.mux held.
+func (s *inMemStore) addLocked(sess Session) {
+	id := sess.ID()
+	s.sessions[id] = sess
+	s.expiry.set(sess)
+	if s.lru != nil {
+		s.lru.set(sess)
+	}
+	if s.sizes != nil {
+		size := s.sizeFunc(sess)
+		s.bytes += int64(size - s.sizes[id])
+		s.sizes[id] = size
 	}
 }
 
+// removeLocked removes the session specified by its id from the maps and indices of the store.
+// Must be called with s.mux held.
+func (s *inMemStore) removeLocked(id string) {
+	delete(s.sessions, id)
+	s.expiry.remove(id)
+	if s.lru != nil {
+		s.lru.remove(id)
+	}
+	if s.sizes != nil {
+		s.bytes -= int64(s.sizes[id])
+		delete(s.sizes, id)
+	}
+}
+
+// evictLocked evicts least recently used sessions while the limits of the store are exceeded.
+// Must be called with s.mux held.
+func (s *inMemStore) evictLocked() (evicted []eviction) {
+	evict := func(reason EvictReason) {
+		sess := s.lru.popMin()
+		log.Printf("Session evicted (%v): %s", reason, sess.ID())
+		s.removeLocked(sess.ID())
+		if s.persister != nil {
+			s.persister.journalRemove(sess.ID())
+		}
+		evicted = append(evicted, eviction{sess, reason})
+		s.metrics.Counter(MetricStoreEvictions, 1, s.labels("reason", reason.String()))
+	}
+
+	for s.maxSessions > 0 && len(s.sessions) > s.maxSessions {
+		evict(EvictMaxSessions)
+	}
+	for s.maxBytes > 0 && s.bytes > s.maxBytes && len(s.sessions) > 0 {
+		evict(EvictMaxBytes)
+	}
+	return
+}
+
+// notifyEvicted calls the eviction callback with the evicted sessions.
+// Must be called without holding s.mux.
+func (s *inMemStore) notifyEvicted(evicted []eviction) {
+	if s.onEvict == nil {
+		return
+	}
+	for _, e := range evicted {
+		s.onEvict(e.sess, e.reason)
+	}
+}
+
+// labels returns the labels of the metrics reported by the store,
+// extended with the specified label name-value pairs.
+func (s *inMemStore) labels(nameValues ...string) Labels {
+	ls := Labels{"store": "inmem"}
+	if s.shard != "" {
+		ls["shard"] = s.shard
+	}
+	for i := 0; i+1 < len(nameValues); i += 2 {
+		ls[nameValues[i]] = nameValues[i+1]
+	}
+	return ls
+}
+
+// observe reports a store operation to the metrics.
+func (s *inMemStore) observe(op, result string, start time.Time) {
+	if s.metrics == NopMetrics {
+		return // Spare building the labels
+	}
+	s.metrics.Counter(MetricStoreOps, 1, s.labels("op", op, "result", result))
+	s.metrics.Histogram(MetricStoreLatency, time.Since(start).Seconds(), s.labels("op", op))
+}
+
+// startSpan starts a span of a store operation on the session specified by its id.
+func (s *inMemStore) startSpan(ctx context.Context, op, id string) Span {
+	if s.tracer == NopTracer {
+		return nopSpan{} // Spare hashing the id
+	}
+	_, span := s.tracer.Start(ctx, "session.Store."+op)
+	span.SetAttr(AttrStore, "inmem")
+	span.SetAttr(AttrSessionIDHash, SessionIDHash(id))
+	return span
+}
+
 // Load is to implement Store.Load().
 func (s *inMemStore) Load(id string) Session {
+	return s.LoadContext(context.Background(), id)
+}
+
+// LoadContext is to implement ContextStore.LoadContext().
+func (s *inMemStore) LoadContext(ctx context.Context, id string) Session {
+	start := time.Now()
+	span := s.startSpan(ctx, "Load", id)
+	defer span.End()
+
 	s.mux.RLock()
 	defer s.mux.RUnlock()
 
 	sess := s.sessions[id]
+	span.SetAttr(AttrHit, sess != nil)
+	defer func() { s.observe("load", loadResult(sess), start) }()
 	if sess == nil {
 		return nil
 	}
 	log.Print("Session inmem loaded:", sess.ID())
 
 	sess.Access()
+	if s.persister != nil {
+		s.persister.journalAccess(sess)
+	}
+	if sess.State() == StateNew { // Saved directly to the store, not by a manager
+		sess.SetState(StateLoaded)
+	}
 	return sess
 }
 
 // Save is to implement Store.Save().
 func (s *inMemStore) Save(sess Session) {
-	s.mux.Lock()
-	defer s.mux.Unlock()
+	s.SaveContext(context.Background(), sess)
+}
+
+// SaveContext is to implement ContextStore.SaveContext().
+func (s *inMemStore) SaveContext(ctx context.Context, sess Session) {
+	start := time.Now()
+	span := s.startSpan(ctx, "Save", sess.ID())
+	defer span.End()
 
-	log.Print("Session inmem saved:", sess.ID())
-	s.sessions[sess.ID()] = sess
+	var evicted []eviction
+	func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+
+		log.Print("Session inmem saved:", sess.ID())
+		s.addLocked(sess)
+		if s.persister != nil {
+			s.persister.journalSave(sess)
+		}
+		evicted = s.evictLocked()
+		s.metrics.Gauge(MetricStoreSessions, float64(len(s.sessions)), s.labels())
+	}()
+	s.notifyEvicted(evicted)
+	s.observe("save", "ok", start)
 }
 
 // Remove is to implement Store.Remove().
 func (s *inMemStore) Remove(sess Session) {
+	s.RemoveContext(context.Background(), sess)
+}
+
+// RemoveContext is to implement ContextStore.RemoveContext().
+func (s *inMemStore) RemoveContext(ctx context.Context, sess Session) {
+	start := time.Now()
+	span := s.startSpan(ctx, "Remove", sess.ID())
+	defer span.End()
+
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
 	log.Print("Session inmem removed:", sess.ID())
-	delete(s.sessions, sess.ID())
+	s.removeLocked(sess.ID())
+	if s.persister != nil {
+		s.persister.journalRemove(sess.ID())
+	}
+	s.metrics.Gauge(MetricStoreSessions, float64(len(s.sessions)), s.labels())
+	s.observe("remove", "ok", start)
+}
+
+// IDs is to implement Lister.IDs().
+func (s *inMemStore) IDs() []string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	ids := make([]string, 0, len(s.sessions))
+	for id := range s.sessions {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Touch is to implement Toucher.Touch().
+func (s *inMemStore) Touch(id string) bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	sess := s.sessions[id]
+	if sess == nil {
+		return false
+	}
+	sess.Access()
+	if s.persister != nil {
+		s.persister.journalAccess(sess)
+	}
+	return true
 }
 
 // Close is to implement Store.Close().
+// If persistence is enabled, a snapshot of the sessions is saved.
 func (s *inMemStore) Close() {
-	close(s.closeTicker)
+	for _, stop := range s.stops {
+		stop()
+	}
+
+	if s.persister != nil {
+		s.snapshot()
+		s.persister.closeJournal()
+	}
 }
@@ -4,20 +4,22 @@ import (
 	"testing"
 	"time"
 
+	"github.com/go-osin/session/clocktest"
 	"github.com/icza/mighty"
 )
 
 func TestInMemStore(t *testing.T) {
 	eq, neq := mighty.EqNeq(t)
 
-	st := NewInMemStore()
+	clock := clocktest.New(time.Now())
+	st := NewInMemStoreOptions(&InMemStoreOptions{Clock: clock})
 	defer st.Close()
 
 	eq(nil, st.Load("asdf"))
 
-	s := NewSession()
+	s := NewSessionOptions(&SessOptions{Clock: clock})
 	st.Save(s)
-	time.Sleep(10 * time.Millisecond)
+	clock.Advance(10 * time.Millisecond)
 	eq(s, st.Load(s.ID()))
 	neq(s.Accessed(), s.Created())
 
@@ -28,16 +30,102 @@ func TestInMemStore(t *testing.T) {
 func TestInMemStoreSessCleaner(t *testing.T) {
 	eq := mighty.Eq(t)
 
-	st := NewInMemStoreOptions(&InMemStoreOptions{SessCleanerInterval: 10 * time.Millisecond})
+	var evicted []Session
+	clock := clocktest.New(time.Now())
+	st := NewInMemStoreOptions(&InMemStoreOptions{
+		SessCleanerInterval: 10 * time.Millisecond,
+		Clock:               clock,
+		OnEvict:             func(sess Session, reason EvictReason) { evicted = append(evicted, sess) },
+	})
 	defer st.Close()
+	eq(1, clock.Tickers())
 
-	s := NewSessionOptions(&SessOptions{Timeout: 50 * time.Millisecond})
+	s := NewSessionOptions(&SessOptions{Timeout: 50 * time.Millisecond, Clock: clock})
 	st.Save(s)
 	eq(s, st.Load(s.ID()))
 
-	time.Sleep(30 * time.Millisecond)
-	eq(s, st.Load(s.ID()))
+	clock.Advance(30 * time.Millisecond)
+	eq(s, st.Load(s.ID())) // Access extends the timeout
 
-	time.Sleep(80 * time.Millisecond)
+	clock.Advance(40 * time.Millisecond)
+	eq(0, len(evicted))
+	clock.Advance(20 * time.Millisecond) // Timed out, the cleaner runs
+	eq(1, len(evicted))
 	eq(nil, st.Load(s.ID()))
+
+	st.Close()
+	eq(0, clock.Tickers())
+}
+
+func TestInMemStoreMaxSessions(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	var evicted []Session
+	var reasons []EvictReason
+	clock := clocktest.New(time.Now())
+	st := NewInMemStoreOptions(&InMemStoreOptions{
+		MaxSessions: 2,
+		Clock:       clock,
+		OnEvict: func(sess Session, reason EvictReason) {
+			evicted = append(evicted, sess)
+			reasons = append(reasons, reason)
+		},
+	})
+	defer st.Close()
+
+	newSess := func() Session { return NewSessionOptions(&SessOptions{Clock: clock}) }
+	s1, s2, s3 := newSess(), newSess(), newSess()
+	st.Save(s1)
+	st.Save(s2)
+	clock.Advance(time.Millisecond)
+	eq(s1, st.Load(s1.ID())) // s1 becomes more recently used than s2
+	st.Save(s3)
+
+	eq(1, len(evicted))
+	eq(s2, evicted[0])
+	eq(EvictMaxSessions, reasons[0])
+	eq("max_sessions", reasons[0].String())
+	eq(nil, st.Load(s2.ID()))
+	eq(s1, st.Load(s1.ID()))
+	eq(s3, st.Load(s3.ID()))
+}
+
+func TestInMemStoreMaxBytes(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	var evicted []Session
+	st := NewInMemStoreOptions(&InMemStoreOptions{
+		MaxBytes: 250,
+		SizeFunc: func(sess Session) int { return 100 },
+		OnEvict: func(sess Session, reason EvictReason) {
+			eq(EvictMaxBytes, reason)
+			evicted = append(evicted, sess)
+		},
+	}).(*inMemStore)
+	defer st.Close()
+
+	s1, s2, s3 := NewSession(), NewSession(), NewSession()
+	st.Save(s1)
+	st.Save(s2)
+	eq(int64(200), st.bytes)
+	st.Save(s2) // Resaving doesn't count twice
+	eq(int64(200), st.bytes)
+	eq(0, len(evicted))
+
+	st.Save(s3)
+	eq(1, len(evicted))
+	eq(s1, evicted[0])
+	eq(int64(200), st.bytes)
+
+	st.Remove(s2)
+	eq(int64(100), st.bytes)
+}
+
+func TestEstimateSize(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	s := NewSessionOptions(&SessOptions{CAttrs: map[string]interface{}{"user": "bob"}})
+	base := EstimateSize(s)
+	s.Set("data", make([]byte, 1000))
+	eq(true, EstimateSize(s) >= base+1000)
 }
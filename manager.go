@@ -7,6 +7,7 @@ Session Manager interface.
 package session
 
 import (
+	"context"
 	"net/http"
 )
 
@@ -29,3 +30,16 @@ type Manager interface {
 	// Close closes the session manager, releasing any resources that were allocated.
 	Close()
 }
+
+// ContextManager is an optional interface a Manager may implement to receive the context of the operations
+// which do not have an HTTP request to take it from.
+// The middleware of this package uses these methods if the Manager implements them.
+type ContextManager interface {
+	Manager
+
+	// SaveContext is like Manager.Save() but with a context.
+	SaveContext(ctx context.Context, sess Session, w http.ResponseWriter)
+
+	// RemoveContext is like Manager.Remove() but with a context.
+	RemoveContext(ctx context.Context, sess Session, w http.ResponseWriter)
+}
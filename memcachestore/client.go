@@ -0,0 +1,319 @@
+package memcachestore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-osin/session"
+)
+
+// Limits of memcached.
+const (
+	// MaxKeyLength is the max length of a memcached key in bytes.
+	MaxKeyLength = 250
+
+	// MaxItemSize is the max size of a memcached item value in bytes (default item size limit of memcached).
+	MaxItemSize = 1 << 20
+)
+
+// Errors returned by the client.
+var (
+	// ErrCacheMiss is returned if the item is not in the cache.
+	ErrCacheMiss = errors.New("memcache: cache miss")
+
+	// ErrMalformedKey is returned if a key is longer than MaxKeyLength, or contains spaces or control characters.
+	ErrMalformedKey = errors.New("memcache: key is too long or contains invalid characters")
+
+	// ErrItemTooLarge is returned if a value is larger than MaxItemSize.
+	ErrItemTooLarge = errors.New("memcache: item is larger than 1 MB")
+)
+
+// serverError is an error reported by the memcached server (ERROR, CLIENT_ERROR, SERVER_ERROR replies).
+type serverError string
+
+func (e serverError) Error() string { return "memcache: " + string(e) }
+
+// validKey tells if the key can be used in the memcached text protocol.
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > MaxKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Number of points of each server on the hash ring.
+const ringPointsPerServer = 160
+
+// ringPoint is a point of a server on the hash ring.
+type ringPoint struct {
+	hash   uint32
+	server int
+}
+
+// ring is a consistent hash ring of servers.
+// Adding or removing a server only remaps keys of the ring segments owned by that server.
+type ring []ringPoint
+
+// newRing creates a hash ring of the specified servers.
+func newRing(addrs []string) ring {
+	r := make(ring, 0, len(addrs)*ringPointsPerServer)
+	for i, addr := range addrs {
+		for j := 0; j < ringPointsPerServer; j++ {
+			h := crc32.ChecksumIEEE([]byte(addr + "-" + strconv.Itoa(j)))
+			r = append(r, ringPoint{hash: h, server: i})
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].hash < r[j].hash })
+	return r
+}
+
+// server returns the index of the server that owns the key.
+func (r ring) server(key string) int {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r), func(i int) bool { return r[i].hash >= h })
+	if i == len(r) {
+		i = 0 // Wrap around
+	}
+	return r[i].server
+}
+
+// conn is a connection to a memcached server.
+type conn struct {
+	nc net.Conn
+	rw *bufio.ReadWriter
+}
+
+// server is a memcached server with its idle connections.
+type server struct {
+	addr string
+
+	mux  sync.Mutex // mutex to synchronize access to idle
+	idle []*conn    // Idle connections
+}
+
+// client is a memcached client speaking the text protocol to multiple servers.
+type client struct {
+	servers []*server
+	ring    ring
+
+	timeout      time.Duration // Dial and I/O timeout
+	maxIdleConns int           // Max number of idle connections per server
+	clock        session.Clock // Clock to compute absolute expiration times with
+}
+
+// newClient creates a new client of the specified servers.
+func newClient(addrs []string, timeout time.Duration, maxIdleConns int, clock session.Clock) *client {
+	c := &client{
+		ring:         newRing(addrs),
+		timeout:      timeout,
+		maxIdleConns: maxIdleConns,
+		clock:        clock,
+	}
+	for _, addr := range addrs {
+		c.servers = append(c.servers, &server{addr: addr})
+	}
+	return c
+}
+
+// conn returns an idle or a new connection to the server owning the key.
+func (c *client) conn(key string) (*server, *conn, error) {
+	srv := c.servers[c.ring.server(key)]
+
+	srv.mux.Lock()
+	if n := len(srv.idle); n > 0 {
+		cn := srv.idle[n-1]
+		srv.idle = srv.idle[:n-1]
+		srv.mux.Unlock()
+		return srv, cn, nil
+	}
+	srv.mux.Unlock()
+
+	nc, err := net.DialTimeout("tcp", srv.addr, c.timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	return srv, &conn{nc: nc, rw: bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))}, nil
+}
+
+// release returns a connection to the idle connections of its server,
+// or closes it if there are enough idle connections.
+// Connections are also closed after any error other than a cache miss: after error replies and unexpected replies
+// the state of the connection is unknown (e.g. the server may still send or expect data).
+func (c *client) release(srv *server, cn *conn, err error) {
+	if err == nil || err == ErrCacheMiss {
+		srv.mux.Lock()
+		if len(srv.idle) < c.maxIdleConns {
+			srv.idle = append(srv.idle, cn)
+			srv.mux.Unlock()
+			return
+		}
+		srv.mux.Unlock()
+	}
+	cn.nc.Close()
+}
+
+// do executes f with a connection to the server owning the key.
+func (c *client) do(key string, f func(rw *bufio.ReadWriter) error) error {
+	if !validKey(key) {
+		return ErrMalformedKey
+	}
+	srv, cn, err := c.conn(key)
+	if err != nil {
+		return err
+	}
+	cn.nc.SetDeadline(time.Now().Add(c.timeout))
+	err = f(cn.rw)
+	c.release(srv, cn, err)
+	return err
+}
+
+// expiration returns the expiration time of an item in the protocol's format.
+// Relative expiration times longer than 30 days are interpreted by memcached as Unix times,
+// so these are computed from now.
+func expiration(d time.Duration, now time.Time) int64 {
+	if d <= 0 {
+		return 0
+	}
+	secs := int64((d + time.Second - 1) / time.Second)
+	if secs > 30*24*60*60 {
+		return now.Add(d).Unix()
+	}
+	return secs
+}
+
+// readLine reads a reply line without the trailing CRLF, and turns error replies into errors.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line, []byte("\r\n"))
+	switch {
+	case bytes.Equal(line, []byte("ERROR")),
+		bytes.HasPrefix(line, []byte("CLIENT_ERROR ")),
+		bytes.HasPrefix(line, []byte("SERVER_ERROR ")):
+		return nil, serverError(line)
+	}
+	return line, nil
+}
+
+// expectLine reads a reply line and checks it against the expected reply.
+// notFound is returned if the reply is NOT_FOUND.
+func expectLine(r *bufio.Reader, expected string, notFound error) error {
+	line, err := readLine(r)
+	if err != nil {
+		return err
+	}
+	switch string(line) {
+	case expected:
+		return nil
+	case "NOT_FOUND":
+		return notFound
+	}
+	return fmt.Errorf("memcache: unexpected reply: %q", line)
+}
+
+// get returns the value of the item specified by its key.
+func (c *client) get(key string) (value []byte, err error) {
+	err = c.do(key, func(rw *bufio.ReadWriter) error {
+		if _, err := fmt.Fprintf(rw, "get %s\r\n", key); err != nil {
+			return err
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+
+		line, err := readLine(rw.Reader)
+		if err != nil {
+			return err
+		}
+		if string(line) == "END" {
+			return ErrCacheMiss
+		}
+		// VALUE <key> <flags> <bytes>
+		var rkey string
+		var flags uint32
+		var size int
+		if _, err := fmt.Sscanf(string(line), "VALUE %s %d %d", &rkey, &flags, &size); err != nil || rkey != key ||
+			size < 0 || size > MaxItemSize {
+			return fmt.Errorf("memcache: unexpected reply: %q", line)
+		}
+		value = make([]byte, size+2)
+		if _, err := io.ReadFull(rw, value); err != nil {
+			return err
+		}
+		value = value[:size]
+		return expectLine(rw.Reader, "END", nil)
+	})
+	return
+}
+
+// set stores an item with the specified expiration.
+func (c *client) set(key string, value []byte, exp time.Duration) error {
+	if len(value) > MaxItemSize {
+		return ErrItemTooLarge
+	}
+	return c.do(key, func(rw *bufio.ReadWriter) error {
+		if _, err := fmt.Fprintf(rw, "set %s 0 %d %d\r\n", key, expiration(exp, c.clock.Now()), len(value)); err != nil {
+			return err
+		}
+		rw.Write(value)
+		rw.WriteString("\r\n")
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		return expectLine(rw.Reader, "STORED", nil)
+	})
+}
+
+// touch updates the expiration of an item.
+func (c *client) touch(key string, exp time.Duration) error {
+	return c.do(key, func(rw *bufio.ReadWriter) error {
+		if _, err := fmt.Fprintf(rw, "touch %s %d\r\n", key, expiration(exp, c.clock.Now())); err != nil {
+			return err
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		return expectLine(rw.Reader, "TOUCHED", ErrCacheMiss)
+	})
+}
+
+// delete deletes an item.
+func (c *client) delete(key string) error {
+	return c.do(key, func(rw *bufio.ReadWriter) error {
+		if _, err := fmt.Fprintf(rw, "delete %s\r\n", key); err != nil {
+			return err
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		return expectLine(rw.Reader, "DELETED", ErrCacheMiss)
+	})
+}
+
+// close closes the idle connections.
+func (c *client) close() {
+	for _, srv := range c.servers {
+		srv.mux.Lock()
+		for _, cn := range srv.idle {
+			cn.nc.Close()
+		}
+		srv.idle = nil
+		srv.mux.Unlock()
+	}
+}
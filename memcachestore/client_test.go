@@ -0,0 +1,257 @@
+package memcachestore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-osin/session/clocktest"
+	"github.com/icza/mighty"
+)
+
+// fakeServer is an in-process memcached server implementing the get, set, touch and delete commands
+// of the text protocol.
+type fakeServer struct {
+	ln    net.Listener
+	clock *clocktest.Clock // Clock to expire items by
+
+	mux      sync.Mutex
+	items    map[string]fakeItem
+	failNext int    // Number of next commands to fail with SERVER_ERROR
+	reply    string // Raw reply to the next command instead of serving it, if not empty
+	ops      int    // Number of commands served
+	conns    int    // Number of connections accepted
+}
+
+type fakeItem struct {
+	value   []byte
+	expires time.Time // Zero means no expiration
+}
+
+// newFakeServer starts a new fake server; it is stopped when the test completes.
+// Items expire by the clock of the server, which should be passed to the stores as well.
+func newFakeServer(t *testing.T) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &fakeServer{ln: ln, clock: clocktest.New(time.Now()), items: map[string]fakeItem{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fs.mux.Lock()
+			fs.conns++
+			fs.mux.Unlock()
+			go fs.serve(c)
+		}
+	}()
+	return fs
+}
+
+func (fs *fakeServer) addr() string { return fs.ln.Addr().String() }
+
+func (fs *fakeServer) count() (items, ops int) {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	return len(fs.items), fs.ops
+}
+
+func (fs *fakeServer) connCount() int {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	return fs.conns
+}
+
+func (fs *fakeServer) fail(n int) {
+	fs.mux.Lock()
+	fs.failNext = n
+	fs.mux.Unlock()
+}
+
+func (fs *fakeServer) expires(exp string) time.Time {
+	secs, _ := strconv.ParseInt(exp, 10, 64)
+	switch {
+	case secs == 0:
+		return time.Time{}
+	case secs > 30*24*60*60:
+		return time.Unix(secs, 0)
+	}
+	return fs.clock.Now().Add(time.Duration(secs) * time.Second)
+}
+
+func (fs *fakeServer) serve(c net.Conn) {
+	defer c.Close()
+	r, w := bufio.NewReader(c), bufio.NewWriter(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+
+		var data []byte
+		if f[0] == "set" && len(f) == 5 {
+			size, _ := strconv.Atoi(f[4])
+			data = make([]byte, size+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			data = data[:size]
+		}
+
+		fs.mux.Lock()
+		fs.ops++
+		if fs.failNext > 0 {
+			fs.failNext--
+			fs.mux.Unlock()
+			w.WriteString("SERVER_ERROR out of memory\r\n")
+			w.Flush()
+			continue
+		}
+		if reply := fs.reply; reply != "" {
+			fs.reply = ""
+			fs.mux.Unlock()
+			w.WriteString(reply)
+			w.Flush()
+			continue
+		}
+		item, ok := fs.items[f[1]]
+		if ok && !item.expires.IsZero() && fs.clock.Now().After(item.expires) {
+			delete(fs.items, f[1])
+			ok = false
+		}
+		switch f[0] {
+		case "get":
+			if ok {
+				fmt.Fprintf(w, "VALUE %s 0 %d\r\n%s\r\n", f[1], len(item.value), item.value)
+			}
+			w.WriteString("END\r\n")
+		case "set":
+			fs.items[f[1]] = fakeItem{value: data, expires: fs.expires(f[3])}
+			w.WriteString("STORED\r\n")
+		case "touch":
+			if ok {
+				item.expires = fs.expires(f[2])
+				fs.items[f[1]] = item
+				w.WriteString("TOUCHED\r\n")
+			} else {
+				w.WriteString("NOT_FOUND\r\n")
+			}
+		case "delete":
+			if ok {
+				delete(fs.items, f[1])
+				w.WriteString("DELETED\r\n")
+			} else {
+				w.WriteString("NOT_FOUND\r\n")
+			}
+		default:
+			w.WriteString("ERROR\r\n")
+		}
+		fs.mux.Unlock()
+		w.Flush()
+	}
+}
+
+func TestValidKey(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	eq(true, validKey("abc"))
+	eq(true, validKey(strings.Repeat("a", MaxKeyLength)))
+	eq(false, validKey(""))
+	eq(false, validKey(strings.Repeat("a", MaxKeyLength+1)))
+	eq(false, validKey("a b"))
+	eq(false, validKey("a\nb"))
+}
+
+func TestExpiration(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	now := time.Unix(1700000000, 0)
+	eq(int64(0), expiration(0, now))
+	eq(int64(1), expiration(time.Millisecond, now))
+	eq(int64(1800), expiration(30*time.Minute, now))
+	eq(now.Add(60*24*time.Hour).Unix(), expiration(60*24*time.Hour, now))
+}
+
+func TestRing(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	addrs := []string{"a:11211", "b:11211", "c:11211"}
+	r := newRing(addrs)
+
+	counts := make([]int, len(addrs))
+	owners := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := "key" + strconv.Itoa(i)
+		owners[key] = r.server(key)
+		counts[owners[key]]++
+	}
+	for _, c := range counts {
+		eq(true, c > 500) // Roughly even distribution
+	}
+
+	// Adding a server only moves keys to the new server:
+	r2 := newRing(append(addrs, "d:11211"))
+	moved := 0
+	for key, owner := range owners {
+		if s := r2.server(key); s != owner {
+			eq(3, s)
+			moved++
+		}
+	}
+	eq(true, moved > 0 && moved < 1500)
+}
+
+func TestClient(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	fs := newFakeServer(t)
+	c := newClient([]string{fs.addr()}, time.Second, 2, fs.clock)
+	defer c.close()
+
+	_, err := c.get("k")
+	eq(ErrCacheMiss, err)
+	eq(nil, c.set("k", []byte("v\r\nv"), time.Minute))
+	v, err := c.get("k")
+	eq(nil, err)
+	eq("v\r\nv", string(v))
+	eq(nil, c.touch("k", time.Minute))
+	eq(nil, c.delete("k"))
+	eq(ErrCacheMiss, c.delete("k"))
+	eq(ErrCacheMiss, c.touch("k", time.Minute))
+
+	eq(ErrMalformedKey, c.set("a b", nil, 0))
+	eq(ErrItemTooLarge, c.set("k", make([]byte, MaxItemSize+1), 0))
+
+	// Connections are closed after error replies:
+	fs.fail(1)
+	_, ok := c.set("k", nil, 0).(serverError)
+	eq(true, ok)
+	eq(nil, c.set("k", nil, 0))
+	eq(2, fs.connCount())
+
+	// Sizes of values are validated:
+	for _, reply := range []string{"VALUE k 0 -1\r\n", "VALUE k 0 99999999999\r\n", "VALUE k 0 1048577\r\n"} {
+		fs.mux.Lock()
+		fs.reply = reply
+		fs.mux.Unlock()
+		_, err = c.get("k")
+		neq(nil, err)
+	}
+	_, err = c.get("k")
+	eq(nil, err)
+	eq(5, fs.connCount()) // New connection after each
+}
@@ -0,0 +1,206 @@
+/*
+
+Package memcachestore provides a session store implementation backed by memcached servers.
+
+The store speaks the memcached text protocol directly, it does not depend on any memcached client library.
+Sessions are distributed among the servers using consistent hashing, so adding or removing a server
+only invalidates a fraction of the sessions.
+
+Sessions are stored with an expiration equal to their timeout, which is extended on each access.
+
+Limitations based on memcached:
+
+- Since session ids are used in the memcached keys, session ids can't be longer than 250 chars (bytes, but with Base64 charset it's the same).
+If you also specify a key prefix (in StoreOptions), that also counts into it.
+
+- The size of a Session cannot be larger than 1 MB (marshalled into a byte slice).
+
+Unlike the memcache store of the gaestore package, this store is not bound to a request,
+a single store is to be created and used for the lifetime of the application.
+
+*/
+
+package memcachestore
+
+import (
+	"log"
+	"time"
+
+	"github.com/go-osin/session"
+	"github.com/go-osin/session/codec"
+)
+
+// Memcached session Store implementation.
+type memcacheStore struct {
+	client *client // Client of the memcached servers
+
+	keyPrefix string        // Prefix to use in front of session ids to construct memcached keys
+	retries   int           // Number of retries to perform in case of general memcached failures
+	codec     codec.Codec   // Codec used to marshal and unmarshal a Session to a byte slice
+	clock     session.Clock // Clock of loaded sessions, may be nil
+}
+
+// StoreOptions defines options that may be passed when creating a new memcached session Store.
+// All fields are optional; default value will be used for any field that has the zero value.
+type StoreOptions struct {
+	// Addresses (host:port) of the memcached servers; default value is []string{"localhost:11211"}.
+	Servers []string
+
+	// Prefix to use when storing sessions in memcached, cannot contain spaces or control characters,
+	// and cannot be longer than 250 chars (bytes) when concatenated with the session id; default value is the empty string.
+	// The memcached key will be this prefix and the session id concatenated.
+	KeyPrefix string
+
+	// Number of retries to perform if memcached operations fail due to network or server errors;
+	// default value is 3.
+	Retries int
+
+	// Codec used to marshal and unmarshal a Session to a byte slice;
+	// default value is codec.Gob (attribute types must be registered with gob.Register()).
+	Codec *codec.Codec
+
+	// Timeout of dialing and of network operations; default value is 500 ms.
+	Timeout time.Duration
+
+	// Max number of idle connections to keep per server; default value is 2.
+	MaxIdleConns int
+
+	// Clock to get the access times of loaded sessions from and to compute expiration times
+	// longer than 30 days with; default value is session.SystemClock.
+	// Sessions are expired by the memcached servers.
+	Clock session.Clock
+}
+
+// Pointer to zero value of StoreOptions to be reused for efficiency.
+var zeroStoreOptions = new(StoreOptions)
+
+// NewStore returns a new, memcached session Store with default options.
+// Default values of options are listed in the StoreOptions type.
+func NewStore() session.Store {
+	return NewStoreOptions(zeroStoreOptions)
+}
+
+// NewStoreOptions returns a new, memcached session Store with the specified options.
+func NewStoreOptions(o *StoreOptions) session.Store {
+	servers := o.Servers
+	if len(servers) == 0 {
+		servers = []string{"localhost:11211"}
+	}
+	timeout := o.Timeout
+	if timeout <= 0 {
+		timeout = 500 * time.Millisecond
+	}
+	maxIdleConns := o.MaxIdleConns
+	if maxIdleConns <= 0 {
+		maxIdleConns = 2
+	}
+
+	clock := o.Clock
+	if clock == nil {
+		clock = session.SystemClock
+	}
+
+	s := &memcacheStore{
+		client:    newClient(servers, timeout, maxIdleConns, clock),
+		keyPrefix: o.KeyPrefix,
+		retries:   o.Retries,
+		clock:     o.Clock,
+	}
+	if s.retries <= 0 {
+		s.retries = 3
+	}
+	if o.Codec != nil {
+		s.codec = *o.Codec
+	} else {
+		s.codec = codec.Gob
+	}
+	return s
+}
+
+// permanent tells if an error is not worth retrying.
+func permanent(err error) bool {
+	return err == nil || err == ErrCacheMiss || err == ErrMalformedKey || err == ErrItemTooLarge
+}
+
+// Load is to implement Store.Load().
+// A new Session value is returned on each call, read from memcached.
+func (s *memcacheStore) Load(id string) session.Session {
+	key := s.keyPrefix + id
+
+	var data []byte
+	var err error
+	for i := 0; i < s.retries; i++ {
+		if data, err = s.client.get(key); permanent(err) {
+			break
+		}
+		// Network or server error? Retry..
+	}
+	if err == ErrCacheMiss {
+		return nil // It's not in memcached (e.g. invalid sess id, expired or evicted)
+	}
+	if err != nil {
+		log.Printf("Failed to get session from memcached, id: %s, error: %v", id, err)
+		return nil
+	}
+
+	o, err := session.UnmarshalSession(s.codec, data, id)
+	if err != nil {
+		log.Printf("Failed to unmarshal session, id: %s, error: %v", id, err)
+		return nil
+	}
+	o.Clock, o.State = s.clock, session.StateLoaded
+	ss := session.NewSessionOptions(o)
+	ss.Access()
+
+	// Extend the expiration due to the access:
+	for i := 0; i < s.retries; i++ {
+		if err = s.client.touch(key, ss.Timeout()); permanent(err) {
+			break
+		}
+	}
+	if err != nil && err != ErrCacheMiss {
+		log.Printf("Failed to touch session in memcached, id: %s, error: %v", id, err)
+	}
+	return ss
+}
+
+// Save is to implement Store.Save().
+func (s *memcacheStore) Save(sess session.Session) {
+	// Marshal the session value itself (its exported fields), holding its read lock:
+	mux := sess.Mutex()
+	mux.RLock()
+	data, err := s.codec.Marshal(sess)
+	mux.RUnlock()
+	if err != nil {
+		log.Printf("Failed to marshal session, id: %s, error: %v", sess.ID(), err)
+		return
+	}
+
+	for i := 0; i < s.retries; i++ {
+		if err = s.client.set(s.keyPrefix+sess.ID(), data, sess.Timeout()); permanent(err) {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to add session to memcached, id: %s, error: %v", sess.ID(), err)
+	}
+}
+
+// Remove is to implement Store.Remove().
+func (s *memcacheStore) Remove(sess session.Session) {
+	var err error
+	for i := 0; i < s.retries; i++ {
+		if err = s.client.delete(s.keyPrefix + sess.ID()); permanent(err) {
+			break
+		}
+	}
+	if err != nil && err != ErrCacheMiss {
+		log.Printf("Failed to remove session from memcached, id: %s, error: %v", sess.ID(), err)
+	}
+}
+
+// Close is to implement Store.Close().
+// Idle connections to the memcached servers are closed.
+func (s *memcacheStore) Close() {
+	s.client.close()
+}
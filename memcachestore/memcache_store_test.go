@@ -0,0 +1,123 @@
+package memcachestore
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+
+	"github.com/go-osin/session"
+	"github.com/go-osin/session/sessiontest"
+)
+
+func TestMemcacheStore(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	fs1, fs2 := newFakeServer(t), newFakeServer(t)
+	st := NewStoreOptions(&StoreOptions{Servers: []string{fs1.addr(), fs2.addr()}, KeyPrefix: "sess:"})
+	defer st.Close()
+
+	eq(nil, st.Load("asdf"))
+
+	var ss []session.Session
+	for i := 0; i < 20; i++ {
+		s := session.NewSessionOptions(&session.SessOptions{
+			CAttrs:  map[string]interface{}{"user": "bob"},
+			Timeout: time.Hour,
+		})
+		s.Set("count", i)
+		st.Save(s)
+		ss = append(ss, s)
+	}
+
+	// Sessions are distributed among servers:
+	n1, _ := fs1.count()
+	n2, _ := fs2.count()
+	eq(20, n1+n2)
+	eq(true, n1 > 0 && n2 > 0)
+
+	for i, s := range ss {
+		s2 := st.Load(s.ID())
+		neq(nil, s2)
+		eq(s.ID(), s2.ID())
+		eq("bob", s2.Getp("user"))
+		eq(i, s2.Get("count"))
+		eq(time.Hour, s2.Timeout())
+		eq(s.Created().UnixNano(), s2.Created().UnixNano())
+	}
+
+	st.Remove(ss[0])
+	eq(nil, st.Load(ss[0].ID()))
+}
+
+func TestMemcacheStoreRetries(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	fs := newFakeServer(t)
+	st := NewStoreOptions(&StoreOptions{Servers: []string{fs.addr()}, Retries: 3})
+	defer st.Close()
+
+	s := session.NewSession()
+	fs.fail(2)
+	st.Save(s)
+	_, ops := fs.count()
+	eq(3, ops)
+	eq(s.ID(), st.Load(s.ID()).ID())
+
+	// Out of retries:
+	fs.fail(3)
+	eq(nil, st.Load(s.ID()))
+}
+
+func TestMemcacheStoreLimits(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	fs := newFakeServer(t)
+
+	// Key too long:
+	st := NewStoreOptions(&StoreOptions{Servers: []string{fs.addr()}, KeyPrefix: strings.Repeat("p", MaxKeyLength)})
+	s := session.NewSession()
+	st.Save(s)
+	eq(nil, st.Load(s.ID()))
+	st.Close()
+
+	// Item too large:
+	st = NewStoreOptions(&StoreOptions{Servers: []string{fs.addr()}})
+	defer st.Close()
+	s.Set("big", strings.Repeat("x", MaxItemSize))
+	st.Save(s)
+	eq(nil, st.Load(s.ID()))
+
+	// Nothing reached the server:
+	items, ops := fs.count()
+	eq(0, items)
+	eq(1, ops) // The last load
+}
+
+func TestMemcacheStoreExpiration(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	fs := newFakeServer(t)
+	st := NewStoreOptions(&StoreOptions{Servers: []string{fs.addr()}, Clock: fs.clock})
+	defer st.Close()
+
+	s := session.NewSessionOptions(&session.SessOptions{Timeout: time.Second, Clock: fs.clock})
+	st.Save(s)
+	eq(s.ID(), st.Load(s.ID()).ID())
+
+	fs.clock.Advance(1100 * time.Millisecond)
+	eq(nil, st.Load(s.ID()))
+}
+
+func TestMemcacheStoreConformance(t *testing.T) {
+	fs := newFakeServer(t)
+	sessiontest.Run(t, &sessiontest.Options{
+		NewStore: func(t *testing.T) session.Store {
+			return NewStoreOptions(&StoreOptions{Servers: []string{fs.addr()}, Clock: fs.clock})
+		},
+		Timeout:     time.Second, // Expiration has second resolution
+		ExpiryDelay: 100 * time.Millisecond,
+		Clock:       fs.clock,
+	})
+}
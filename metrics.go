@@ -0,0 +1,82 @@
+/*
+
+Metrics hook interface for session stores and managers.
+
+*/
+
+package session
+
+// Metrics is a hook interface to collect metrics from session stores, managers and the middleware.
+// Implementations must be safe for concurrent use.
+//
+// Metric names used by the implementations of this package are listed as the Metric* constants.
+type Metrics interface {
+	// Counter adds delta to the counter specified by its name and labels.
+	Counter(name string, delta float64, labels Labels)
+
+	// Histogram records an observation in the histogram specified by its name and labels.
+	Histogram(name string, value float64, labels Labels)
+
+	// Gauge sets the value of the gauge specified by its name and labels.
+	Gauge(name string, value float64, labels Labels)
+}
+
+// Labels are the label name-value pairs of a metric.
+type Labels map[string]string
+
+// Metric names reported by the implementations of this package.
+const (
+	// MetricStoreOps counts Store operations; labels: store, op, result.
+	// Result of a Load is "hit" or "miss", result of other operations is "ok" or "error".
+	MetricStoreOps = "session_store_operations_total"
+
+	// MetricStoreLatency is the histogram of Store operation durations in seconds; labels: store, op.
+	MetricStoreLatency = "session_store_operation_duration_seconds"
+
+	// MetricStoreRetries counts retried Store operations against a backend; labels: store, op.
+	MetricStoreRetries = "session_store_retries_total"
+
+	// MetricStoreSessions is the gauge of live sessions held by a Store; labels: store.
+	MetricStoreSessions = "session_store_sessions"
+
+	// MetricStoreEvictions counts sessions evicted from a Store due to its limits; labels: store, reason.
+	MetricStoreEvictions = "session_store_evictions_total"
+
+	// MetricCleanerSweep is the histogram of session cleaner sweep durations in seconds; labels: store.
+	MetricCleanerSweep = "session_store_cleaner_sweep_duration_seconds"
+
+	// MetricCleanerRemoved counts sessions removed by a session cleaner due to timeout; labels: store.
+	MetricCleanerRemoved = "session_store_cleaner_removed_total"
+
+	// MetricManagerOps counts Manager operations; labels: manager, op, result.
+	// Result of a Load is "hit", "miss" or "invalid" (malformed session ID), result of other operations is "ok".
+	MetricManagerOps = "session_manager_operations_total"
+
+	// MetricMiddlewareRequests counts requests served by the middleware; labels: session.
+	// Value of the session label is "loaded" or "new".
+	MetricMiddlewareRequests = "session_middleware_requests_total"
+
+	// MetricMiddlewareSaves counts sessions saved by the middleware at the end of requests.
+	MetricMiddlewareSaves = "session_middleware_saves_total"
+
+	// MetricMiddlewareDenied counts new sessions not saved by the middleware because creation was denied.
+	MetricMiddlewareDenied = "session_middleware_denied_total"
+)
+
+// NopMetrics is a Metrics implementation which discards everything.
+// This is the default used when no Metrics is specified in options.
+var NopMetrics Metrics = nopMetrics{}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Counter(string, float64, Labels)   {}
+func (nopMetrics) Histogram(string, float64, Labels) {}
+func (nopMetrics) Gauge(string, float64, Labels)     {}
+
+// loadResult returns the result label value of a Load operation.
+func loadResult(sess Session) string {
+	if sess == nil {
+		return "miss"
+	}
+	return "hit"
+}
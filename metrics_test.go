@@ -0,0 +1,80 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/icza/mighty"
+)
+
+// recMetrics is a Metrics implementation which records reported values for testing.
+type recMetrics struct {
+	mux      sync.Mutex
+	counters map[string]float64
+	gauges   map[string]float64
+	hists    map[string]int
+}
+
+func newRecMetrics() *recMetrics {
+	return &recMetrics{
+		counters: map[string]float64{},
+		gauges:   map[string]float64{},
+		hists:    map[string]int{},
+	}
+}
+
+func (m *recMetrics) Counter(name string, delta float64, labels Labels) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.counters[name+braced(renderLabels(labels))] += delta
+}
+
+func (m *recMetrics) Histogram(name string, value float64, labels Labels) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.hists[name+braced(renderLabels(labels))]++
+}
+
+func (m *recMetrics) Gauge(name string, value float64, labels Labels) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.gauges[name+braced(renderLabels(labels))] = value
+}
+
+func TestMetrics(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	m := newRecMetrics()
+	st := NewInMemStoreOptions(&InMemStoreOptions{Metrics: m})
+	mgr := NewCookieManagerOptions(st, &CookieMngrOptions{AllowHTTP: true, Metrics: m})
+	defer mgr.Close()
+
+	h := NewMiddleware(mgr, &MiddlewareOptions{Metrics: m})(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			sess, _ := FromContext(r.Context())
+			sess.Set("a", 1)
+		}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	cookies := rec.Result().Cookies()
+	eq(1, len(cookies))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	eq(1.0, m.counters[`session_middleware_requests_total{session="new"}`])
+	eq(1.0, m.counters[`session_middleware_requests_total{session="loaded"}`])
+	eq(2.0, m.counters[`session_middleware_saves_total`])
+	eq(1.0, m.counters[`session_manager_operations_total{manager="cookie",op="load",result="miss"}`])
+	eq(1.0, m.counters[`session_manager_operations_total{manager="cookie",op="load",result="hit"}`])
+	eq(2.0, m.counters[`session_manager_operations_total{manager="cookie",op="save",result="ok"}`])
+	eq(1.0, m.counters[`session_store_operations_total{op="load",result="hit",store="inmem"}`])
+	eq(2.0, m.counters[`session_store_operations_total{op="save",result="ok",store="inmem"}`])
+	eq(3, m.hists[`session_store_operation_duration_seconds{op="load",store="inmem"}`]+
+		m.hists[`session_store_operation_duration_seconds{op="save",store="inmem"}`])
+	eq(1.0, m.gauges[`session_store_sessions{store="inmem"}`])
+}
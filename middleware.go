@@ -13,32 +13,168 @@ const SessionKey ctxKeySession = 0
 
 type sessionFunc func() Session
 
+// sessionCreator is implemented by managers creating new sessions matching their configuration.
+type sessionCreator interface {
+	NewSession() Session
+}
+
+// cookieReissuer is implemented by managers issuing persistent cookies which are to be re-issued
+// for loaded sessions that are not saved.
+type cookieReissuer interface {
+	ReissueCookie(sess Session, w http.ResponseWriter)
+}
+
+// MiddlewareOptions defines options that may be passed when creating a new middleware.
+// All fields are optional; default value will be used for any field that has the zero value.
+type MiddlewareOptions struct {
+	// Function to create a new session if the request does not have one; default value is the NewSession
+	// method of the manager if it has one (e.g. CookieManager.NewSession()), else NewSession.
+	// If the store does not use codec.Gob, sessions should be created with the codec of the store
+	// (see SessOptions.Codec), so Session.TrySet() validates attributes of new sessions with it.
+	SessionFunc func() Session
+
+	// Metrics to report served requests and saved sessions to; default value is NopMetrics.
+	Metrics Metrics
+
+	// Hook to limit the creation of new sessions, e.g. per client (IP address) rate limiting;
+	// default value is nil which allows all.
+	// It is called at the end of a request before a session created in the request would be saved.
+	// If it returns false, the new session is not saved (and so no session cookie is issued).
+	AllowCreate func(r *http.Request) bool
+}
+
 // Middleware return a http middleware with session process
 func Middleware(mgr Manager, sf sessionFunc) func(next http.Handler) http.Handler {
+	return NewMiddleware(mgr, &MiddlewareOptions{SessionFunc: sf})
+}
+
+// NewMiddleware returns a http middleware with session process, with the specified options.
+// A request cache is attached to the context of each request, which is flushed at the end of the request
+// (see RequestCachedStore).
+// The session is saved if it is new and has attributes set, or if it was modified (see Session.State());
+// sessions removed during the request are not saved. It is saved right before the handler writes the header
+// of the response (so the session cookie can be added to it), and again at the end of the request
+// if it was modified after that. Persistent cookies of loaded sessions which are not saved are re-issued
+// if the manager supports it (see CookieManager.ReissueCookie()).
+func NewMiddleware(mgr Manager, o *MiddlewareOptions) func(next http.Handler) http.Handler {
+	sf := o.SessionFunc
+	if sf == nil {
+		sf = NewSession
+		if sc, ok := mgr.(sessionCreator); ok {
+			sf = sc.NewSession
+		}
+	}
+	metrics := o.Metrics
+	if metrics == nil {
+		metrics = NopMetrics
+	}
+	allowCreate := o.AllowCreate
+
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
+			// Stores wrapped with RequestCachedStore cache sessions in the request and defer changes to its end:
+			r = r.WithContext(ContextWithRequestCache(r.Context()))
 			sess := mgr.Load(r)
 			if sess == nil {
-				if sf == nil {
-					sf = NewSession
-				}
 				sess = sf()
+				metrics.Counter(MetricMiddlewareRequests, 1, Labels{"session": "new"})
+			} else {
+				metrics.Counter(MetricMiddlewareRequests, 1, Labels{"session": "loaded"})
 			}
 			ctx := r.Context()
 			ctx = ContextWithSession(ctx, sess)
-			defer func() {
-				if sess, ok := FromContext(r.Context()); ok {
-					if sess.Changed() {
-						mgr.Save(sess, w)
+			sw := &saveWriter{ResponseWriter: w}
+			denied := false
+			sw.save = func() {
+				sess, ok := FromContext(ctx)
+				if !ok || denied {
+					return
+				}
+				if !needsSave(sess) {
+					// Not saved, but the persistent cookie of the session is re-issued to slide its expiration:
+					if ri, ok := mgr.(cookieReissuer); ok && sess.State() == StateLoaded && !sw.wrote {
+						ri.ReissueCookie(sess, w)
 					}
+					return
+				}
+				if sess.State() == StateNew && allowCreate != nil && !allowCreate(r) {
+					denied = true
+					metrics.Counter(MetricMiddlewareDenied, 1, nil)
+					return
+				}
+				if cm, ok := mgr.(ContextManager); ok {
+					cm.SaveContext(ctx, sess, w)
+				} else {
+					mgr.Save(sess, w)
 				}
+				metrics.Counter(MetricMiddlewareSaves, 1, nil)
+			}
+			defer func() {
+				defer FlushRequestCache(ctx) // Including the save below
+				// Saved before the header is written if the handler writes a response,
+				// but changes made after that still have to be saved (the cookie can't be added then):
+				sw.save()
 			}()
-			next.ServeHTTP(w, r.WithContext(ctx))
+			next.ServeHTTP(sw, r.WithContext(ctx))
 		}
 		return http.HandlerFunc(fn)
 	}
 }
 
+// saveWriter is a http.ResponseWriter which saves the session of the request before the header
+// of the response is written, so the session cookie can still be added to it.
+type saveWriter struct {
+	http.ResponseWriter
+	save  func() // Saves the session if needed
+	wrote bool   // Tells if the header was written
+}
+
+// WriteHeader is to implement http.ResponseWriter.WriteHeader().
+func (w *saveWriter) WriteHeader(code int) {
+	w.writeHeader()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write is to implement http.ResponseWriter.Write().
+func (w *saveWriter) Write(p []byte) (int, error) {
+	w.writeHeader()
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush is to implement http.Flusher.Flush(); it is a no-op if the wrapped writer is not a http.Flusher.
+func (w *saveWriter) Flush() {
+	w.writeHeader()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, used by http.ResponseController.
+func (w *saveWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writeHeader saves the session before the header is written for the first time.
+func (w *saveWriter) writeHeader() {
+	if !w.wrote {
+		w.save()
+		w.wrote = true
+	}
+}
+
+// needsSave tells if the session of a request is to be saved at the end of the request:
+// if it is new and has attributes set, or if it was loaded and then modified.
+// Removed sessions and loaded sessions which were not modified are not saved.
+func needsSave(sess Session) bool {
+	switch sess.State() {
+	case StateNew:
+		return sess.Changed()
+	case StateModified:
+		return true
+	}
+	return false
+}
+
 // ContextWithSession returns a new Context that carries value Session.
 func ContextWithSession(ctx context.Context, sess Session) context.Context {
 	return context.WithValue(ctx, SessionKey, sess)
@@ -0,0 +1,213 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-osin/session/codec"
+	"github.com/icza/mighty"
+)
+
+func TestMiddlewareState(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	m := newRecMetrics()
+	mgr := NewCookieManagerOptions(NewInMemStore(), &CookieMngrOptions{AllowHTTP: true})
+	defer mgr.Close()
+
+	var action string
+	var sess Session
+	h := NewMiddleware(mgr, &MiddlewareOptions{Metrics: m})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, _ = FromContext(r.Context())
+		switch action {
+		case "set":
+			sess.Set("a", 1)
+		case "remove":
+			sess.Set("a", 2)
+			mgr.Remove(sess, w)
+		}
+	}))
+	serve := func(a string, cookies ...*http.Cookie) []*http.Cookie {
+		action = a
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Result().Cookies()
+	}
+	saves := func() float64 { return m.counters[`session_middleware_saves_total`] }
+
+	// New session without attributes is not saved:
+	eq(0, len(serve("")))
+	eq(0.0, saves())
+
+	cookies := serve("set")
+	eq(1, len(cookies))
+	eq(1.0, saves())
+
+	// Not modified:
+	eq(0, len(serve("", cookies...)))
+	eq(StateLoaded, sess.State())
+	eq(1.0, saves())
+
+	// Modified, saved without a new cookie:
+	eq(0, len(serve("set", cookies...)))
+	eq(2.0, saves())
+
+	// Removed, not saved again:
+	eq(1, len(serve("remove", cookies...)))
+	eq(StateDestroyed, sess.State())
+	eq(2.0, saves())
+	eq(nil, mgr.Load(func() *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookies[0])
+		return r
+	}()))
+}
+
+func TestMiddlewareWritingHandler(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	mgr := NewCookieManagerOptions(NewInMemStore(), &CookieMngrOptions{AllowHTTP: true})
+	defer mgr.Close()
+
+	var sess Session
+	h := NewMiddleware(mgr, &MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, _ = FromContext(r.Context())
+		sess.Set("a", 1)
+		w.Write([]byte("body"))
+		sess.Set("b", 2) // After the header was written
+	}))
+
+	// Cookie is added before the body is written:
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	eq("body", rec.Body.String())
+	cookies := rec.Result().Cookies()
+	eq(1, len(cookies))
+	eq(sess.ID(), cookies[0].Value)
+
+	// Changes after the header are saved too:
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	s := mgr.Load(r)
+	neq(nil, s)
+	eq(1, s.Get("a"))
+	eq(2, s.Get("b"))
+}
+
+func TestMiddlewarePersistentCookie(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	m := newRecMetrics()
+	mgr := NewCookieManagerOptions(NewInMemStore(), &CookieMngrOptions{AllowHTTP: true, CookieMaxAge: time.Hour})
+	defer mgr.Close()
+
+	set := true
+	h := NewMiddleware(mgr, &MiddlewareOptions{Metrics: m})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := FromContext(r.Context())
+		if set {
+			sess.Set("a", 1)
+		}
+		sess.Get("a")
+		w.Write([]byte("body"))
+	}))
+	serve := func(cookies ...*http.Cookie) []*http.Cookie {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Result().Cookies()
+	}
+
+	cookies := serve()
+	eq(1, len(cookies))
+	eq(1.0, m.counters[`session_middleware_saves_total`])
+
+	// Only read, re-issued without a save:
+	set = false
+	cookies2 := serve(cookies...)
+	eq(1, len(cookies2))
+	eq(cookies[0].Value, cookies2[0].Value)
+	eq(3600, cookies2[0].MaxAge)
+	eq(1.0, m.counters[`session_middleware_saves_total`])
+}
+
+func TestMiddlewareAllowCreate(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	m := newRecMetrics()
+	mgr := NewCookieManagerOptions(NewInMemStore(), &CookieMngrOptions{AllowHTTP: true})
+	defer mgr.Close()
+
+	allow := false
+	h := NewMiddleware(mgr, &MiddlewareOptions{
+		Metrics:     m,
+		AllowCreate: func(r *http.Request) bool { return allow },
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := FromContext(r.Context())
+		sess.Set("a", 1)
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	eq(0, len(rec.Result().Cookies()))
+	eq(1.0, m.counters[`session_middleware_denied_total`])
+
+	allow = true
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	eq(1, len(rec.Result().Cookies()))
+	eq(1.0, m.counters[`session_middleware_saves_total`])
+}
+
+func TestMiddlewareTrySet(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	type unregistered struct{ A int }
+
+	mgr := NewCookieManagerOptions(NewInMemStore(), &CookieMngrOptions{AllowHTTP: true})
+	defer mgr.Close()
+
+	var err error
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := FromContext(r.Context())
+		err = sess.TrySet("a", unregistered{})
+	})
+
+	// New session of the default SessionFunc, validated with gob:
+	NewMiddleware(mgr, &MiddlewareOptions{})(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	neq(nil, err)
+
+	// New session created with the codec of the store:
+	sf := func() Session { return NewSessionOptions(&SessOptions{Codec: &codec.JSON}) }
+	NewMiddleware(mgr, &MiddlewareOptions{SessionFunc: sf})(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	eq(nil, err)
+}
+
+func TestMiddlewareManagerIDGen(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	mgr := NewCookieManagerOptions(NewInMemStore(), &CookieMngrOptions{AllowHTTP: true, IDGen: ULID})
+	defer mgr.Close()
+
+	var sess Session
+	h := NewMiddleware(mgr, &MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, _ = FromContext(r.Context())
+		sess.Set("a", 1)
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	eq(true, ULID.Valid(sess.ID()))
+
+	// The issued cookie passes validation:
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(rec.Result().Cookies()[0])
+	eq(sess, mgr.Load(r))
+}
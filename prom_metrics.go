@@ -0,0 +1,242 @@
+/*
+
+A Metrics implementation producing the Prometheus text exposition format.
+
+*/
+
+package session
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PromMetrics is a Metrics implementation which keeps metrics in memory and
+// renders them in the Prometheus text exposition format (version 0.0.4).
+// It has no dependencies and does not do any network communication on its own:
+// register it as an http.Handler to a path scraped by Prometheus, or use WriteTo().
+type PromMetrics struct {
+	buckets []float64 // Upper bounds of histogram buckets, sorted
+
+	mux      sync.Mutex             // mutex to synchronize access to families
+	families map[string]*promFamily // Metric families mapped from name
+}
+
+// PromMetricsOptions defines options that may be passed when creating a new PromMetrics.
+// All fields are optional; default value will be used for any field that has the zero value.
+type PromMetricsOptions struct {
+	// Upper bounds of histogram buckets; default value is the default buckets of the Prometheus
+	// client libraries: .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10
+	Buckets []float64
+}
+
+// Pointer to zero value of PromMetricsOptions to be reused for efficiency.
+var zeroPromMetricsOptions = new(PromMetricsOptions)
+
+var defaultPromBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// promFamily is a metric family: metrics of the same name and type.
+type promFamily struct {
+	typ    string                 // Prometheus type: "counter", "gauge" or "histogram"
+	series map[string]*promSeries // Series mapped from rendered labels
+}
+
+// promSeries is a metric of a family with specific labels.
+type promSeries struct {
+	labels string   // Rendered labels without braces, e.g. `op="load",store="inmem"`
+	value  float64  // Value of counters and gauges
+	counts []uint64 // Non-cumulative bucket counts of histograms, last one is the +Inf bucket
+	sum    float64  // Sum of observations of histograms
+	count  uint64   // Count of observations of histograms
+}
+
+// NewPromMetrics returns a new PromMetrics with the default options.
+// Default values of options are listed in the PromMetricsOptions type.
+func NewPromMetrics() *PromMetrics {
+	return NewPromMetricsOptions(zeroPromMetricsOptions)
+}
+
+// NewPromMetricsOptions returns a new PromMetrics with the specified options.
+func NewPromMetricsOptions(o *PromMetricsOptions) *PromMetrics {
+	buckets := o.Buckets
+	if len(buckets) == 0 {
+		buckets = defaultPromBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &PromMetrics{
+		buckets:  buckets,
+		families: make(map[string]*promFamily),
+	}
+}
+
+// series returns the series of the specified metric, creating it if needed.
+// Must be called with p.mux held.
+func (p *PromMetrics) series(typ, name string, labels Labels) *promSeries {
+	f := p.families[name]
+	if f == nil {
+		f = &promFamily{typ: typ, series: make(map[string]*promSeries)}
+		p.families[name] = f
+	}
+	ls := renderLabels(labels)
+	s := f.series[ls]
+	if s == nil {
+		s = &promSeries{labels: ls}
+		if typ == "histogram" {
+			s.counts = make([]uint64, len(p.buckets)+1)
+		}
+		f.series[ls] = s
+	}
+	return s
+}
+
+// Counter is to implement Metrics.Counter().
+func (p *PromMetrics) Counter(name string, delta float64, labels Labels) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.series("counter", name, labels).value += delta
+}
+
+// Histogram is to implement Metrics.Histogram().
+func (p *PromMetrics) Histogram(name string, value float64, labels Labels) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	s := p.series("histogram", name, labels)
+	s.counts[sort.SearchFloat64s(p.buckets, value)]++
+	s.sum += value
+	s.count++
+}
+
+// Gauge is to implement Metrics.Gauge().
+func (p *PromMetrics) Gauge(name string, value float64, labels Labels) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.series("gauge", name, labels).value = value
+}
+
+// WriteTo writes all metrics to w in the Prometheus text exposition format.
+// Families and series are written in a deterministic (sorted) order.
+func (p *PromMetrics) WriteTo(w io.Writer) (n int64, err error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	names := make([]string, 0, len(p.families))
+	for name := range p.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := p.families[name]
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, f.typ)
+
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			s := f.series[k]
+			if f.typ != "histogram" {
+				fmt.Fprintf(bw, "%s%s %s\n", name, braced(s.labels), formatFloat(s.value))
+				continue
+			}
+			var cum uint64
+			for i, c := range s.counts {
+				cum += c
+				le := "+Inf"
+				if i < len(p.buckets) {
+					le = formatFloat(p.buckets[i])
+				}
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", name, braced(joinLabels(s.labels, `le="`+le+`"`)), cum)
+			}
+			fmt.Fprintf(bw, "%s_sum%s %s\n", name, braced(s.labels), formatFloat(s.sum))
+			fmt.Fprintf(bw, "%s_count%s %d\n", name, braced(s.labels), s.count)
+		}
+	}
+
+	err = bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP writes all metrics to the response in the Prometheus text exposition format.
+func (p *PromMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.WriteTo(w)
+}
+
+// renderLabels renders labels sorted by name, without braces.
+func renderLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + `="` + labelValueEscaper.Replace(labels[name]) + `"`
+	}
+	return strings.Join(parts, ",")
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// joinLabels joins rendered label lists.
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+// braced returns the rendered labels enclosed in braces, or the empty string if there are no labels.
+func braced(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// formatFloat formats a sample value as expected by the exposition format.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// countingWriter is an io.Writer which counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,45 @@
+package session
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/icza/mighty"
+)
+
+func TestPromMetrics(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	p := NewPromMetricsOptions(&PromMetricsOptions{Buckets: []float64{1, 0.1}})
+	p.Counter("c_total", 1, Labels{"b": "2", "a": `x"y`})
+	p.Counter("c_total", 2, Labels{"b": "2", "a": `x"y`})
+	p.Gauge("g", 5, nil)
+	p.Gauge("g", 3, nil)
+	p.Histogram("h", 0.05, Labels{"op": "load"})
+	p.Histogram("h", 0.5, Labels{"op": "load"})
+	p.Histogram("h", 7, Labels{"op": "load"})
+
+	exp := `# TYPE c_total counter
+c_total{a="x\"y",b="2"} 3
+# TYPE g gauge
+g 3
+# TYPE h histogram
+h_bucket{op="load",le="0.1"} 1
+h_bucket{op="load",le="1"} 2
+h_bucket{op="load",le="+Inf"} 3
+h_sum{op="load"} 7.55
+h_count{op="load"} 3
+`
+	buf := &bytes.Buffer{}
+	n, err := p.WriteTo(buf)
+	eq(nil, err)
+	eq(exp, buf.String())
+	eq(int64(len(exp)), n)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	eq(exp, rec.Body.String())
+	eq(true, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+}
@@ -0,0 +1,57 @@
+package redicache
+
+import (
+	"context"
+	"errors"
+)
+
+// Client is the interface of Redis clients the store talks to.
+// Any Redis client (single node, Sentinel, Cluster or Ring) can be adapted to it with a ClientFunc,
+// e.g. using github.com/redis/go-redis:
+//
+//	rdb := redis.NewClusterClient(&redis.ClusterOptions{Addrs: addrs})
+//	client := redicache.ClientFunc(func(ctx context.Context, args ...interface{}) (interface{}, error) {
+//		v, err := rdb.Do(ctx, args...).Result()
+//		if err == redis.Nil {
+//			return nil, nil
+//		}
+//		return v, err
+//	})
+//
+// The store only uses commands operating on a single key, so it works with Redis Cluster too.
+type Client interface {
+	// Do executes a Redis command and returns its reply.
+	// Replies are returned as string (simple strings), int64 (integers), []byte or string (bulk strings),
+	// []interface{} (arrays) or nil (nil bulk strings and nil arrays).
+	// Error replies are returned as errors.
+	Do(ctx context.Context, args ...interface{}) (interface{}, error)
+}
+
+// ClientFunc is an adapter to allow the use of ordinary functions as Client.
+type ClientFunc func(ctx context.Context, args ...interface{}) (interface{}, error)
+
+// Do calls f(ctx, args...).
+func (f ClientFunc) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	return f(ctx, args...)
+}
+
+// Error is an error reply of the Redis server.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// errUnexpectedReply is returned if the reply to a command is of unexpected type.
+var errUnexpectedReply = errors.New("redicache: unexpected reply")
+
+// replyBytes converts a bulk string reply to a byte slice; nil is returned for a nil reply.
+func replyBytes(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, errUnexpectedReply
+}
@@ -0,0 +1,274 @@
+package redicache
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ConnOptions defines options of the built-in single node Redis client.
+// All fields are optional; default value will be used for any field that has the zero value.
+type ConnOptions struct {
+	// Address (host:port) of the Redis server; default value is "localhost:6379".
+	Addr string
+
+	// Username to authenticate with (Redis 6 ACL); default value is the empty string (default user).
+	Username string
+
+	// Password to authenticate with; default value is the empty string (no authentication).
+	Password string
+
+	// Database to select; default value is 0.
+	DB int
+
+	// TLS configuration; default value is nil which means TLS is not used.
+	TLSConfig *tls.Config
+
+	// Timeout of dialing and of commands (unless the context has an earlier deadline); default value is 3 seconds.
+	Timeout time.Duration
+
+	// Max number of idle connections to keep; default value is 4.
+	MaxIdleConns int
+}
+
+// ConnClient is a minimal Client implementation connecting to a single Redis node using the RESP protocol.
+// It is used by the store if no Client is specified. It is safe for concurrent use.
+type ConnClient struct {
+	o ConnOptions
+
+	mux    sync.Mutex // mutex to synchronize access to idle and closed
+	idle   []*conn    // Idle connections
+	closed bool       // Tells if the client is closed
+}
+
+// NewConnClient returns a new ConnClient with the specified options.
+// Connections are established lazily.
+func NewConnClient(o *ConnOptions) *ConnClient {
+	c := &ConnClient{o: *o}
+	if c.o.Addr == "" {
+		c.o.Addr = "localhost:6379"
+	}
+	if c.o.Timeout <= 0 {
+		c.o.Timeout = 3 * time.Second
+	}
+	if c.o.MaxIdleConns <= 0 {
+		c.o.MaxIdleConns = 4
+	}
+	return c
+}
+
+// errClosed is returned when using a closed client.
+var errClosed = errors.New("redicache: client is closed")
+
+// Do is to implement Client.Do().
+func (c *ConnClient) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	cn, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v, err := cn.do(ctx, c.o.Timeout, args...)
+	c.release(cn, err)
+	return v, err
+}
+
+// conn returns an idle or a new connection.
+func (c *ConnClient) conn(ctx context.Context) (*conn, error) {
+	c.mux.Lock()
+	if c.closed {
+		c.mux.Unlock()
+		return nil, errClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mux.Unlock()
+		return cn, nil
+	}
+	c.mux.Unlock()
+
+	return c.dial(ctx)
+}
+
+// dial establishes a new connection, authenticates and selects the database.
+func (c *ConnClient) dial(ctx context.Context) (*conn, error) {
+	d := &net.Dialer{Timeout: c.o.Timeout}
+	var nc net.Conn
+	var err error
+	if c.o.TLSConfig != nil {
+		nc, err = (&tls.Dialer{NetDialer: d, Config: c.o.TLSConfig}).DialContext(ctx, "tcp", c.o.Addr)
+	} else {
+		nc, err = d.DialContext(ctx, "tcp", c.o.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cn := newConn(nc)
+
+	if c.o.Password != "" {
+		args := []interface{}{"AUTH", c.o.Password}
+		if c.o.Username != "" {
+			args = []interface{}{"AUTH", c.o.Username, c.o.Password}
+		}
+		if _, err = cn.do(ctx, c.o.Timeout, args...); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if c.o.DB != 0 {
+		if _, err = cn.do(ctx, c.o.Timeout, "SELECT", c.o.DB); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// release returns a connection to the idle connections,
+// or closes it if it failed or if there are enough idle connections.
+func (c *ConnClient) release(cn *conn, err error) {
+	if _, ok := err.(Error); err == nil || ok {
+		c.mux.Lock()
+		if !c.closed && len(c.idle) < c.o.MaxIdleConns {
+			c.idle = append(c.idle, cn)
+			c.mux.Unlock()
+			return
+		}
+		c.mux.Unlock()
+	}
+	cn.nc.Close()
+}
+
+// Close closes the idle connections, and makes further commands fail.
+func (c *ConnClient) Close() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.closed = true
+	for _, cn := range c.idle {
+		cn.nc.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+// conn is a connection to a Redis server.
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+}
+
+func newConn(nc net.Conn) *conn {
+	return &conn{nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+}
+
+// do sends a command and reads its reply.
+// The deadline is the deadline of ctx or timeout, whichever is earlier.
+func (cn *conn) do(ctx context.Context, timeout time.Duration, args ...interface{}) (interface{}, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	cn.nc.SetDeadline(deadline)
+
+	if err := writeCommand(cn.w, args...); err != nil {
+		return nil, err
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(cn.r)
+}
+
+// writeCommand writes a command as an array of bulk strings.
+func writeCommand(w *bufio.Writer, args ...interface{}) error {
+	w.WriteString("*")
+	w.WriteString(strconv.Itoa(len(args)))
+	w.WriteString("\r\n")
+	for _, arg := range args {
+		var b []byte
+		switch arg := arg.(type) {
+		case string:
+			b = []byte(arg)
+		case []byte:
+			b = arg
+		case int:
+			b = strconv.AppendInt(nil, int64(arg), 10)
+		case int64:
+			b = strconv.AppendInt(nil, arg, 10)
+		default:
+			return fmt.Errorf("redicache: unsupported argument type: %T", arg)
+		}
+		w.WriteString("$")
+		w.WriteString(strconv.Itoa(len(b)))
+		w.WriteString("\r\n")
+		w.Write(b)
+		w.WriteString("\r\n")
+	}
+	return nil
+}
+
+// maxBulkLen is the max length of bulk strings accepted in replies (the max of Redis).
+const maxBulkLen = 512 << 20
+
+// readReply reads a reply.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redicache: invalid reply: %q", line)
+	}
+	typ, line := line[0], line[1:len(line)-2]
+
+	switch typ {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, Error(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n > maxBulkLen {
+			return nil, fmt.Errorf("redicache: invalid bulk length: %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("redicache: invalid array length: %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			// Error replies in arrays (e.g. of EXEC) are returned as values.
+			if a[i], err = readReply(r); err != nil {
+				if e, ok := err.(Error); ok {
+					a[i] = e
+					continue
+				}
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("redicache: invalid reply type: %q", typ)
+}
@@ -0,0 +1,459 @@
+package redicache
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-osin/session/clocktest"
+	"github.com/icza/mighty"
+)
+
+// fakeRedis is an in-process Redis server speaking RESP, implementing the commands used by the store.
+type fakeRedis struct {
+	ln    net.Listener
+	clock *clocktest.Clock // Clock to expire keys by
+
+	mux      sync.Mutex
+	password string
+	data     map[string][]byte            // String values
+	hashes   map[string]map[string][]byte // Hash values
+	expires  map[string]time.Time
+	scripts  map[string]string // Sources of cached scripts by SHA1 digest
+	cmds     []string          // Names of the commands served
+	failNext int               // Number of next connections to drop instead of replying
+
+	subs map[*bufio.Writer]string // Pattern subscriptions of connections
+}
+
+// newFakeRedis starts a new fake server (a TLS server if config is not nil);
+// it is stopped when the test completes.
+// Keys expire by the clock of the server, which should be passed to the stores and sessions as well.
+func newFakeRedis(t *testing.T, config *tls.Config) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != nil {
+		ln = tls.NewListener(ln, config)
+	}
+	fr := &fakeRedis{ln: ln, clock: clocktest.New(time.Now()), data: map[string][]byte{}, hashes: map[string]map[string][]byte{}, expires: map[string]time.Time{},
+		scripts: map[string]string{}, subs: map[*bufio.Writer]string{}}
+	stop := fr.clock.Every(5*time.Millisecond, fr.expire)
+	t.Cleanup(func() {
+		stop()
+		ln.Close()
+	})
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(c)
+		}
+	}()
+	return fr
+}
+
+func (fr *fakeRedis) addr() string { return fr.ln.Addr().String() }
+
+// client returns a new ConnClient connected to the fake server.
+func (fr *fakeRedis) client(t *testing.T) *ConnClient {
+	c := NewConnClient(&ConnOptions{Addr: fr.addr(), Timeout: time.Second})
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// commands returns the names of the commands served, and resets them.
+func (fr *fakeRedis) commands() []string {
+	fr.mux.Lock()
+	defer fr.mux.Unlock()
+	cmds := fr.cmds
+	fr.cmds = nil
+	return cmds
+}
+
+// live tells if key exists and is not expired; fr.mux must be held.
+func (fr *fakeRedis) live(key string) bool {
+	if exp, ok := fr.expires[key]; ok && fr.clock.Now().After(exp) {
+		fr.del(key)
+		fr.notify(key, "expired")
+	}
+	_, ok := fr.data[key]
+	_, ok2 := fr.hashes[key]
+	return ok || ok2
+}
+
+// del deletes a key; fr.mux must be held.
+func (fr *fakeRedis) del(key string) {
+	delete(fr.data, key)
+	delete(fr.hashes, key)
+	delete(fr.expires, key)
+}
+
+// notify publishes a keyspace notification of key to the subscribers; fr.mux must be held.
+func (fr *fakeRedis) notify(key, event string) {
+	channel := "__keyspace@0__:" + key
+	for w, pattern := range fr.subs {
+		if ok, _ := path.Match(pattern, channel); ok {
+			w.WriteString("*4\r\n$8\r\npmessage\r\n")
+			for _, s := range []string{pattern, channel, event} {
+				w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+			}
+			w.Flush()
+		}
+	}
+}
+
+// expire actively expires keys (like Redis does).
+func (fr *fakeRedis) expire() {
+	fr.mux.Lock()
+	for key := range fr.expires {
+		fr.live(key)
+	}
+	fr.mux.Unlock()
+}
+
+func (fr *fakeRedis) serve(c net.Conn) {
+	r, w := bufio.NewReader(c), bufio.NewWriter(c)
+	defer func() {
+		fr.mux.Lock()
+		delete(fr.subs, w)
+		fr.mux.Unlock()
+		c.Close()
+	}()
+	authed := false
+	for {
+		v, err := readReply(r)
+		if err != nil {
+			return
+		}
+		a, _ := v.([]interface{})
+		if len(a) == 0 {
+			return
+		}
+		args := make([]string, len(a))
+		for i, arg := range a {
+			b, _ := replyBytes(arg)
+			args[i] = string(b)
+		}
+		cmd := strings.ToUpper(args[0])
+
+		fr.mux.Lock()
+		if fr.failNext > 0 {
+			fr.failNext--
+			fr.mux.Unlock()
+			return
+		}
+		fr.cmds = append(fr.cmds, cmd)
+		if fr.password != "" && !authed && cmd != "AUTH" {
+			w.WriteString("-NOAUTH Authentication required.\r\n")
+		} else {
+			if cmd == "AUTH" {
+				authed = args[len(args)-1] == fr.password
+			}
+			fr.exec(w, cmd, args[1:])
+		}
+		w.Flush() // Under fr.mux, as notifications may be written to w concurrently
+		fr.mux.Unlock()
+	}
+}
+
+// exec executes a command and writes its reply; fr.mux must be held.
+func (fr *fakeRedis) exec(w *bufio.Writer, cmd string, args []string) {
+	bulk := func(b []byte) {
+		w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+		w.Write(b)
+		w.WriteString("\r\n")
+	}
+	integer := func(n int) { w.WriteString(":" + strconv.Itoa(n) + "\r\n") }
+
+	switch cmd {
+	case "PING":
+		w.WriteString("+PONG\r\n")
+	case "AUTH", "SELECT", "CONFIG":
+		w.WriteString("+OK\r\n")
+	case "PSUBSCRIBE":
+		fr.subs[w] = args[0]
+		w.WriteString("*3\r\n$10\r\npsubscribe\r\n")
+		bulk([]byte(args[0]))
+		integer(1)
+	case "EXISTS":
+		n := 0
+		for _, key := range args {
+			if fr.live(key) {
+				n++
+			}
+		}
+		integer(n)
+	case "GET":
+		if fr.live(args[0]) {
+			bulk(fr.data[args[0]])
+		} else {
+			w.WriteString("$-1\r\n")
+		}
+	case "GETEX":
+		if !fr.live(args[0]) {
+			w.WriteString("$-1\r\n")
+			return
+		}
+		if len(args) == 3 && strings.ToUpper(args[1]) == "PX" {
+			ms, _ := strconv.Atoi(args[2])
+			fr.expires[args[0]] = fr.clock.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		bulk(fr.data[args[0]])
+	case "SET":
+		fr.del(args[0])
+		fr.data[args[0]] = []byte(args[1])
+		if len(args) == 4 && strings.ToUpper(args[2]) == "PX" {
+			ms, _ := strconv.Atoi(args[3])
+			fr.expires[args[0]] = fr.clock.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		w.WriteString("+OK\r\n")
+	case "PEXPIRE":
+		if !fr.live(args[0]) {
+			integer(0)
+			return
+		}
+		ms, _ := strconv.Atoi(args[1])
+		fr.expires[args[0]] = fr.clock.Now().Add(time.Duration(ms) * time.Millisecond)
+		integer(1)
+	case "PTTL":
+		switch exp, ok := fr.expires[args[0]]; {
+		case !fr.live(args[0]):
+			integer(-2)
+		case !ok:
+			integer(-1)
+		default:
+			integer(int(exp.Sub(fr.clock.Now()) / time.Millisecond))
+		}
+	case "DEL":
+		n := 0
+		for _, key := range args {
+			if fr.live(key) {
+				fr.del(key)
+				n++
+			}
+		}
+		integer(n)
+	case "HSET":
+		if !fr.live(args[0]) {
+			fr.hashes[args[0]] = map[string][]byte{}
+		}
+		h, n := fr.hashes[args[0]], 0
+		for i := 1; i+1 < len(args); i += 2 {
+			if _, ok := h[args[i]]; !ok {
+				n++
+			}
+			h[args[i]] = []byte(args[i+1])
+		}
+		integer(n)
+	case "HGET":
+		if v, ok := fr.hashes[args[0]][args[1]]; ok && fr.live(args[0]) {
+			bulk(v)
+		} else {
+			w.WriteString("$-1\r\n")
+		}
+	case "HGETALL":
+		if !fr.live(args[0]) {
+			w.WriteString("*0\r\n")
+			return
+		}
+		h := fr.hashes[args[0]]
+		w.WriteString("*" + strconv.Itoa(2*len(h)) + "\r\n")
+		for field, v := range h {
+			bulk([]byte(field))
+			bulk(v)
+		}
+	case "HDEL":
+		n := 0
+		if fr.live(args[0]) {
+			h := fr.hashes[args[0]]
+			for _, field := range args[1:] {
+				if _, ok := h[field]; ok {
+					delete(h, field)
+					n++
+				}
+			}
+			if len(h) == 0 {
+				fr.del(args[0])
+			}
+		}
+		integer(n)
+	case "EVAL", "EVALSHA":
+		src := args[0]
+		if cmd == "EVALSHA" {
+			var ok bool
+			if src, ok = fr.scripts[args[0]]; !ok {
+				w.WriteString("-NOSCRIPT No matching script.\r\n")
+				return
+			}
+		} else {
+			fr.scripts[newScript(src).sha] = src
+		}
+		fr.eval(w, src, args[2], args[3:])
+	default:
+		w.WriteString("-ERR unknown command '" + cmd + "'\r\n")
+	}
+}
+
+// eval executes the known scripts of the store (emulating them in Go) and writes the reply; fr.mux must be held.
+func (fr *fakeRedis) eval(w *bufio.Writer, src, key string, argv []string) {
+	discard := bufio.NewWriter(io.Discard)
+	switch src {
+	case scriptReplace.src:
+		fr.exec(discard, "DEL", []string{key})
+		fr.exec(discard, "HSET", append([]string{key}, argv[1:]...))
+		fr.exec(w, "PEXPIRE", []string{key, argv[0]})
+	case scriptSetAttr.src:
+		if !fr.live(key) {
+			w.WriteString(":0\r\n")
+			return
+		}
+		fr.exec(discard, "HSET", []string{key, argv[0], argv[1]})
+		w.WriteString(":1\r\n")
+	case scriptUpdate.src:
+		if !fr.live(key) {
+			w.WriteString(":0\r\n")
+			return
+		}
+		n, _ := strconv.Atoi(argv[1])
+		if n > 0 {
+			fr.exec(discard, "HDEL", append([]string{key}, argv[2:2+n]...))
+		}
+		if len(argv) > 2+n {
+			fr.exec(discard, "HSET", append([]string{key}, argv[2+n:]...))
+		}
+		fr.exec(w, "PEXPIRE", []string{key, argv[0]})
+	default:
+		w.WriteString("-ERR unknown script\r\n")
+	}
+}
+
+// selfSignedTLS returns server and client TLS configs with a self-signed certificate for 127.0.0.1.
+func selfSignedTLS(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake redis"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: pool}
+	return
+}
+
+func TestConnClient(t *testing.T) {
+	eq, deq := mighty.EqDeq(t)
+	ctx := context.Background()
+
+	fr := newFakeRedis(t, nil)
+	c := fr.client(t)
+
+	v, err := c.Do(ctx, "GET", "k")
+	eq(nil, err)
+	eq(nil, v)
+
+	v, err = c.Do(ctx, "SET", "k", []byte("v\r\n"), "PX", 1000)
+	eq(nil, err)
+	eq("OK", v)
+	v, err = c.Do(ctx, "GET", "k")
+	eq(nil, err)
+	deq([]byte("v\r\n"), v)
+	v, err = c.Do(ctx, "DEL", "k", "x")
+	eq(nil, err)
+	eq(int64(1), v)
+
+	_, err = c.Do(ctx, "FOO")
+	eq(Error("ERR unknown command 'FOO'"), err)
+
+	// Connection is still usable after an error reply:
+	_, err = c.Do(ctx, "PING")
+	eq(nil, err)
+
+	c.Close()
+	_, err = c.Do(ctx, "PING")
+	eq(errClosed, err)
+}
+
+func TestConnClientAuth(t *testing.T) {
+	eq, deq := mighty.EqDeq(t)
+	ctx := context.Background()
+
+	fr := newFakeRedis(t, nil)
+	fr.password = "secret"
+
+	c := NewConnClient(&ConnOptions{Addr: fr.addr(), Password: "secret", DB: 2})
+	defer c.Close()
+	_, err := c.Do(ctx, "GET", "k")
+	eq(nil, err)
+	deq([]string{"AUTH", "SELECT", "GET"}, fr.commands())
+
+	c2 := NewConnClient(&ConnOptions{Addr: fr.addr()})
+	defer c2.Close()
+	_, err = c2.Do(ctx, "GET", "k")
+	eq(Error("NOAUTH Authentication required."), err)
+}
+
+func TestConnClientTLS(t *testing.T) {
+	eq := mighty.Eq(t)
+	ctx := context.Background()
+
+	serverConfig, clientConfig := selfSignedTLS(t)
+	fr := newFakeRedis(t, serverConfig)
+
+	c := NewConnClient(&ConnOptions{Addr: fr.addr(), TLSConfig: clientConfig})
+	defer c.Close()
+	v, err := c.Do(ctx, "PING")
+	eq(nil, err)
+	eq("PONG", v)
+}
+
+func TestReadReply(t *testing.T) {
+	eq, deq := mighty.EqDeq(t)
+
+	read := func(s string) (interface{}, error) {
+		return readReply(bufio.NewReader(strings.NewReader(s)))
+	}
+
+	v, err := read("*3\r\n:1\r\n$-1\r\n-ERR x\r\n")
+	eq(nil, err)
+	deq([]interface{}{int64(1), nil, Error("ERR x")}, v)
+
+	v, err = read("*-1\r\n")
+	eq(nil, err)
+	eq(nil, v)
+
+	_, err = read("?\r\n")
+	eq(true, err != nil)
+}
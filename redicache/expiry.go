@@ -0,0 +1,287 @@
+package redicache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-osin/session"
+)
+
+// shadowInfix is inserted between the key prefix and the session id to construct shadow keys.
+const shadowInfix = "shadow:"
+
+// shadowKey returns the shadow key of the session specified by its id.
+func (s *storeImpl) shadowKey(id string) string {
+	return s.keyPrefix + shadowInfix + id
+}
+
+// dataTTL returns the expiration of session data in milliseconds for the session timeout,
+// which includes the expiry grace period.
+func (s *storeImpl) dataTTL(timeout time.Duration) int64 {
+	return millis(timeout + s.expiryGrace)
+}
+
+// shadowExists tells if the shadow key of the session specified by its id exists.
+func (s *storeImpl) shadowExists(ctx context.Context, span session.Span, id string) (bool, error) {
+	v, err := s.do(ctx, "load", span, "EXISTS", s.shadowKey(id))
+	if err != nil {
+		return false, err
+	}
+	n, _ := v.(int64)
+	return n == 1, nil
+}
+
+// setShadow sets the shadow key of the session specified by its id to expire after timeout.
+// It's a no-op if shadow keys are disabled.
+func (s *storeImpl) setShadow(ctx context.Context, span session.Span, op, id string, timeout time.Duration) error {
+	if s.expiryGrace <= 0 {
+		return nil
+	}
+	_, err := s.do(ctx, op, span, "SET", s.shadowKey(id), "", "PX", millis(timeout))
+	return err
+}
+
+// claimExpired loads and deletes the data of an expired session.
+// nil is returned if the data is not found, or if another subscriber claimed it first.
+func (s *storeImpl) claimExpired(ctx context.Context, id string) (session.Session, error) {
+	span := s.startSpan(ctx, "Expire", id)
+	defer span.End()
+
+	key := s.keyPrefix + id
+	var ss session.Session
+	var err error
+	if s.layout == LayoutHash {
+		ss, err = s.loadHash(ctx, span, key)
+	} else {
+		ss, err = s.loadBlob(ctx, span, key, 0) // Don't extend the expiration
+	}
+	if err != nil || ss == nil {
+		return nil, err
+	}
+
+	// Only the subscriber that deletes the data handles the expiry:
+	v, err := s.do(ctx, "expire", span, "DEL", key)
+	if n, _ := v.(int64); err != nil || n != 1 {
+		return nil, err
+	}
+	if h, ok := ss.(*hashSession); ok {
+		ss = h.Session // Don't write the expired session through
+	}
+	return ss, nil
+}
+
+// ExpiryHandler is a function which is called with sessions that expired.
+type ExpiryHandler func(sess session.Session)
+
+// SubscriberOptions defines options that may be passed when creating a new ExpirySubscriber.
+// All fields are optional; default value will be used for any field that has the zero value.
+type SubscriberOptions struct {
+	// Options of the dedicated connection to subscribe to notifications on;
+	// default value connects to localhost:6379. The DB field selects the database whose keyspace is observed.
+	// Note that in case of Redis Cluster, notifications are local to nodes: a subscriber is needed for each master node.
+	Conn *ConnOptions
+
+	// Tells if keyspace notifications of expired keys are to be enabled on the server when connecting,
+	// with "CONFIG SET notify-keyspace-events Kx"; default value is false.
+	// Note that this overwrites other notification settings of the server. CONFIG may also be disabled
+	// on managed Redis services, in which case notifications must be enabled by other means.
+	ConfigureNotifications bool
+
+	// Interval to wait before reconnecting if the subscription connection breaks; default value is 1 second.
+	RetryInterval time.Duration
+}
+
+// ExpirySubscriber listens to Redis keyspace notifications of expired shadow keys of a store,
+// and calls the registered handlers with the expired sessions.
+//
+// The store must be created with StoreOptions.ExpiryGrace, so the data of an expired session
+// is still available when the notification of its shadow key arrives.
+// Each expired session is handled once even if there are multiple subscribers (e.g. multiple application instances):
+// the subscriber which deletes the session data handles it.
+// Note that Redis only delivers notifications to connected subscribers, so expirations during a lost connection
+// are not handled (the data of those sessions expires after the grace period).
+type ExpirySubscriber struct {
+	store         *storeImpl
+	conn          *ConnClient // Used to dial the subscription connection
+	pattern       string      // Pattern of notification channels to subscribe to
+	channelPrefix string      // Prefix of notification channels before the session id
+	configure     bool        // Tells if notifications are to be enabled on the server
+	retryInterval time.Duration
+
+	mux      sync.RWMutex    // mutex to synchronize access to handlers and active
+	handlers []ExpiryHandler // Registered handlers
+	active   *conn           // Active subscription connection, nil if not connected
+
+	done    chan struct{} // Channel to signal close
+	stopped chan struct{} // Channel closed when the subscriber goroutine returned
+}
+
+// NewExpirySubscriber returns a new ExpirySubscriber of the specified store, which must be a store created by this package
+// with StoreOptions.ExpiryGrace set.
+// The returned subscriber subscribes to notifications in its own goroutine; call Close() to stop it.
+func NewExpirySubscriber(st session.Store, o *SubscriberOptions) (*ExpirySubscriber, error) {
+	s, ok := st.(*storeImpl)
+	if !ok {
+		return nil, errors.New("redicache: not a redicache store")
+	}
+	if s.expiryGrace <= 0 {
+		return nil, errors.New("redicache: store has no ExpiryGrace set")
+	}
+	co := o.Conn
+	if co == nil {
+		co = &ConnOptions{}
+	}
+	es := &ExpirySubscriber{
+		store:         s,
+		conn:          NewConnClient(co),
+		configure:     o.ConfigureNotifications,
+		retryInterval: o.RetryInterval,
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	if es.retryInterval <= 0 {
+		es.retryInterval = time.Second
+	}
+	es.channelPrefix = "__keyspace@" + strconv.Itoa(co.DB) + "__:" + s.keyPrefix + shadowInfix
+	es.pattern = globEscape(es.channelPrefix) + "*"
+
+	go es.run()
+	return es, nil
+}
+
+// globEscape escapes the special characters of Redis glob-style patterns.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Handle registers a handler to be called with expired sessions.
+// Handlers are called sequentially in the goroutine of the subscriber.
+func (es *ExpirySubscriber) Handle(h ExpiryHandler) {
+	es.mux.Lock()
+	defer es.mux.Unlock()
+
+	es.handlers = append(es.handlers, h)
+}
+
+// run subscribes to notifications and handles them, reconnecting if the connection breaks.
+// This method is to be started as a new goroutine.
+func (es *ExpirySubscriber) run() {
+	defer close(es.stopped)
+
+	for {
+		err := es.subscribe()
+		select {
+		case <-es.done:
+			// We are being shut down...
+			return
+		default:
+		}
+		log.Printf("Expiry subscription failed, reconnecting in %v: %v", es.retryInterval, err)
+
+		select {
+		case <-es.done:
+			return
+		case <-time.After(es.retryInterval):
+		}
+	}
+}
+
+// subscribe subscribes to notifications on a new connection, and handles them until the connection breaks.
+func (es *ExpirySubscriber) subscribe() error {
+	ctx := context.Background()
+	cn, err := es.conn.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer cn.nc.Close()
+
+	if es.configure {
+		if _, err := cn.do(ctx, es.conn.o.Timeout, "CONFIG", "SET", "notify-keyspace-events", "Kx"); err != nil {
+			return err
+		}
+	}
+	if _, err := cn.do(ctx, es.conn.o.Timeout, "PSUBSCRIBE", es.pattern); err != nil {
+		return err
+	}
+
+	es.mux.Lock()
+	es.active = cn
+	es.mux.Unlock()
+	select {
+	case <-es.done:
+		return nil // Closed before we registered cn
+	default:
+	}
+
+	cn.nc.SetDeadline(time.Time{}) // Notifications may take arbitrarily long to arrive
+	for {
+		v, err := readReply(cn.r)
+		if err != nil {
+			return err
+		}
+		// pmessage <pattern> <channel> <event>
+		msg, ok := v.([]interface{})
+		if !ok || len(msg) != 4 {
+			continue
+		}
+		kind, _ := replyBytes(msg[0])
+		channel, _ := replyBytes(msg[2])
+		event, _ := replyBytes(msg[3])
+		if string(kind) != "pmessage" || string(event) != "expired" || !strings.HasPrefix(string(channel), es.channelPrefix) {
+			continue
+		}
+		es.expired(string(channel[len(es.channelPrefix):]))
+	}
+}
+
+// expired handles the expiration of the session specified by its id.
+func (es *ExpirySubscriber) expired(id string) {
+	sess, err := es.store.claimExpired(context.Background(), id)
+	if err != nil {
+		log.Printf("Failed to load expired session from redis, id: %s, error: %v", id, err)
+		return
+	}
+	if sess == nil {
+		return // Not found or handled by another subscriber
+	}
+	es.store.metrics.Counter(session.MetricStoreEvictions, 1, session.Labels{"store": "redicache", "reason": session.EvictTimeout.String()})
+
+	es.mux.RLock()
+	handlers := es.handlers
+	es.mux.RUnlock()
+	for _, h := range handlers {
+		h(sess)
+	}
+}
+
+// Close stops the subscriber and waits for its goroutine to return.
+func (es *ExpirySubscriber) Close() {
+	es.mux.Lock()
+	select {
+	case <-es.done:
+		es.mux.Unlock()
+		return // Already closed
+	default:
+	}
+	close(es.done)
+	if es.active != nil {
+		es.active.nc.Close() // Unblocks reading
+	}
+	es.mux.Unlock()
+
+	<-es.stopped
+	es.conn.Close()
+}
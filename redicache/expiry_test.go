@@ -0,0 +1,149 @@
+package redicache
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+
+	"github.com/go-osin/session"
+)
+
+// waitSubs waits until the fake server has n pattern subscriptions.
+func (fr *fakeRedis) waitSubs(t *testing.T, n int) {
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		fr.mux.Lock()
+		m := len(fr.subs)
+		fr.mux.Unlock()
+		if m == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d subscriptions, got: %d", n, m)
+		}
+	}
+}
+
+func TestExpirySubscriber(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	for _, layout := range []Layout{LayoutBlob, LayoutHash} {
+		fr := newFakeRedis(t, nil)
+		st := NewStoreOptions(&StoreOptions{Client: fr.client(t), Namespace: "app", Layout: layout, ExpiryGrace: time.Minute, Clock: fr.clock})
+
+		es, err := NewExpirySubscriber(st, &SubscriberOptions{
+			Conn:                   &ConnOptions{Addr: fr.addr(), Timeout: time.Second},
+			ConfigureNotifications: true,
+		})
+		eq(nil, err)
+		expired := make(chan session.Session, 1)
+		es.Handle(func(sess session.Session) { expired <- sess })
+		fr.waitSubs(t, 1)
+
+		s := session.NewSessionOptions(&session.SessOptions{
+			Attrs:   map[string]interface{}{"a": 1},
+			Timeout: 50 * time.Millisecond,
+			Clock:   fr.clock,
+		})
+		st.Save(s)
+		neq(nil, st.Load(s.ID()))
+		fr.clock.Advance(60 * time.Millisecond)
+
+		select {
+		case sess := <-expired:
+			eq(s.ID(), sess.ID())
+			eq(1, sess.Get("a"))
+		case <-time.After(time.Second):
+			t.Fatal("Expiry not handled")
+		}
+
+		// Data is removed by the handling subscriber:
+		fr.mux.Lock()
+		eq(false, fr.live("app:"+s.ID()))
+		fr.mux.Unlock()
+		eq(nil, st.Load(s.ID()))
+
+		es.Close()
+		st.Close()
+	}
+}
+
+func TestExpirySubscriberOnce(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	fr := newFakeRedis(t, nil)
+	st := NewStoreOptions(&StoreOptions{Client: fr.client(t), ExpiryGrace: time.Minute, Clock: fr.clock})
+	defer st.Close()
+
+	var count int32
+	handled := make(chan struct{}, 10)
+	var ess []*ExpirySubscriber
+	for i := 0; i < 3; i++ {
+		es, err := NewExpirySubscriber(st, &SubscriberOptions{Conn: &ConnOptions{Addr: fr.addr(), Timeout: time.Second}})
+		eq(nil, err)
+		es.Handle(func(sess session.Session) {
+			atomic.AddInt32(&count, 1)
+			handled <- struct{}{}
+		})
+		ess = append(ess, es)
+	}
+	fr.waitSubs(t, 3)
+
+	for i := 0; i < 5; i++ {
+		st.Save(session.NewSessionOptions(&session.SessOptions{Timeout: 20 * time.Millisecond, Clock: fr.clock}))
+	}
+	fr.clock.Advance(30 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("Expiry not handled")
+		}
+	}
+
+	// Handlers run in the subscriber goroutines, closing waits for the ones in progress:
+	for _, es := range ess {
+		es.Close()
+	}
+	eq(int32(5), atomic.LoadInt32(&count))
+}
+
+func TestExpiryGrace(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	fr := newFakeRedis(t, nil)
+	st := NewStoreOptions(&StoreOptions{Client: fr.client(t), KeyPrefix: "sess:", ExpiryGrace: time.Minute, Clock: fr.clock})
+	defer st.Close()
+
+	s := session.NewSessionOptions(&session.SessOptions{Timeout: 20 * time.Millisecond, Clock: fr.clock})
+	st.Save(s)
+	neq(nil, st.Load(s.ID()))
+
+	// Data is kept after expiration, but the session is not loaded:
+	fr.clock.Advance(30 * time.Millisecond)
+	fr.mux.Lock()
+	eq(true, fr.live("sess:"+s.ID()))
+	fr.mux.Unlock()
+	eq(nil, st.Load(s.ID()))
+
+	// Remove removes the shadow key too:
+	st.Save(s)
+	st.Remove(s)
+	fr.mux.Lock()
+	eq(false, fr.live("sess:shadow:"+s.ID()))
+	fr.mux.Unlock()
+}
+
+func TestNewExpirySubscriberErrors(t *testing.T) {
+	neq := mighty.Neq(t)
+
+	inmem := session.NewInMemStore()
+	defer inmem.Close()
+	_, err := NewExpirySubscriber(inmem, &SubscriberOptions{})
+	neq(nil, err)
+
+	fr := newFakeRedis(t, nil)
+	_, err = NewExpirySubscriber(NewStoreOptions(&StoreOptions{Client: fr.client(t)}), &SubscriberOptions{})
+	neq(nil, err)
+}
@@ -0,0 +1,360 @@
+package redicache
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-osin/session"
+)
+
+// Layout tells how sessions are stored in Redis.
+type Layout int
+
+// Session layouts.
+const (
+	// LayoutBlob stores a session as a single string value, marshalled with the codec of the store.
+	LayoutBlob Layout = iota
+
+	// LayoutHash stores a session as a Redis hash, with metadata fields and one field per attribute.
+	//
+	// Metadata fields are "meta:created" (Unix nanoseconds), "meta:timeout" (milliseconds)
+	// and "meta:cattrs" (constant attributes marshalled with the codec of the store).
+	// Attribute fields are "attr:" followed by the attribute name, each value marshalled individually
+	// with the codec of the store (wrapped in a struct with a single V field).
+	// With codec.JSON, other services can read an attribute with a single HGET without knowing the Go types.
+	// Note that attribute fields are marshalled (and encrypted, see codec.Encrypt) without the session ID,
+	// so an attribute field moved from one session to another is not detected.
+	//
+	// Saving a session loaded from a store with this layout only writes the attributes changed by Session.Set()
+	// and extends its expiration, without rewriting the entire session.
+	// Session.TrySet() of such a session writes the attribute through to Redis immediately
+	// (with the context the session was loaded with), and returns the error if it fails.
+	// Attributes of a session can also be accessed without loading it, see AttrStore.
+	//
+	// Sessions are written with Lua scripts (EVALSHA), so a session is replaced atomically;
+	// the server must allow scripting.
+	LayoutHash
+)
+
+// Fields of sessions stored with the hash layout.
+const (
+	fieldCreated    = "meta:created"
+	fieldTimeout    = "meta:timeout"
+	fieldCAttrs     = "meta:cattrs"
+	fieldAttrPrefix = "attr:"
+)
+
+// Lua scripts modifying sessions stored with the hash layout atomically, so concurrent loads never see a partial session.
+var (
+	// scriptReplace replaces the hash of a session: KEYS[1] is the key, ARGV[1] is the expiration in milliseconds,
+	// the rest are field-value pairs.
+	scriptReplace = newScript(`redis.call('DEL', KEYS[1])
+redis.call('HSET', KEYS[1], unpack(ARGV, 2))
+return redis.call('PEXPIRE', KEYS[1], ARGV[1])`)
+
+	// scriptSetAttr sets a field of an existing hash: KEYS[1] is the key, ARGV[1] and ARGV[2] are the field and the value.
+	// Returns 0 if the hash does not exist.
+	scriptSetAttr = newScript(`if redis.call('EXISTS', KEYS[1]) == 0 then return 0 end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1`)
+
+	// scriptUpdate updates fields of an existing hash and extends its expiration: KEYS[1] is the key,
+	// ARGV[1] is the expiration in milliseconds, ARGV[2] is the number of fields to delete, followed by
+	// the fields to delete, the rest are field-value pairs to set.
+	// Returns 0 if the hash does not exist.
+	scriptUpdate = newScript(`if redis.call('EXISTS', KEYS[1]) == 0 then return 0 end
+local n = tonumber(ARGV[2])
+if n > 0 then redis.call('HDEL', KEYS[1], unpack(ARGV, 3, 2 + n)) end
+if #ARGV > 2 + n then redis.call('HSET', KEYS[1], unpack(ARGV, 3 + n)) end
+return redis.call('PEXPIRE', KEYS[1], ARGV[1])`)
+)
+
+// script is a Lua script executed atomically by Redis.
+type script struct {
+	src string // Source of the script
+	sha string // SHA1 digest of src (hex), used with EVALSHA
+}
+
+// newScript returns a new script of the specified source.
+func newScript(src string) *script {
+	sum := sha1.Sum([]byte(src))
+	return &script{src: src, sha: hex.EncodeToString(sum[:])}
+}
+
+// eval executes a script on a single key with EVALSHA, falling back to EVAL if the script is not cached by the server.
+func (s *storeImpl) eval(ctx context.Context, op string, span session.Span, sc *script, key string, args ...interface{}) (interface{}, error) {
+	v, err := s.do(ctx, op, span, append([]interface{}{"EVALSHA", sc.sha, 1, key}, args...)...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		v, err = s.do(ctx, op, span, append([]interface{}{"EVAL", sc.src, 1, key}, args...)...)
+	}
+	return v, err
+}
+
+// AttrStore is implemented by stores with the hash layout (LayoutHash);
+// it allows accessing attributes of a session without loading the entire session.
+type AttrStore interface {
+	session.Store
+
+	// GetAttr returns the value of an attribute of the session specified by its id.
+	// nil is returned if the session or the attribute does not exist.
+	GetAttr(ctx context.Context, id, name string) (interface{}, error)
+
+	// SetAttr sets the value of an attribute of the session specified by its id.
+	// Pass the nil value to delete the attribute.
+	// ErrNoSession is returned if the session does not exist.
+	SetAttr(ctx context.Context, id, name string, value interface{}) error
+}
+
+// ErrNoSession is returned by AttrStore.SetAttr() if the session does not exist.
+var ErrNoSession = errors.New("redicache: session does not exist")
+
+// errNotHashLayout is returned by the AttrStore methods of a store not using the hash layout.
+var errNotHashLayout = errors.New("redicache: store does not use the hash layout")
+
+// attrValue wraps attribute values so they can be marshalled individually by any codec
+// (e.g. gob can only transmit interface values as fields).
+type attrValue struct {
+	V interface{} `json:"v"`
+}
+
+// hashSession is a session loaded from a store with the hash layout.
+// Attributes changed by Set() are written when the session is saved, TrySet() is written through to Redis.
+type hashSession struct {
+	session.Session
+	store *storeImpl
+	ctx   context.Context // Context the session was loaded with (e.g. of the request), used by TrySet()
+
+	mux   sync.Mutex      // mutex to synchronize access to dirty
+	dirty map[string]bool // Names of attributes changed by Set() and not yet written to Redis
+}
+
+// Set sets the value of an attribute in the session; it is written to Redis when the session is saved.
+func (h *hashSession) Set(name string, value interface{}) {
+	h.Session.Set(name, value)
+	h.mux.Lock()
+	h.dirty[name] = true
+	h.mux.Unlock()
+}
+
+// TrySet sets the value of an attribute in the session if it can be marshalled, and also in Redis.
+func (h *hashSession) TrySet(name string, value interface{}) error {
+	if err := h.Session.TrySet(name, value); err != nil {
+		return err
+	}
+	if err := h.store.SetAttr(h.ctx, h.ID(), name, value); err != nil {
+		h.mux.Lock()
+		h.dirty[name] = true // Retried by the next save
+		h.mux.Unlock()
+		return err
+	}
+	h.mux.Lock()
+	delete(h.dirty, name)
+	h.mux.Unlock()
+	return nil
+}
+
+// takeDirty returns the names of the changed attributes, and resets them.
+func (h *hashSession) takeDirty() map[string]bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	dirty := h.dirty
+	h.dirty = map[string]bool{}
+	return dirty
+}
+
+// restoreDirty marks the attributes as changed again (after failing to write them).
+func (h *hashSession) restoreDirty(dirty map[string]bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for name := range dirty {
+		h.dirty[name] = true
+	}
+}
+
+// loadHash loads a session stored with the hash layout.
+// nil session is returned if the session is not found.
+func (s *storeImpl) loadHash(ctx context.Context, span session.Span, key string) (session.Session, error) {
+	v, err := s.do(ctx, "load", span, "HGETALL", key)
+	if err != nil {
+		return nil, err
+	}
+	a, ok := v.([]interface{})
+	if !ok || len(a)%2 != 0 {
+		return nil, errUnexpectedReply
+	}
+	if len(a) == 0 {
+		return nil, nil
+	}
+
+	o := &session.SessOptions{
+		IDF:   key[len(s.keyPrefix):],
+		Attrs: make(map[string]interface{}, len(a)/2),
+		Codec: &s.codec,
+		Clock: s.clock,
+		State: session.StateLoaded,
+	}
+	for i := 0; i < len(a); i += 2 {
+		field, err := replyBytes(a[i])
+		if err != nil {
+			return nil, err
+		}
+		value, err := replyBytes(a[i+1])
+		if err != nil {
+			return nil, err
+		}
+		switch name := string(field); {
+		case name == fieldCreated:
+			ns, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			o.CreatedF = time.Unix(0, ns)
+		case name == fieldTimeout:
+			ms, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			o.Timeout = time.Duration(ms) * time.Millisecond
+		case name == fieldCAttrs:
+			if err := s.codec.Unmarshal(value, &o.CAttrs); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(name, fieldAttrPrefix):
+			var av attrValue
+			if err := s.codec.Unmarshal(value, &av); err != nil {
+				return nil, err
+			}
+			o.Attrs[name[len(fieldAttrPrefix):]] = av.V
+		}
+	}
+	if o.CreatedF.IsZero() {
+		// Only attributes without metadata (not written by this store), treat it as not existing.
+		return nil, nil
+	}
+
+	ss := session.NewSessionOptions(o)
+	ss.Access()
+	return &hashSession{Session: ss, store: s, ctx: ctx, dirty: map[string]bool{}}, nil
+}
+
+// saveHash saves a session with the hash layout.
+func (s *storeImpl) saveHash(ctx context.Context, span session.Span, sess session.Session) error {
+	key := s.keyPrefix + sess.ID()
+	if h, ok := sess.(*hashSession); ok && h.store == s {
+		// Only write the changed attributes and extend the expiration.
+		// If the session expired meanwhile, write it fully.
+		dirty := h.takeDirty()
+		v, err := s.updateHash(ctx, span, key, sess, dirty)
+		if err != nil {
+			h.restoreDirty(dirty)
+		}
+		if n, _ := v.(int64); err != nil || n == 1 {
+			return err
+		}
+	}
+
+	args := []interface{}{s.dataTTL(sess.Timeout()),
+		fieldCreated, sess.Created().UnixNano(),
+		fieldTimeout, millis(sess.Timeout()),
+	}
+	if cattrs := sess.ConstValues(); len(cattrs) > 0 {
+		data, err := s.codec.Marshal(cattrs)
+		if err != nil {
+			return err
+		}
+		args = append(args, fieldCAttrs, data)
+	}
+	for name, value := range sess.Values() {
+		data, err := s.codec.Marshal(&attrValue{V: value})
+		if err != nil {
+			return err
+		}
+		args = append(args, fieldAttrPrefix+name, data)
+	}
+
+	// Replace the hash (removing fields of attributes deleted since the last save) in one step:
+	_, err := s.eval(ctx, "save", span, scriptReplace, key, args...)
+	return err
+}
+
+// updateHash writes the changed attributes of a session stored with the hash layout, and extends its expiration.
+// The reply of the script is returned, 0 if the session does not exist.
+func (s *storeImpl) updateHash(ctx context.Context, span session.Span, key string, sess session.Session, dirty map[string]bool) (interface{}, error) {
+	if len(dirty) == 0 {
+		return s.do(ctx, "save", span, "PEXPIRE", key, s.dataTTL(sess.Timeout()))
+	}
+	values := sess.Values()
+	var dels, sets []interface{}
+	for name := range dirty {
+		value, ok := values[name]
+		if !ok {
+			dels = append(dels, fieldAttrPrefix+name)
+			continue
+		}
+		data, err := s.codec.Marshal(&attrValue{V: value})
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, fieldAttrPrefix+name, data)
+	}
+	args := append([]interface{}{s.dataTTL(sess.Timeout()), len(dels)}, dels...)
+	return s.eval(ctx, "save", span, scriptUpdate, key, append(args, sets...)...)
+}
+
+// GetAttr is to implement AttrStore.GetAttr().
+func (s *storeImpl) GetAttr(ctx context.Context, id, name string) (interface{}, error) {
+	if s.layout != LayoutHash {
+		return nil, errNotHashLayout
+	}
+	span := s.startSpan(ctx, "GetAttr", id)
+	defer span.End()
+
+	v, err := s.do(ctx, "get_attr", span, "HGET", s.keyPrefix+id, fieldAttrPrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := replyBytes(v)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var av attrValue
+	if err := s.codec.Unmarshal(data, &av); err != nil {
+		return nil, err
+	}
+	return av.V, nil
+}
+
+// SetAttr is to implement AttrStore.SetAttr().
+func (s *storeImpl) SetAttr(ctx context.Context, id, name string, value interface{}) error {
+	if s.layout != LayoutHash {
+		return errNotHashLayout
+	}
+	span := s.startSpan(ctx, "SetAttr", id)
+	defer span.End()
+
+	key := s.keyPrefix + id
+	if value == nil {
+		_, err := s.do(ctx, "set_attr", span, "HDEL", key, fieldAttrPrefix+name)
+		return err
+	}
+
+	data, err := s.codec.Marshal(&attrValue{V: value})
+	if err != nil {
+		return err
+	}
+	// Only set it if the session exists, else HSET would create a hash without expiration:
+	v, err := s.eval(ctx, "set_attr", span, scriptSetAttr, key, fieldAttrPrefix+name, data)
+	if err != nil {
+		return err
+	}
+	if n, _ := v.(int64); n == 0 {
+		return ErrNoSession
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package redicache
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+
+	"github.com/go-osin/session"
+	"github.com/go-osin/session/codec"
+)
+
+func TestHashLayout(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	fr := newFakeRedis(t, nil)
+	st := NewStoreOptions(&StoreOptions{Client: fr.client(t), Layout: LayoutHash, KeyPrefix: "sess:"})
+	defer st.Close()
+
+	eq(nil, st.Load("asdf"))
+
+	s := session.NewSessionOptions(&session.SessOptions{
+		CAttrs:  map[string]interface{}{"user": "bob"},
+		Attrs:   map[string]interface{}{"a": 1, "b": "x"},
+		Timeout: time.Hour,
+	})
+	st.Save(s)
+
+	fr.mux.Lock()
+	eq(5, len(fr.hashes["sess:"+s.ID()]))
+	fr.mux.Unlock()
+
+	s2 := st.Load(s.ID())
+	neq(nil, s2)
+	eq(s.ID(), s2.ID())
+	eq("bob", s2.Getp("user"))
+	eq(1, s2.Get("a"))
+	eq("x", s2.Get("b"))
+	eq(time.Hour, s2.Timeout())
+	eq(s.Created().UnixNano(), s2.Created().UnixNano())
+
+	// Only changed attributes are written by Save, without rewriting the session:
+	fr.commands()
+	s2.Set("a", 2)
+	s2.Set("b", nil)
+	eq(0, len(fr.commands()))
+	st.Save(s2)
+	eq("EVALSHA EVAL", strings.Join(fr.commands(), " ")) // Script not cached yet on first use
+	s3 := st.Load(s.ID())
+	eq(2, s3.Get("a"))
+	eq(nil, s3.Get("b"))
+	eq("bob", s3.Getp("user"))
+
+	// TrySet is written through:
+	fr.commands()
+	eq(nil, s2.TrySet("a", 3))
+	eq("EVALSHA EVAL", strings.Join(fr.commands(), " "))
+	eq(3, st.Load(s.ID()).Get("a"))
+	fr.commands()
+	st.Save(s2)
+	eq("PEXPIRE", strings.Join(fr.commands(), " ")) // Nothing else to write
+
+	st.Remove(s)
+	eq(nil, st.Load(s.ID()))
+}
+
+func TestHashLayoutAttrStore(t *testing.T) {
+	eq := mighty.Eq(t)
+	ctx := context.Background()
+
+	fr := newFakeRedis(t, nil)
+	st := NewStoreOptions(&StoreOptions{Client: fr.client(t), Layout: LayoutHash, Codec: &codec.JSON}).(AttrStore)
+	defer st.Close()
+
+	eq(ErrNoSession, st.SetAttr(ctx, "asdf", "a", 1))
+	v, err := st.GetAttr(ctx, "asdf", "a")
+	eq(nil, err)
+	eq(nil, v)
+	fr.mux.Lock()
+	eq(false, fr.live("asdf"))
+	fr.mux.Unlock()
+
+	s := session.NewSession()
+	st.Save(s)
+	eq(nil, st.SetAttr(ctx, s.ID(), "name", "alice"))
+	v, err = st.GetAttr(ctx, s.ID(), "name")
+	eq(nil, err)
+	eq("alice", v)
+	eq("alice", st.Load(s.ID()).Get("name"))
+
+	// Other services can read attributes without Go types:
+	fr.mux.Lock()
+	raw := fr.hashes[s.ID()]["attr:name"]
+	fr.mux.Unlock()
+	var av struct{ V string }
+	eq(nil, json.Unmarshal(raw, &av))
+	eq("alice", av.V)
+
+	// Not available with the blob layout:
+	blob := NewStoreOptions(&StoreOptions{Client: fr.client(t)}).(AttrStore)
+	eq(errNotHashLayout, blob.SetAttr(ctx, s.ID(), "name", "bob"))
+}
+
+func TestHashLayoutExpired(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	fr := newFakeRedis(t, nil)
+	st := NewStoreOptions(&StoreOptions{Client: fr.client(t), Layout: LayoutHash, Clock: fr.clock})
+	defer st.Close()
+
+	s := session.NewSessionOptions(&session.SessOptions{Timeout: 20 * time.Millisecond, Clock: fr.clock})
+	st.Save(s)
+	s2 := st.Load(s.ID())
+	s2.Set("a", 1)
+	fr.clock.Advance(30 * time.Millisecond)
+	eq(nil, st.Load(s.ID()))
+
+	// Saving a loaded session which expired meanwhile writes it fully:
+	st.Save(s2)
+	eq(1, st.Load(s.ID()).Get("a"))
+}
+
+func TestHashLayoutConcurrentSave(t *testing.T) {
+	fr := newFakeRedis(t, nil)
+	st := NewStoreOptions(&StoreOptions{Client: fr.client(t), Layout: LayoutHash})
+	defer st.Close()
+
+	s := session.NewSessionOptions(&session.SessOptions{Attrs: map[string]interface{}{"a": 1}})
+	st.Save(s)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			st.Save(s) // Replaces the hash
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if st.Load(s.ID()) == nil {
+			t.Fatal("Session not found while being saved")
+		}
+	}
+}
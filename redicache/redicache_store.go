@@ -1,187 +1,382 @@
+/*
+
+Package redicache provides a session store implementation backed by Redis.
+
+The store talks to Redis through the small Client interface using native commands,
+so single node, Sentinel, Cluster and Ring clients of any Redis library can be used
+(see ClientFunc). If no client is specified, the built-in ConnClient is used
+which connects to a single Redis node, optionally over TLS.
+
+Sessions are stored with an expiration equal to their timeout, which is extended on each access.
+By default a session is stored as a single value, marshalled with the codec of the store (see LayoutBlob).
+Alternatively a session may be stored as a Redis hash, with an individually marshalled field per attribute
+(see LayoutHash).
+
+Sessions are loaded with GETEX (which also extends their expiration), so Redis 6.2 or newer is required.
+
+*/
+
 package redicache
 
 import (
-	"fmt"
+	"context"
 	"log"
-	"sync"
 	"time"
 
-	"github.com/go-redis/cache"
-	"github.com/go-redis/redis"
-
 	"github.com/go-osin/session"
 	"github.com/go-osin/session/codec"
 )
 
 type storeImpl struct {
-	keyPrefix string // Prefix to use in front of session ids to construct Redis key
-	retries   int    // Number of retries to perform in case of general Redis failures
-
-	codec *cache.Codec // Codec used to marshal and unmarshal a Session to a byte slice
+	client    Client                     // Client to talk to Redis with
+	ownClient interface{ Close() error } // Client created by the store (closed when the store is closed), nil if Client was specified
+	keyPrefix string                     // Prefix to use in front of session ids to construct Redis keys (namespace included)
+	retries   int                        // Number of retries to perform in case of general Redis failures
+	codec     codec.Codec                // Codec used to marshal and unmarshal a Session to a byte slice
+	layout    Layout                     // Layout of sessions in Redis
+	timeout   time.Duration              // Expected timeout of loaded sessions (see loadBlob)
 
-	sessions map[string]session.Session
+	expiryGrace time.Duration // Grace period to keep session data after expiration, 0 if shadow keys are disabled
 
-	mux *sync.RWMutex // mutex to synchronize access to sessions
+	metrics session.Metrics // Metrics to report to
+	tracer  session.Tracer  // Tracer to create spans with
+	clock   session.Clock   // Clock of loaded sessions, may be nil
 }
 
-// StoreOptions ...
+// StoreOptions defines options that may be passed when creating a new Redis session Store.
+// All fields are optional; default value will be used for any field that has the zero value.
 type StoreOptions struct {
-	Addrs     []string
-	DB        int
-	Password  string
+	// Client to talk to Redis with; default value is a ConnClient created with the Conn options.
+	Client Client
+
+	// Options of the built-in client, only used if Client is nil;
+	// default value connects to localhost:6379.
+	Conn *ConnOptions
+
+	// Namespace of the keys of the store, to isolate applications sharing a Redis database;
+	// default value is the empty string (no namespace).
+	// Keys will be Namespace + ":" + KeyPrefix + session id.
+	Namespace string
+
+	// Prefix to use in front of session ids to construct Redis keys; default value is the empty string.
 	KeyPrefix string
-	Retries   int
-	Codec     *codec.Codec
+
+	// Layout of sessions in Redis; default value is LayoutBlob.
+	Layout Layout
+
+	// Grace period to keep the data of expired sessions, so expiry handlers can access it (see ExpirySubscriber);
+	// default value is 0 which means expired sessions are removed by Redis immediately, and no expiry events are emitted.
+	// If set, a shadow key is maintained for each session which expires at the expiration of the session,
+	// while the session data expires this much later.
+	ExpiryGrace time.Duration
+
+	// Timeout of the sessions of the application, the expiration set on loaded sessions in the same command
+	// as they are read (GETEX); default value is 30 minutes, the default timeout of sessions.
+	// Loaded sessions with a different timeout get their expiration corrected with an extra command.
+	Timeout time.Duration
+
+	// Number of retries to perform if Redis commands fail due to network errors; default value is 3.
+	Retries int
+
+	// Codec used to marshal and unmarshal a Session to a byte slice;
+	// default value is codec.Gob (attribute types must be registered with gob.Register()).
+	Codec *codec.Codec
+
+	// Metrics to report store operations and retries to; default value is session.NopMetrics.
+	Metrics session.Metrics
+
+	// Tracer to create spans around store operations with; default value is session.NopTracer.
+	Tracer session.Tracer
+
+	// Clock to get the access times of loaded sessions from; default value is session.SystemClock.
+	// Sessions are expired by Redis.
+	Clock session.Clock
+
+	// Addresses (host:port) of Redis nodes to distribute sessions among, only used if Client and Conn are nil.
+	// Sessions are assigned to the nodes the same way as by the go-redis Ring which served this option
+	// in earlier versions, so sessions saved by them are found after upgrading (as long as the order
+	// of the addresses is kept). Unlike the go-redis Ring, nodes which are down are not taken out of the ring.
+	//
+	// Deprecated: Use Conn for a single node, or Client (e.g. a go-redis Ring or Cluster client) for multiple nodes.
+	Addrs []string
+
+	// Database to select, only used if Client and Conn are nil.
+	//
+	// Deprecated: Use Conn.DB.
+	DB int
+
+	// Password to authenticate with, only used if Client and Conn are nil.
+	//
+	// Deprecated: Use Conn.Password.
+	Password string
 }
 
 var zeroStoreOptions = new(StoreOptions)
 
-// NewStore ...
+// NewStore returns a new, Redis session Store with default options,
+// connecting to localhost:6379.
 func NewStore() session.Store {
 	return NewStoreOptions(zeroStoreOptions)
 }
 
-// NewStoreOptions ...
+// NewStoreOptions returns a new, Redis session Store with the specified options.
 func NewStoreOptions(o *StoreOptions) session.Store {
-	if len(o.Addrs) == 0 {
-		o.Addrs = []string{":6379"}
-	} else {
-		log.Printf("redis addrs %v", o.Addrs)
-	}
-	var addrs = map[string]string{}
-	for i, svr := range o.Addrs {
-		k := fmt.Sprintf("server%d", i)
-		addrs[k] = svr
-	}
-	ring := redis.NewRing(&redis.RingOptions{
-		Addrs:    addrs,
-		DB:       o.DB,
-		Password: o.Password,
-	})
-	var cd codec.Codec
-	if o.Codec == nil {
-		cd = codec.Gob
-	} else {
-		cd = *o.Codec
-	}
-	codec := &cache.Codec{
-		Redis:     ring,
-		Marshal:   cd.Marshal,
-		Unmarshal: cd.Unmarshal,
-	}
 	s := &storeImpl{
+		client:    o.Client,
 		keyPrefix: o.KeyPrefix,
 		retries:   o.Retries,
-		sessions:  make(map[string]session.Session, 2),
-		mux:       &sync.RWMutex{},
+		layout:    o.Layout,
+		timeout:   o.Timeout,
+
+		expiryGrace: o.ExpiryGrace,
+		metrics:     o.Metrics,
+		tracer:      o.Tracer,
+		clock:       o.Clock,
+	}
+	if s.client == nil {
+		co := o.Conn
+		if co == nil {
+			co = &ConnOptions{DB: o.DB, Password: o.Password}
+			if len(o.Addrs) == 1 {
+				co.Addr = o.Addrs[0]
+			}
+		}
+		if o.Conn == nil && len(o.Addrs) > 1 {
+			ring := newRingClient(o.Addrs, co)
+			s.client, s.ownClient = ring, ring
+		} else {
+			cc := NewConnClient(co)
+			s.client, s.ownClient = cc, cc
+		}
+	}
+	if o.Namespace != "" {
+		s.keyPrefix = o.Namespace + ":" + s.keyPrefix
 	}
 	if s.retries <= 0 {
 		s.retries = 3
 	}
-	s.codec = codec
-
+	if s.timeout <= 0 {
+		s.timeout = 30 * time.Minute
+	}
+	if o.Codec != nil {
+		s.codec = *o.Codec
+	} else {
+		s.codec = codec.Gob
+	}
+	if s.metrics == nil {
+		s.metrics = session.NopMetrics
+	}
+	if s.tracer == nil {
+		s.tracer = session.NopTracer
+	}
 	return s
 }
 
-type sessionImpl struct {
-	IDF      string                 `json:"id"`      // ID of the session
-	CreatedF time.Time              `json:"created"` // Creation time
-	CAttrsF  map[string]interface{} `json:"cattrs"`  // Constant attributes specified at session creation
-	AttrsF   map[string]interface{} `json:"attrs"`   // Attributes stored in the session
+// startSpan starts a span of a store operation on the session specified by its id.
+func (s *storeImpl) startSpan(ctx context.Context, op, id string) session.Span {
+	_, span := s.tracer.Start(ctx, "session.Store."+op)
+	span.SetAttr(session.AttrStore, "redicache")
+	span.SetAttr(session.AttrSessionIDHash, session.SessionIDHash(id))
+	return span
+}
+
+// do executes a command, retrying it in case of network errors.
+// Retries are reported to the metrics and recorded in span.
+func (s *storeImpl) do(ctx context.Context, op string, span session.Span, args ...interface{}) (v interface{}, err error) {
+	for i := 0; i < s.retries; i++ {
+		if i > 0 {
+			s.retry(op)
+			span.SetAttr(session.AttrRetry, i)
+		}
+		v, err = s.client.Do(ctx, args...)
+		if _, ok := err.(Error); err == nil || ok || ctx.Err() != nil {
+			// Success, error reply of the server (retrying wouldn't help), or context done.
+			return
+		}
+		// Network error? Retry..
+	}
+	return
+}
+
+// millis returns the duration in milliseconds, at least 1.
+func millis(d time.Duration) int64 {
+	if ms := int64(d / time.Millisecond); ms > 0 {
+		return ms
+	}
+	return 1
 }
 
 // Load is to implement Store.Load().
 func (s *storeImpl) Load(id string) session.Session {
-	s.mux.RLock()
-	defer s.mux.RUnlock()
+	return s.LoadContext(context.Background(), id)
+}
 
-	// Next check in Memcache
-	var err error
-	var sess *sessionImpl
+// LoadContext is to implement session.ContextStore.LoadContext().
+// A new Session value is returned on each call, read from Redis.
+func (s *storeImpl) LoadContext(ctx context.Context, id string) session.Session {
+	start := time.Now()
+	span := s.startSpan(ctx, "Load", id)
+	defer span.End()
 
 	key := s.keyPrefix + id
-	for i := 0; i < s.retries; i++ {
-		var _sess sessionImpl
-		err = s.codec.Get(key, &_sess)
-		if err == cache.ErrCacheMiss {
-			break // It's not in the cache
+	var ss session.Session
+	var err error
+	if s.expiryGrace > 0 {
+		// Session data is kept for a grace period after expiration, it's live only if its shadow key exists:
+		var live bool
+		if live, err = s.shadowExists(ctx, span, id); err == nil && !live {
+			span.SetAttr(session.AttrHit, false)
+			s.observe("load", "miss", start)
+			return nil
 		}
-		if err == nil {
-			sess = &_sess
-			break
+	}
+	expected := s.dataTTL(s.timeout)
+	if err == nil {
+		if s.layout == LayoutHash {
+			ss, err = s.loadHash(ctx, span, key)
+		} else {
+			ss, err = s.loadBlob(ctx, span, key, expected)
 		}
-		// Service error? Retry..
 	}
-
-	if sess == nil {
-		log.Printf("Failed to load session from redicache, id: %s, error: %v", id, err)
+	if err != nil {
+		log.Printf("Failed to load session from redis, id: %s, error: %v", id, err)
+		span.SetAttr(session.AttrHit, false)
+		s.observe("load", "error", start)
+		return nil
+	}
+	if ss == nil {
+		// It's not in Redis (e.g. invalid sess id or expired)
+		span.SetAttr(session.AttrHit, false)
+		s.observe("load", "miss", start)
 		return nil
 	}
 
-	ss := session.NewSessionOptions(&session.SessOptions{
-		IDF:      sess.IDF,
-		CreatedF: sess.CreatedF,
-		CAttrs:   sess.CAttrsF,
-		Attrs:    sess.AttrsF,
-	})
-	ss.Access()
-	s.sessions[id] = ss
-	log.Printf("session load from redic, id: %s, vals %v", sess.IDF, sess.AttrsF)
+	// Extend the expiration due to the access (unless GETEX did it with the right expiration):
+	if ttl := s.dataTTL(ss.Timeout()); s.layout == LayoutHash || ttl != expected {
+		_, err = s.do(ctx, "load", span, "PEXPIRE", key, ttl)
+	}
+	if err == nil {
+		err = s.setShadow(ctx, span, "load", id, ss.Timeout())
+	}
+	if err != nil {
+		log.Printf("Failed to extend session expiration in redis, id: %s, error: %v", id, err)
+	}
+
+	span.SetAttr(session.AttrHit, true)
+	s.observe("load", "hit", start)
 	return ss
 }
 
-// Save is to implement Store.Save().
-func (s *storeImpl) Save(sess session.Session) {
-	s.mux.Lock()
-	defer s.mux.Unlock()
+// loadBlob loads a session stored as a single value with the blob layout.
+// If ttl is positive, the expiration of the session is set to ttl milliseconds in the same command (GETEX);
+// as the timeout of the session is only known after reading it, callers pass the expiration of the expected
+// timeout (see StoreOptions.Timeout), and correct it if it turns out to be different.
+// nil session is returned if the session is not found.
+func (s *storeImpl) loadBlob(ctx context.Context, span session.Span, key string, ttl int64) (session.Session, error) {
+	args := []interface{}{"GET", key}
+	if ttl > 0 {
+		args = []interface{}{"GETEX", key, "PX", ttl}
+	}
+	v, err := s.do(ctx, "load", span, args...)
+	if err != nil {
+		return nil, err
+	}
+	data, err := replyBytes(v)
+	if err != nil || data == nil {
+		return nil, err
+	}
 
-	if s.storeSession(sess) {
-		log.Printf("Session save to redic: %s", sess.ID())
-		s.sessions[sess.ID()] = sess
-		return
+	o, err := session.UnmarshalSession(s.codec, data, key[len(s.keyPrefix):])
+	if err != nil {
+		return nil, err
 	}
+	o.Clock, o.State = s.clock, session.StateLoaded
+	ss := session.NewSessionOptions(o)
+	ss.Access()
+	return ss, nil
 }
 
-// storeSession sets the specified session in the Memcache.
-func (s *storeImpl) storeSession(sess session.Session) (success bool) {
-	item := &cache.Item{
-		Key:        s.keyPrefix + sess.ID(),
-		Object:     sess,
-		Expiration: sess.Timeout(),
-	}
+// Save is to implement Store.Save().
+func (s *storeImpl) Save(sess session.Session) {
+	s.SaveContext(context.Background(), sess)
+}
+
+// SaveContext is to implement session.ContextStore.SaveContext().
+func (s *storeImpl) SaveContext(ctx context.Context, sess session.Session) {
+	start := time.Now()
+	span := s.startSpan(ctx, "Save", sess.ID())
+	defer span.End()
 
 	var err error
-	for i := 0; i < s.retries; i++ {
-		if err = s.codec.Set(item); err == nil {
-			return true
-		}
+	if s.layout == LayoutHash {
+		err = s.saveHash(ctx, span, sess)
+	} else {
+		err = s.saveBlob(ctx, span, sess)
 	}
+	if err == nil {
+		err = s.setShadow(ctx, span, "save", sess.ID(), sess.Timeout())
+	}
+	if err != nil {
+		log.Printf("Failed to save session to redis, id: %s, error: %v", sess.ID(), err)
+		s.observe("save", "error", start)
+		return
+	}
+	s.observe("save", "ok", start)
+}
 
-	log.Printf("Failed to store session to cache, id: %s, error: %v", sess.ID(), err)
-	return false
+// saveBlob saves a session as a single value with the blob layout.
+func (s *storeImpl) saveBlob(ctx context.Context, span session.Span, sess session.Session) error {
+	// Marshal the session value itself (its exported fields), holding its read lock:
+	mux := sess.Mutex()
+	mux.RLock()
+	data, err := s.codec.Marshal(sess)
+	mux.RUnlock()
+	if err != nil {
+		return err
+	}
+	_, err = s.do(ctx, "save", span, "SET", s.keyPrefix+sess.ID(), data, "PX", s.dataTTL(sess.Timeout()))
+	return err
 }
 
 // Remove is to implement Store.Remove().
 func (s *storeImpl) Remove(sess session.Session) {
-	s.mux.Lock()
-	defer s.mux.Unlock()
+	s.RemoveContext(context.Background(), sess)
+}
 
-	var err error
-	for i := 0; i < s.retries; i++ {
-		if err = s.codec.Delete(s.keyPrefix + sess.ID()); err == nil {
-			log.Printf("Session redic removed: %s", sess.ID())
-			delete(s.sessions, sess.ID())
-			return
-		}
+// RemoveContext is to implement session.ContextStore.RemoveContext().
+func (s *storeImpl) RemoveContext(ctx context.Context, sess session.Session) {
+	start := time.Now()
+	span := s.startSpan(ctx, "Remove", sess.ID())
+	defer span.End()
+
+	_, err := s.do(ctx, "remove", span, "DEL", s.keyPrefix+sess.ID())
+	if err == nil && s.expiryGrace > 0 {
+		// Separate command so keys may be in different cluster slots:
+		_, err = s.do(ctx, "remove", span, "DEL", s.shadowKey(sess.ID()))
 	}
-	log.Printf("Failed to remove session from s.Codec, id: %s, error: %v", sess.ID(), err)
+	if err != nil {
+		log.Printf("Failed to remove session from redis, id: %s, error: %v", sess.ID(), err)
+		s.observe("remove", "error", start)
+		return
+	}
+	s.observe("remove", "ok", start)
+}
+
+// observe reports a store operation to the metrics.
+func (s *storeImpl) observe(op, result string, start time.Time) {
+	s.metrics.Counter(session.MetricStoreOps, 1, session.Labels{"store": "redicache", "op": op, "result": result})
+	s.metrics.Histogram(session.MetricStoreLatency, time.Since(start).Seconds(), session.Labels{"store": "redicache", "op": op})
+}
+
+// retry reports a retried operation to the metrics.
+func (s *storeImpl) retry(op string) {
+	s.metrics.Counter(session.MetricStoreRetries, 1, session.Labels{"store": "redicache", "op": op})
 }
 
 // Close is to implement Store.Close().
+// The built-in client is closed if the store created it; a Client passed in StoreOptions is not closed.
 func (s *storeImpl) Close() {
-	// Flush out sessions that were accessed from this store. No need locking, we're closing...
-	// We could use Codec.SetMulti(), but sessions will contain at most 1 session like all the times.
-	for _, sess := range s.sessions {
-		s.storeSession(sess)
+	if s.ownClient != nil {
+		s.ownClient.Close()
 	}
 }
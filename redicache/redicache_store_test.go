@@ -1,6 +1,7 @@
 package redicache
 
 import (
+	"context"
 	"encoding/gob"
 	"testing"
 	"time"
@@ -8,6 +9,8 @@ import (
 	"github.com/icza/mighty"
 
 	"github.com/go-osin/session"
+	"github.com/go-osin/session/codec"
+	"github.com/go-osin/session/sessiontest"
 )
 
 type Namer interface {
@@ -30,24 +33,219 @@ func TestRedicacheStore(t *testing.T) {
 	gob.Register(&vect{})
 	eq, neq := mighty.EqNeq(t)
 
-	st := NewStore()
+	fr := newFakeRedis(t, nil)
+	st := NewStoreOptions(&StoreOptions{Conn: &ConnOptions{Addr: fr.addr()}, Clock: fr.clock})
 	defer st.Close()
 
 	eq(nil, st.Load("asdf"))
 
-	s := session.NewSession()
+	s := session.NewSessionOptions(&session.SessOptions{Clock: fr.clock})
 	var v Namer
 	v = &vect{Name: "name"}
 	s.Set("test", v.(Namer))
 	st.Save(s)
-	time.Sleep(15 * time.Millisecond)
+	fr.clock.Advance(15 * time.Millisecond)
 	s_ := st.Load(s.ID())
 	// eq(s, s_)
 	value := s_.Get("test")
 	eq(v.GetName(), value.(Namer).GetName())
 	eq(len(s.Values()), len(s_.Values()))
 	neq(s_.Accessed(), s_.Created())
+	eq(s.Timeout(), s_.Timeout())
+
+	st.Remove(s)
+	eq(nil, st.Load(s.ID()))
+}
+
+func TestRedicacheStoreNamespace(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	fr := newFakeRedis(t, nil)
+	st := NewStoreOptions(&StoreOptions{Client: fr.client(t), Namespace: "app", KeyPrefix: "sess:"})
+	defer st.Close()
+
+	s := session.NewSession()
+	st.Save(s)
+
+	fr.mux.Lock()
+	_, ok := fr.data["app:sess:"+s.ID()]
+	fr.mux.Unlock()
+	eq(true, ok)
+}
+
+func TestRedicacheStoreEncrypted(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	kr, err := codec.NewKeyring(1, map[codec.KeyID][]byte{1: make([]byte, 32)})
+	eq(nil, err)
+	c := codec.Encrypt(codec.Envelope(codec.IDJSON, nil), kr, nil)
+	fr := newFakeRedis(t, nil)
+	st := NewStoreOptions(&StoreOptions{Client: fr.client(t), Codec: &c})
+	defer st.Close()
+
+	s := session.NewSession()
+	s.Set("a", "secret")
+	st.Save(s)
+	eq("secret", st.Load(s.ID()).Get("a"))
+
+	// Data of a session copied to another session is not loaded:
+	s2 := session.NewSession()
+	st.Save(s2)
+	fr.mux.Lock()
+	fr.data[s2.ID()] = fr.data[s.ID()]
+	fr.mux.Unlock()
+	eq(nil, st.Load(s2.ID()))
+}
+
+func TestRedicacheStoreCodecs(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	fr := newFakeRedis(t, nil)
+	for _, c := range []codec.Codec{codec.MsgPack, codec.CBOR} {
+		c := c
+		st := NewStoreOptions(&StoreOptions{Client: fr.client(t), Codec: &c})
+
+		s := session.NewSessionOptions(&session.SessOptions{Timeout: time.Hour})
+		s.Set("a", 1)
+		s.Set("b", int64(2))
+		st.Save(s)
+
+		s2 := st.Load(s.ID())
+		eq(1, s2.Get("a"))
+		eq(int64(2), s2.Get("b"))
+		eq(time.Hour, s2.Timeout())
+		eq(true, s.Created().Equal(s2.Created()))
+		st.Close()
+	}
+}
+
+func TestRedicacheStoreExpiration(t *testing.T) {
+	eq, deq := mighty.EqDeq(t)
+
+	fr := newFakeRedis(t, nil)
+	st := NewStoreOptions(&StoreOptions{Client: fr.client(t), Timeout: 50 * time.Millisecond, Clock: fr.clock})
+	defer st.Close()
+
+	s := session.NewSessionOptions(&session.SessOptions{Timeout: 50 * time.Millisecond, Clock: fr.clock})
+	st.Save(s)
+	deq([]string{"SET"}, fr.commands())
+
+	// Access extends the expiration (in the same command if the timeout is as expected):
+	fr.clock.Advance(30 * time.Millisecond)
+	eq(s.ID(), st.Load(s.ID()).ID())
+	deq([]string{"GETEX"}, fr.commands())
+	fr.clock.Advance(30 * time.Millisecond)
+	eq(s.ID(), st.Load(s.ID()).ID())
+
+	fr.clock.Advance(70 * time.Millisecond)
+	eq(nil, st.Load(s.ID()))
+
+	// Session with another timeout than expected, the expiration is corrected:
+	s2 := session.NewSessionOptions(&session.SessOptions{Timeout: time.Hour, Clock: fr.clock})
+	st.Save(s2)
+	st.Save(s)
+	fr.commands()
+	for i := 0; i < 2; i++ { // Loading other sessions doesn't change what's expected
+		eq(s2.ID(), st.Load(s2.ID()).ID())
+		deq([]string{"GETEX", "PEXPIRE"}, fr.commands())
+		eq(s.ID(), st.Load(s.ID()).ID())
+		deq([]string{"GETEX"}, fr.commands())
+	}
+	fr.mux.Lock()
+	eq(true, fr.expires[s2.ID()].Sub(fr.clock.Now()) > 59*time.Minute)
+	fr.mux.Unlock()
+}
+
+func TestRedicacheStoreDeprecatedOptions(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	fr1, fr2 := newFakeRedis(t, nil), newFakeRedis(t, nil)
+	fr1.password, fr2.password = "secret", "secret"
+
+	// Multiple nodes:
+	st := NewStoreOptions(&StoreOptions{Addrs: []string{fr1.addr(), fr2.addr()}, Password: "secret", DB: 1})
+	defer st.Close()
+	var ss []session.Session
+	for i := 0; i < 20; i++ {
+		s := session.NewSession()
+		st.Save(s)
+		ss = append(ss, s)
+	}
+	for _, s := range ss {
+		eq(s.ID(), st.Load(s.ID()).ID())
+	}
+	fr1.mux.Lock()
+	n1 := len(fr1.data)
+	fr1.mux.Unlock()
+	fr2.mux.Lock()
+	n2 := len(fr2.data)
+	fr2.mux.Unlock()
+	eq(20, n1+n2)
+	eq(true, n1 > 0 && n2 > 0) // Distributed
+
+	// Single node:
+	st2 := NewStoreOptions(&StoreOptions{Addrs: []string{fr1.addr()}, Password: "secret"})
+	defer st2.Close()
+	fr1.commands()
+	s := session.NewSession()
+	st2.Save(s)
+	eq("AUTH", fr1.commands()[0])
+	fr1.mux.Lock()
+	eq(true, fr1.live(s.ID()))
+	fr1.mux.Unlock()
+}
+
+func TestRedicacheStoreRetries(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	fr := newFakeRedis(t, nil)
+	rec := &recMetrics{}
+	st := NewStoreOptions(&StoreOptions{Client: fr.client(t), Retries: 3, Metrics: rec})
+	defer st.Close()
+
+	s := session.NewSession()
+	fr.mux.Lock()
+	fr.failNext = 2
+	fr.mux.Unlock()
+	st.Save(s)
+	eq(2, rec.retries)
+	eq(s.ID(), st.Load(s.ID()).ID())
+
+	// Error replies are not retried:
+	var calls int
+	st2 := NewStoreOptions(&StoreOptions{Client: ClientFunc(func(ctx context.Context, args ...interface{}) (interface{}, error) {
+		calls++
+		return nil, Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	})})
+	defer st2.Close()
+	eq(nil, st2.Load(s.ID()))
+	eq(1, calls)
+}
+
+// recMetrics counts store retries.
+type recMetrics struct {
+	session.Metrics
+	retries int
+}
+
+func (m *recMetrics) Counter(name string, delta float64, labels session.Labels) {
+	if name == session.MetricStoreRetries {
+		m.retries++
+	}
+}
+
+func (m *recMetrics) Histogram(name string, value float64, labels session.Labels) {}
 
-	// st.Remove(s)
-	// eq(nil, st.Load(s.ID()))
+func TestRedicacheStoreConformance(t *testing.T) {
+	fr := newFakeRedis(t, nil)
+	for _, layout := range []Layout{LayoutBlob, LayoutHash} {
+		sessiontest.Run(t, &sessiontest.Options{
+			NewStore: func(t *testing.T) session.Store {
+				return NewStoreOptions(&StoreOptions{Client: fr.client(t), Layout: layout, Clock: fr.clock})
+			},
+			Timeout:     400 * time.Millisecond,
+			ExpiryDelay: 50 * time.Millisecond,
+			Clock:       fr.clock,
+		})
+	}
 }
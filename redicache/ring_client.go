@@ -0,0 +1,91 @@
+package redicache
+
+import (
+	"context"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ringReplicas is the number of points of each node on the hash ring.
+const ringReplicas = 100
+
+// ringClient is a Client distributing keys among multiple Redis nodes, used for the deprecated StoreOptions.Addrs.
+// Keys are assigned to nodes the same way as by the go-redis Ring which served Addrs in earlier versions
+// of the store (with its default options), so sessions saved by those versions are found after upgrading:
+// consistent hashing with 100 points per node named "server<i>" (i being the index of the node in Addrs),
+// using the CRC-32 checksum of the hash tag of keys. Unlike the go-redis Ring, nodes which are down
+// are not taken out of the ring.
+// The store only uses commands operating on a single key, so each command is sent to the node owning its key.
+type ringClient struct {
+	nodes  []*ConnClient
+	points []uint32       // Sorted points of the nodes on the ring
+	owners map[uint32]int // Indices of the nodes owning the points
+}
+
+// newRingClient returns a new ringClient of the specified nodes, connecting to each with the options o.
+func newRingClient(addrs []string, o *ConnOptions) *ringClient {
+	c := &ringClient{owners: make(map[uint32]int)}
+	for i, addr := range addrs {
+		no := *o
+		no.Addr = addr
+		c.nodes = append(c.nodes, NewConnClient(&no))
+
+		name := "server" + strconv.Itoa(i)
+		for r := 0; r < ringReplicas; r++ {
+			p := crc32.ChecksumIEEE([]byte(strconv.Itoa(r) + name))
+			c.points = append(c.points, p)
+			c.owners[p] = i
+		}
+	}
+	sort.Slice(c.points, func(i, j int) bool { return c.points[i] < c.points[j] })
+	return c
+}
+
+// Do is to implement Client.Do().
+func (c *ringClient) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	return c.node(commandKey(args)).Do(ctx, args...)
+}
+
+// node returns the client of the node owning the key: the node of the first point at or after the hash of the key.
+func (c *ringClient) node(key string) *ConnClient {
+	h := crc32.ChecksumIEEE([]byte(hashTag(key)))
+	i := sort.Search(len(c.points), func(i int) bool { return c.points[i] >= h })
+	if i == len(c.points) {
+		i = 0 // Wrapped around
+	}
+	return c.nodes[c.owners[c.points[i]]]
+}
+
+// hashTag returns the hash tag of a key: the part between the first '{' and the next '}' if not empty,
+// else the key itself.
+func hashTag(key string) string {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			return key[s+1 : s+1+e]
+		}
+	}
+	return key
+}
+
+// commandKey returns the key of a single key command.
+func commandKey(args []interface{}) string {
+	i := 1
+	if cmd, _ := args[0].(string); cmd == "EVAL" || cmd == "EVALSHA" {
+		i = 3 // EVAL script numkeys key ...
+	}
+	if i < len(args) {
+		key, _ := args[i].(string)
+		return key
+	}
+	return ""
+}
+
+// Close closes the clients of all nodes.
+func (c *ringClient) Close() error {
+	for _, n := range c.nodes {
+		n.Close()
+	}
+	return nil
+}
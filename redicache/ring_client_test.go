@@ -0,0 +1,28 @@
+package redicache
+
+import (
+	"testing"
+
+	"github.com/icza/mighty"
+)
+
+func TestRingClientPlacement(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	c := newRingClient([]string{"a:6379", "b:6379", "c:6379"}, &ConnOptions{})
+	defer c.Close()
+
+	// Same nodes as chosen by the go-redis Ring with the nodes named "server0", "server1" and "server2":
+	for key, node := range map[string]int{
+		"a": 1, "b": 2, "c": 2, "d": 0, "e": 2,
+		"sess:a": 0, "sess:b": 0, "sess:c": 1,
+		"x{a}y": 1, // Hash tag
+	} {
+		if c.node(key) != c.nodes[node] {
+			t.Errorf("Expected node %d for key %q", node, key)
+		}
+	}
+
+	eq("sess:a", commandKey([]interface{}{"GET", "sess:a"}))
+	eq("sess:a", commandKey([]interface{}{"EVALSHA", "sha", 1, "sess:a", "arg"}))
+}
@@ -0,0 +1,207 @@
+/*
+
+A request-scoped session cache for distributed stores.
+
+*/
+
+package session
+
+import (
+	"context"
+	"sync"
+)
+
+// Key to use when setting the request cache.
+type ctxKeyRequestCache int
+
+// requestCacheKey is the key that holds the request cache in a request context.
+const requestCacheKey ctxKeyRequestCache = 0
+
+// cacheKey identifies a session of a request cached store.
+type cacheKey struct {
+	store *requestCachedStore
+	id    string
+}
+
+// cacheOp is a pending operation recorded in a request cache.
+type cacheOp int
+
+// Pending operations.
+const (
+	opNone cacheOp = iota
+	opSave
+	opRemove
+)
+
+// cacheEntry is a session cached in a request cache.
+type cacheEntry struct {
+	sess    Session // Cached session, nil if the store does not have it (or it is removed)
+	op      cacheOp // Pending operation to perform when flushing
+	pending Session // Session of the pending operation
+}
+
+// requestCache holds the sessions loaded and the changes made in the scope of a request.
+type requestCache struct {
+	mux     sync.Mutex // mutex to synchronize access to entries
+	entries map[cacheKey]*cacheEntry
+	order   []cacheKey // Keys of entries with pending operations in the order of the operations
+}
+
+// ContextWithRequestCache returns a new Context that carries a request cache.
+// Stores wrapped with RequestCachedStore load each session at most once in the scope of the returned context,
+// and defer saves and removals until FlushRequestCache() is called.
+//
+// The middleware of this package attaches a request cache to the context of each request,
+// and flushes it at the end of the request.
+func ContextWithRequestCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestCacheKey, &requestCache{entries: map[cacheKey]*cacheEntry{}})
+}
+
+// requestCacheFrom returns the request cache carried by ctx, nil if ctx has none.
+func requestCacheFrom(ctx context.Context) *requestCache {
+	rc, _ := ctx.Value(requestCacheKey).(*requestCache)
+	return rc
+}
+
+// FlushRequestCache performs the saves and removals recorded in the request cache carried by ctx,
+// each session being saved or removed at most once. It's a no-op if ctx has no request cache.
+// Cached sessions are kept, so a request cache may be flushed multiple times.
+func FlushRequestCache(ctx context.Context) {
+	rc := requestCacheFrom(ctx)
+	if rc == nil {
+		return
+	}
+
+	rc.mux.Lock()
+	order := rc.order
+	rc.order = nil
+	ops := make([]cacheEntry, len(order))
+	for i, key := range order {
+		e := rc.entries[key]
+		ops[i] = *e
+		e.op, e.pending = opNone, nil
+	}
+	rc.mux.Unlock()
+
+	for i, e := range ops {
+		switch st := order[i].store.st; e.op {
+		case opSave:
+			saveContext(ctx, st, e.pending)
+		case opRemove:
+			removeContext(ctx, st, e.pending)
+		}
+	}
+}
+
+// Request cached session Store implementation.
+type requestCachedStore struct {
+	st Store // Wrapped store
+}
+
+// RequestCachedStore returns a new Store which caches sessions of st in the scope of a request,
+// which is useful if st is a distributed store (e.g. Redis or memcached) where each access is a round trip.
+//
+// If the context of an operation carries a request cache (see ContextWithRequestCache),
+// Load() returns the session cached in the request (a miss is cached too), and only loads it from st once;
+// Save() and Remove() are recorded in the request cache, and performed on st by FlushRequestCache(),
+// repeated saves of a session resulting in a single save.
+// Operations without a request cache in their context (including the methods without a context) go directly to st.
+//
+// Closing the returned store closes st.
+func RequestCachedStore(st Store) Store {
+	return &requestCachedStore{st: st}
+}
+
+// Load is to implement Store.Load().
+func (s *requestCachedStore) Load(id string) Session {
+	return s.st.Load(id)
+}
+
+// LoadContext is to implement ContextStore.LoadContext().
+func (s *requestCachedStore) LoadContext(ctx context.Context, id string) Session {
+	rc := requestCacheFrom(ctx)
+	if rc == nil {
+		return loadContext(ctx, s.st, id)
+	}
+
+	key := cacheKey{s, id}
+	rc.mux.Lock()
+	if e := rc.entries[key]; e != nil {
+		sess := e.sess
+		rc.mux.Unlock()
+		if sess != nil {
+			sess.Access()
+		}
+		return sess
+	}
+	rc.mux.Unlock()
+
+	sess := loadContext(ctx, s.st, id)
+
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	if e := rc.entries[key]; e != nil {
+		// Another goroutine of the request loaded or changed it meanwhile, theirs wins:
+		return e.sess
+	}
+	rc.entries[key] = &cacheEntry{sess: sess}
+	return sess
+}
+
+// Save is to implement Store.Save().
+func (s *requestCachedStore) Save(sess Session) {
+	s.st.Save(sess)
+}
+
+// SaveContext is to implement ContextStore.SaveContext().
+func (s *requestCachedStore) SaveContext(ctx context.Context, sess Session) {
+	if !s.record(ctx, sess, opSave) {
+		saveContext(ctx, s.st, sess)
+	}
+}
+
+// Remove is to implement Store.Remove().
+func (s *requestCachedStore) Remove(sess Session) {
+	s.st.Remove(sess)
+}
+
+// RemoveContext is to implement ContextStore.RemoveContext().
+func (s *requestCachedStore) RemoveContext(ctx context.Context, sess Session) {
+	if !s.record(ctx, sess, opRemove) {
+		removeContext(ctx, s.st, sess)
+	}
+}
+
+// record records an operation on sess in the request cache carried by ctx.
+// Returns false if ctx has no request cache.
+func (s *requestCachedStore) record(ctx context.Context, sess Session, op cacheOp) bool {
+	rc := requestCacheFrom(ctx)
+	if rc == nil {
+		return false
+	}
+
+	key := cacheKey{s, sess.ID()}
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+
+	e := rc.entries[key]
+	if e == nil {
+		e = &cacheEntry{}
+		rc.entries[key] = e
+	}
+	if e.op == opNone {
+		rc.order = append(rc.order, key)
+	}
+	e.op, e.pending = op, sess
+	if op == opRemove {
+		e.sess = nil
+	} else {
+		e.sess = sess
+	}
+	return true
+}
+
+// Close is to implement Store.Close().
+func (s *requestCachedStore) Close() {
+	s.st.Close()
+}
@@ -0,0 +1,98 @@
+package session
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/icza/mighty"
+)
+
+func TestRequestCachedStore(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	inner := &countingStore{Store: NewInMemStore()}
+	st := RequestCachedStore(inner).(ContextStore)
+	defer st.Close()
+
+	s := NewSession()
+	inner.Store.Save(s)
+
+	ctx := ContextWithRequestCache(context.Background())
+	for i := 0; i < 3; i++ {
+		eq(s, st.LoadContext(ctx, s.ID()))
+		eq(nil, st.LoadContext(ctx, "asdf"))
+	}
+	loads, _ := inner.counts()
+	eq(2, loads)
+
+	// Saves are deferred and coalesced:
+	s2 := NewSession()
+	for i := 0; i < 3; i++ {
+		st.SaveContext(ctx, s)
+		st.SaveContext(ctx, s2)
+	}
+	eq(s2, st.LoadContext(ctx, s2.ID()))
+	_, saves := inner.counts()
+	eq(0, saves)
+	FlushRequestCache(ctx)
+	_, saves = inner.counts()
+	eq(2, saves)
+	eq(s2, inner.Store.Load(s2.ID()))
+
+	// Flushing again doesn't repeat them:
+	FlushRequestCache(ctx)
+	_, saves = inner.counts()
+	eq(2, saves)
+
+	// Removal cancels a pending save:
+	st.SaveContext(ctx, s)
+	st.RemoveContext(ctx, s)
+	eq(nil, st.LoadContext(ctx, s.ID()))
+	eq(s, inner.Store.Load(s.ID()))
+	FlushRequestCache(ctx)
+	_, saves = inner.counts()
+	eq(2, saves)
+	eq(nil, inner.Store.Load(s.ID()))
+	eq(nil, st.LoadContext(ctx, s.ID()))
+
+	// Without a request cache, operations go directly to the store:
+	st.SaveContext(context.Background(), s)
+	_, saves = inner.counts()
+	eq(3, saves)
+	eq(s, st.LoadContext(context.Background(), s.ID()))
+}
+
+func TestMiddlewareRequestCache(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	inner := &countingStore{Store: NewInMemStore()}
+	mgr := NewCookieManagerOptions(RequestCachedStore(inner), &CookieMngrOptions{AllowHTTP: true})
+	defer mgr.Close()
+
+	var id string
+	h := NewMiddleware(mgr, &MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := FromContext(r.Context())
+		id = sess.ID()
+		// Loads in the request hit the store once:
+		for i := 0; i < 3; i++ {
+			mgr.Load(r)
+		}
+		sess.Set("a", 1)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	loads, saves := inner.counts()
+	eq(0, loads) // No cookie yet
+	eq(1, saves)
+	eq(1, inner.Store.Load(id).Get("a"))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	loads, saves = inner.counts()
+	eq(1, loads) // Of the middleware and the handler
+	eq(2, saves)
+}
@@ -7,11 +7,11 @@ Session interface and its implementation.
 package session
 
 import (
-	"crypto/rand"
-	"encoding/base64"
-	"io"
+	"fmt"
 	"sync"
 	"time"
+
+	"github.com/go-osin/session/codec"
 )
 
 // Session is the (HTTP) session interface.
@@ -20,10 +20,19 @@ type Session interface {
 	// ID returns the id of the session.
 	ID() string
 
-	// New tells if the session is new.
-	// Implementation is based on whether created and access times are equal.
+	// New tells if the session is new: it was created and it has not yet been saved.
+	// It is a shorthand for State() == StateNew.
 	New() bool
 
+	// State returns the persistence state of the session.
+	// Safe for concurrent use.
+	State() State
+
+	// SetState sets the persistence state of the session.
+	// Users do not need to call this as stores and managers are responsible for that.
+	// Safe for concurrent use.
+	SetState(state State)
+
 	// Getp returns the value of an attribute provided at session creation.
 	// These attributes cannot be changes during the lifetime of a session,
 	// so they can be accessed safely without synchronization. Exampe is storing the
@@ -39,10 +48,19 @@ type Session interface {
 	// Safe for concurrent use.
 	Set(name string, value interface{})
 
+	// TrySet is like Set, but it validates that the value can be marshalled by the codec of the session
+	// (see SessOptions.Codec, codec.Gob if the session has none), and returns an error instead of setting
+	// the attribute if it can't be (e.g. its type is not registered, see RegisterType).
+	// Safe for concurrent use.
+	TrySet(name string, value interface{}) error
+
 	// Values returns a copy of all the attribute values stored in the session.
 	// Safe for concurrent use.
 	Values() map[string]interface{}
 
+	// ConstValues returns a copy of the attributes provided at session creation (see Getp).
+	ConstValues() map[string]interface{}
+
 	// Created returns the session creation time.
 	Created() time.Time
 
@@ -71,6 +89,40 @@ type Session interface {
 	Changed() bool
 }
 
+// State is the persistence state of a Session.
+type State int
+
+// Session states.
+const (
+	// StateNew means the session was created and it has not yet been saved.
+	StateNew State = iota
+
+	// StateLoaded means the session was loaded from a store (or it has been saved),
+	// and its attributes have not been modified since.
+	StateLoaded
+
+	// StateModified means the attributes of the session have been modified since it was loaded (or saved).
+	StateModified
+
+	// StateDestroyed means the session has been removed.
+	StateDestroyed
+)
+
+// String returns the name of the state.
+func (s State) String() string {
+	switch s {
+	case StateNew:
+		return "new"
+	case StateLoaded:
+		return "loaded"
+	case StateModified:
+		return "modified"
+	case StateDestroyed:
+		return "destroyed"
+	}
+	return "unknown"
+}
+
 // Session implementation.
 // Fields are exported so a session may be marshalled / unmarshalled.
 type sessionImpl struct {
@@ -82,6 +134,9 @@ type sessionImpl struct {
 	TimeoutF  time.Duration          `json:"timeout"`  // Session timeout
 	mux       *sync.RWMutex          // RW mutex to synchronize session state access
 	changedF  bool
+	stateF    State        // Persistence state of the session
+	codec     *codec.Codec // Codec to validate attribute values with, nil if no validation is to be done
+	clock     Clock        // Clock to get the access time from
 }
 
 // SessOptions defines options that may be passed when creating a new Session.
@@ -106,7 +161,28 @@ type SessOptions struct {
 	// Byte-length of the information that builds up the session ids.
 	// Using Base-64 encoding, id length will be this multiplied by 4/3 chars.
 	// Default value is 18 (which means length of ID will be 24 chars).
+	// Only used by the default ID generator (if IDGen is nil).
 	IDLength int
+
+	// Generator of the session ID if IDF is not specified; default value is RandomIDGen(IDLength)
+	// if IDLength is set, else the default generator (see CookieMngrOptions.IDGen).
+	// Managers validate incoming IDs with their generator, which must be the same (see CookieMngrOptions.IDGen).
+	// Generators embedding a timestamp (UUIDv7, ULID) take it from Clock.
+	IDGen IDGenerator
+
+	// Codec to validate attribute values with in Session.TrySet(), which should be the codec of the store;
+	// default value is nil which means values are validated with codec.Gob, the default codec of stores.
+	// Stores of this module pass their codec when they load sessions; if the store uses another codec,
+	// new sessions should be created with it too (see MiddlewareOptions.SessionFunc).
+	Codec *codec.Codec
+
+	// Clock to get the creation and access times from; default value is SystemClock.
+	// Stores of this module pass their clock when they load sessions.
+	Clock Clock
+
+	// Initial persistence state of the session; default value is StateNew.
+	// Stores pass StateLoaded when they load sessions.
+	State State
 }
 
 // Pointer to zero value of SessOptions to be reused for efficiency.
@@ -120,11 +196,8 @@ func NewSession() Session {
 
 // NewSessionOptions creates a new Session with the specified options.
 func NewSessionOptions(o *SessOptions) Session {
-	now := time.Now()
-	idLength := o.IDLength
-	if idLength <= 0 {
-		idLength = 18
-	}
+	clock := clockOrSystem(o.Clock)
+	now := clock.Now()
 	timeout := o.Timeout
 	if timeout == 0 {
 		timeout = 30 * time.Minute
@@ -134,7 +207,14 @@ func NewSessionOptions(o *SessOptions) Session {
 	if o.IDF != "" {
 		id = o.IDF
 	} else {
-		id = genID(idLength)
+		idGen := o.IDGen
+		if idGen == nil {
+			idGen = defaultIDGen
+			if o.IDLength > 0 {
+				idGen = randomIDGen(o.IDLength)
+			}
+		}
+		id = newID(idGen, now)
 	}
 	var created time.Time
 	if !o.CreatedF.IsZero() {
@@ -149,6 +229,9 @@ func NewSessionOptions(o *SessOptions) Session {
 		AttrsF:    make(map[string]interface{}),
 		TimeoutF:  timeout,
 		mux:       &sync.RWMutex{},
+		codec:     o.Codec,
+		clock:     clock,
+		stateF:    o.State,
 	}
 
 	if len(o.CAttrs) > 0 {
@@ -165,13 +248,6 @@ func NewSessionOptions(o *SessOptions) Session {
 	return &sess
 }
 
-// genID generates a secure, random session id using the crypto/rand package.
-func genID(length int) string {
-	r := make([]byte, length)
-	io.ReadFull(rand.Reader, r)
-	return base64.URLEncoding.EncodeToString(r)
-}
-
 // ID is to implement Session.ID().
 func (s *sessionImpl) ID() string {
 	return s.IDF
@@ -179,7 +255,23 @@ func (s *sessionImpl) ID() string {
 
 // New is to implement Session.New().
 func (s *sessionImpl) New() bool {
-	return s.CreatedF == s.AccessedF
+	return s.State() == StateNew
+}
+
+// State is to implement Session.State().
+func (s *sessionImpl) State() State {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.stateF
+}
+
+// SetState is to implement Session.SetState().
+func (s *sessionImpl) SetState(state State) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.stateF = state
 }
 
 // Changed is to implement Session.Changed().
@@ -211,6 +303,30 @@ func (s *sessionImpl) Set(name string, value interface{}) {
 		s.AttrsF[name] = value
 	}
 	s.changedF = true
+	if s.stateF == StateLoaded {
+		s.stateF = StateModified
+	}
+}
+
+// attrCheck is marshalled to validate attribute values.
+// Wrapping the value in an interface makes codecs requiring type registration (e.g. gob) check it.
+type attrCheck struct {
+	V interface{}
+}
+
+// TrySet is to implement Session.TrySet().
+func (s *sessionImpl) TrySet(name string, value interface{}) error {
+	if value != nil {
+		c := s.codec
+		if c == nil {
+			c = &codec.Gob
+		}
+		if _, err := c.Marshal(&attrCheck{V: value}); err != nil {
+			return fmt.Errorf("session: value of attribute %q can't be marshalled: %v", name, err)
+		}
+	}
+	s.Set(name, value)
+	return nil
 }
 
 // Values is to implement Session.Values().
@@ -225,6 +341,15 @@ func (s *sessionImpl) Values() map[string]interface{} {
 	return m
 }
 
+// ConstValues is to implement Session.ConstValues().
+func (s *sessionImpl) ConstValues() map[string]interface{} {
+	m := make(map[string]interface{}, len(s.CAttrsF))
+	for k, v := range s.CAttrsF {
+		m[k] = v
+	}
+	return m
+}
+
 // Created is to implement Session.Created().
 func (s *sessionImpl) Created() time.Time {
 	return s.CreatedF
@@ -253,5 +378,5 @@ func (s *sessionImpl) Access() {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
-	s.AccessedF = time.Now()
+	s.AccessedF = s.clock.Now()
 }
@@ -2,10 +2,12 @@ package session
 
 import (
 	"encoding/base64"
+	"errors"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/go-osin/session/codec"
 	"github.com/icza/mighty"
 )
 
@@ -56,6 +58,7 @@ func TestSessOptions(t *testing.T) {
 	for k, v := range so.CAttrs {
 		eq(v, s.Getp(k))
 	}
+	eq(true, reflect.DeepEqual(s.ConstValues(), so.CAttrs))
 
 	data, err := base64.URLEncoding.DecodeString(s.ID())
 	eq(nil, err)
@@ -63,3 +66,92 @@ func TestSessOptions(t *testing.T) {
 
 	eq(so.Timeout, s.Timeout())
 }
+
+func TestSessionTrySet(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	type unregistered struct{ A int }
+
+	// No codec, validated with gob:
+	s := NewSession()
+	neq(nil, s.TrySet("a", unregistered{}))
+	eq(nil, s.Get("a"))
+	eq(nil, s.TrySet("a", &registeredAttr{Name: "x"}))
+
+	for _, c := range []codec.Codec{codec.Gob, codec.MsgPack, codec.CBOR} {
+		c := c
+		s := NewSessionOptions(&SessOptions{Codec: &c})
+		eq(nil, s.TrySet("a", 1))
+		eq(1, s.Get("a"))
+		neq(nil, s.TrySet("b", unregistered{}))
+		eq(nil, s.Get("b"))
+		eq(nil, s.TrySet("c", &registeredAttr{Name: "x"}))
+		eq(nil, s.TrySet("a", nil))
+		eq(nil, s.Get("a"))
+	}
+
+	s = NewSessionOptions(&SessOptions{Codec: &codec.JSON})
+	neq(nil, s.TrySet("f", func() {}))
+	eq(nil, s.Get("f"))
+}
+
+func TestSessionState(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	s := NewSession()
+	eq(StateNew, s.State())
+	eq(true, s.New())
+	s.Set("a", 1)
+	eq(StateNew, s.State()) // New until saved
+	eq(true, s.Changed())
+
+	s.SetState(StateLoaded)
+	eq(false, s.New())
+	s.Access()
+	eq(StateLoaded, s.State())
+	eq(nil, s.TrySet("a", 2))
+	eq(StateModified, s.State())
+
+	s.SetState(StateDestroyed)
+	s.Set("a", 3)
+	eq(StateDestroyed, s.State())
+
+	s = NewSessionOptions(&SessOptions{State: StateLoaded})
+	eq(StateLoaded, s.State())
+	eq(false, s.New())
+
+	eq("new", StateNew.String())
+	eq("modified", StateModified.String())
+	eq("unknown", State(99).String())
+}
+
+func TestUnmarshalSession(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	s := NewSessionOptions(&SessOptions{
+		CAttrs:  map[string]interface{}{"user": "bob"},
+		Attrs:   map[string]interface{}{"a": "x"},
+		Timeout: time.Hour,
+	})
+	for _, c := range []codec.Codec{codec.Gob, codec.JSON, codec.MsgPack} {
+		data, err := c.Marshal(s)
+		eq(nil, err)
+
+		o, err := UnmarshalSession(c, data, s.ID())
+		eq(nil, err)
+		eq(s.ID(), o.IDF)
+		eq(s.Created().UnixNano(), o.CreatedF.UnixNano())
+		eq("bob", o.CAttrs["user"])
+		eq("x", o.Attrs["a"])
+		eq(time.Hour, o.Timeout)
+		neq(nil, o.Codec)
+
+		// Data of another session:
+		o, err = UnmarshalSession(c, data, NewSession().ID())
+		eq(true, errors.Is(err, ErrIDMismatch))
+		eq(true, o == nil)
+
+		_, err = UnmarshalSession(c, []byte("garbage"), s.ID())
+		neq(nil, err)
+	}
+}
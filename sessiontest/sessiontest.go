@@ -0,0 +1,422 @@
+/*
+
+Package sessiontest provides a conformance test suite for session.Store implementations.
+
+The suite is table-driven: each test runs as a subtest on a store returned by Options.NewStore.
+It covers load-after-save, remove, timeout expiry, access time updates, concurrent use
+(run the tests with -race), Close semantics and the optional interfaces
+(session.ContextStore, session.Lister and session.Toucher) if the store implements them.
+
+Stores supporting a session.Clock should be tested with a clocktest.Clock (see Options.Clock),
+so the expiry tests advance the clock instead of sleeping.
+
+Usage in a test of a store implementation:
+
+	func TestConformance(t *testing.T) {
+		sessiontest.Run(t, &sessiontest.Options{
+			NewStore: func(t *testing.T) session.Store {
+				return mystore.New(...)
+			},
+		})
+	}
+
+*/
+
+package sessiontest
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-osin/session"
+	"github.com/go-osin/session/clocktest"
+)
+
+// Options defines options of the suite.
+// All fields are optional except NewStore; default value will be used for any field that has the zero value.
+type Options struct {
+	// NewStore returns a new store to run a test on. Required.
+	// The store does not need to be empty, but it must not be shared with other tests running in parallel.
+	// The suite closes the store at the end of the test.
+	// Goroutines started by NewStore (e.g. fake servers) must not outlive the store (see SkipGoroutineCheck);
+	// start them before calling Run instead.
+	NewStore func(t *testing.T) session.Store
+
+	// Timeout of sessions used by the expiry tests; default value is 1 second.
+	Timeout time.Duration
+
+	// Maximum time after a session timed out until the store stops returning it
+	// (e.g. the interval of its session cleaner); default value is 1 second.
+	// Tests checking that accessing a session extends its life are skipped unless
+	// ExpiryDelay is less than half of Timeout.
+	ExpiryDelay time.Duration
+
+	// Number of goroutines of the concurrency test; default value is 8.
+	Goroutines int
+
+	// Maximum duration of Close; default value is 5 seconds.
+	CloseTimeout time.Duration
+
+	// Tells to skip checking that the goroutines started by the store stop when it is closed.
+	SkipGoroutineCheck bool
+
+	// Clock used by the stores returned by NewStore; default value is nil which means the stores use real time.
+	// If set, sessions of the tests are created with it, and the expiry tests advance it instead of sleeping
+	// (session cleaners registered with it run synchronously, so ExpiryDelay may be their interval).
+	Clock *clocktest.Clock
+}
+
+// test is a test of the suite.
+type test struct {
+	name string
+	f    func(t *testing.T, o *Options, st session.Store)
+	own  bool // Tells if the test creates (and closes) its store itself, st is nil then
+}
+
+// tests is the suite.
+var tests = []test{
+	{name: "LoadMissing", f: testLoadMissing},
+	{name: "LoadAfterSave", f: testLoadAfterSave},
+	{name: "SaveAgain", f: testSaveAgain},
+	{name: "Remove", f: testRemove},
+	{name: "Expiry", f: testExpiry},
+	{name: "AccessTime", f: testAccessTime},
+	{name: "Concurrency", f: testConcurrency},
+	{name: "Context", f: testContext},
+	{name: "Lister", f: testLister},
+	{name: "Toucher", f: testToucher},
+	{name: "Close", f: testClose, own: true},
+}
+
+// Run runs the suite on stores returned by o.NewStore, each test as a subtest of t.
+func Run(t *testing.T, o *Options) {
+	if o.NewStore == nil {
+		t.Fatal("sessiontest: Options.NewStore is required")
+	}
+	oo := *o
+	if oo.Timeout <= 0 {
+		oo.Timeout = time.Second
+	}
+	if oo.ExpiryDelay <= 0 {
+		oo.ExpiryDelay = time.Second
+	}
+	if oo.Goroutines <= 0 {
+		oo.Goroutines = 8
+	}
+	if oo.CloseTimeout <= 0 {
+		oo.CloseTimeout = 5 * time.Second
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var st session.Store
+			if !tt.own {
+				st = oo.NewStore(t)
+				defer st.Close()
+			}
+			tt.f(t, &oo, st)
+		})
+	}
+}
+
+// newSession returns a new session with attributes and the given timeout, created with the clock of o.
+func newSession(o *Options, timeout time.Duration) session.Session {
+	so := &session.SessOptions{
+		CAttrs:  map[string]interface{}{"const": "c"},
+		Attrs:   map[string]interface{}{"a": "b", "ünicode ✓": "é"},
+		Timeout: timeout,
+	}
+	if o.Clock != nil {
+		so.Clock = o.Clock
+	}
+	return session.NewSessionOptions(so)
+}
+
+// sleep advances the clock of o by d if it has one, else it sleeps for d.
+func (o *Options) sleep(d time.Duration) {
+	if o.Clock != nil {
+		o.Clock.Advance(d)
+		return
+	}
+	time.Sleep(d)
+}
+
+// now returns the current time of the clock of o if it has one, else the current time.
+func (o *Options) now() time.Time {
+	if o.Clock != nil {
+		return o.Clock.Now()
+	}
+	return time.Now()
+}
+
+// mustLoad loads the session specified by its id, and fails the test if it is not found.
+func mustLoad(t *testing.T, st session.Store, id string) session.Session {
+	t.Helper()
+	sess := st.Load(id)
+	if sess == nil {
+		t.Fatalf("Session not found: %s", id)
+	}
+	return sess
+}
+
+func testLoadMissing(t *testing.T, o *Options, st session.Store) {
+	if sess := st.Load(session.NewSession().ID()); sess != nil {
+		t.Errorf("Expected nil for a missing session, got: %v", sess.ID())
+	}
+}
+
+func testLoadAfterSave(t *testing.T, o *Options, st session.Store) {
+	sess := newSession(o, 30*time.Minute)
+	st.Save(sess)
+
+	loaded := mustLoad(t, st, sess.ID())
+	if got := loaded.ID(); got != sess.ID() {
+		t.Errorf("Expected ID: %s, got: %s", sess.ID(), got)
+	}
+	if got := loaded.State(); got != session.StateLoaded {
+		t.Errorf("Expected state: %v, got: %v", session.StateLoaded, got)
+	}
+	for _, name := range []string{"a", "ünicode ✓", "const"} {
+		if got, exp := loaded.Get(name), sess.Get(name); got != exp {
+			t.Errorf("Expected attribute %q: %v, got: %v", name, exp, got)
+		}
+	}
+	if got := loaded.Timeout(); got != sess.Timeout() {
+		t.Errorf("Expected timeout: %v, got: %v", sess.Timeout(), got)
+	}
+	if d := loaded.Created().Sub(sess.Created()); d < -time.Second || d > time.Second {
+		t.Errorf("Expected created: %v, got: %v", sess.Created(), loaded.Created())
+	}
+}
+
+func testSaveAgain(t *testing.T, o *Options, st session.Store) {
+	sess := newSession(o, 30*time.Minute)
+	st.Save(sess)
+
+	loaded := mustLoad(t, st, sess.ID())
+	loaded.Set("a", "modified")
+	loaded.Set("new", "value")
+	loaded.Set("ünicode ✓", nil)
+	st.Save(loaded)
+
+	loaded = mustLoad(t, st, sess.ID())
+	for name, exp := range map[string]interface{}{"a": "modified", "new": "value", "ünicode ✓": nil} {
+		if got := loaded.Get(name); got != exp {
+			t.Errorf("Expected attribute %q: %v, got: %v", name, exp, got)
+		}
+	}
+}
+
+func testRemove(t *testing.T, o *Options, st session.Store) {
+	sess, other := newSession(o, 30*time.Minute), newSession(o, 30*time.Minute)
+	st.Save(sess)
+	st.Save(other)
+
+	st.Remove(sess)
+	if got := st.Load(sess.ID()); got != nil {
+		t.Errorf("Expected nil for a removed session, got: %v", got.ID())
+	}
+	mustLoad(t, st, other.ID())
+
+	st.Remove(sess)                     // Removing again must be a no-op
+	st.Remove(newSession(o, time.Hour)) // Removing a session not in the store must be a no-op
+}
+
+func testExpiry(t *testing.T, o *Options, st session.Store) {
+	sess := newSession(o, o.Timeout)
+	st.Save(sess)
+	mustLoad(t, st, sess.ID())
+
+	o.sleep(o.Timeout + o.ExpiryDelay)
+	if got := st.Load(sess.ID()); got != nil {
+		t.Errorf("Expected nil for a timed out session, got: %v", got.ID())
+	}
+}
+
+// keepAlive checks that access extends the life of a session: access is called at half of the timeout,
+// and the session must be live after the timeout and the expiry delay.
+func keepAlive(t *testing.T, o *Options, st session.Store, access func(id string)) {
+	if o.ExpiryDelay >= o.Timeout/2 {
+		t.Logf("Skipping keep alive check, ExpiryDelay (%v) is not less than half of Timeout (%v)", o.ExpiryDelay, o.Timeout)
+		return
+	}
+	sess := newSession(o, o.Timeout)
+	st.Save(sess)
+
+	o.sleep(o.Timeout / 2)
+	access(sess.ID())
+	o.sleep(o.Timeout/2 + o.ExpiryDelay)
+	if st.Load(sess.ID()) == nil {
+		t.Errorf("Session timed out despite access: %s", sess.ID())
+	}
+}
+
+func testAccessTime(t *testing.T, o *Options, st session.Store) {
+	sess := newSession(o, 30*time.Minute)
+	st.Save(sess)
+
+	o.sleep(10 * time.Millisecond)
+	before := o.now()
+	loaded := mustLoad(t, st, sess.ID())
+	if loaded.Accessed().Before(before) {
+		t.Errorf("Expected access time after %v, got: %v", before, loaded.Accessed())
+	}
+
+	keepAlive(t, o, st, func(id string) { mustLoad(t, st, id) })
+}
+
+func testConcurrency(t *testing.T, o *Options, st session.Store) {
+	shared := newSession(o, 30*time.Minute)
+	st.Save(shared)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, o.Goroutines)
+	for i := 0; i < o.Goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				sess := newSession(o, 30*time.Minute)
+				st.Save(sess)
+				if st.Load(sess.ID()) == nil {
+					errs <- fmt.Errorf("session not found after save: %s", sess.ID())
+					return
+				}
+				st.Remove(sess)
+
+				if s := st.Load(shared.ID()); s != nil {
+					s.Set(fmt.Sprint("g", i), j)
+					s.Get("a")
+					s.Values()
+					st.Save(s)
+				} else {
+					errs <- fmt.Errorf("shared session not found: %s", shared.ID())
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func testContext(t *testing.T, o *Options, st session.Store) {
+	cs, ok := st.(session.ContextStore)
+	if !ok {
+		t.Skip("Store does not implement session.ContextStore")
+	}
+	ctx := context.Background()
+
+	sess := newSession(o, 30*time.Minute)
+	cs.SaveContext(ctx, sess)
+	if cs.LoadContext(ctx, sess.ID()) == nil {
+		t.Fatalf("Session not found: %s", sess.ID())
+	}
+	cs.RemoveContext(ctx, sess)
+	if got := cs.LoadContext(ctx, sess.ID()); got != nil {
+		t.Errorf("Expected nil for a removed session, got: %v", got.ID())
+	}
+}
+
+func testLister(t *testing.T, o *Options, st session.Store) {
+	l, ok := st.(session.Lister)
+	if !ok {
+		t.Skip("Store does not implement session.Lister")
+	}
+
+	var saved []string
+	for i := 0; i < 3; i++ {
+		sess := newSession(o, 30*time.Minute)
+		st.Save(sess)
+		saved = append(saved, sess.ID())
+	}
+	removed := newSession(o, 30*time.Minute)
+	st.Save(removed)
+	st.Remove(removed)
+
+	ids := l.IDs()
+	sort.Strings(ids)
+	contains := func(id string) bool {
+		i := sort.SearchStrings(ids, id)
+		return i < len(ids) && ids[i] == id
+	}
+	for _, id := range saved {
+		if !contains(id) {
+			t.Errorf("Saved session not listed: %s", id)
+		}
+	}
+	if contains(removed.ID()) {
+		t.Errorf("Removed session listed: %s", removed.ID())
+	}
+}
+
+func testToucher(t *testing.T, o *Options, st session.Store) {
+	tc, ok := st.(session.Toucher)
+	if !ok {
+		t.Skip("Store does not implement session.Toucher")
+	}
+
+	if tc.Touch(session.NewSession().ID()) {
+		t.Error("Touch reported a missing session as found")
+	}
+	sess := newSession(o, 30*time.Minute)
+	st.Save(sess)
+	if !tc.Touch(sess.ID()) {
+		t.Errorf("Touch reported a saved session as missing: %s", sess.ID())
+	}
+	st.Remove(sess)
+	if tc.Touch(sess.ID()) {
+		t.Errorf("Touch reported a removed session as found: %s", sess.ID())
+	}
+
+	keepAlive(t, o, st, func(id string) {
+		if !tc.Touch(id) {
+			t.Errorf("Touch reported a saved session as missing: %s", id)
+		}
+	})
+}
+
+func testClose(t *testing.T, o *Options, _ session.Store) {
+	before := runtime.NumGoroutine()
+	st := o.NewStore(t)
+	sess := newSession(o, 30*time.Minute)
+	st.Save(sess)
+	mustLoad(t, st, sess.ID())
+
+	done := make(chan struct{})
+	go func() {
+		st.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(o.CloseTimeout):
+		t.Fatalf("Close did not return in %v", o.CloseTimeout)
+	}
+
+	if !o.SkipGoroutineCheck {
+		if n := numGoroutine(before, time.Now().Add(o.CloseTimeout)); n > before {
+			t.Errorf("Goroutines left running after Close: %d, before the store was created: %d", n, before)
+		}
+	}
+}
+
+// numGoroutine returns the number of goroutines once it drops to max or the deadline is reached.
+func numGoroutine(max int, deadline time.Time) int {
+	for {
+		n := runtime.NumGoroutine()
+		if n <= max || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
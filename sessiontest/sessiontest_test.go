@@ -0,0 +1,44 @@
+package sessiontest
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-osin/session"
+	"github.com/go-osin/session/clocktest"
+)
+
+func TestInMemStore(t *testing.T) {
+	clock := clocktest.New(time.Now())
+	for _, o := range []*session.InMemStoreOptions{
+		{SessCleanerInterval: 10 * time.Millisecond, Clock: clock},
+		{SessCleanerInterval: 10 * time.Millisecond, Clock: clock, Shards: 4},
+		{SessCleanerInterval: 10 * time.Millisecond, Clock: clock, MaxSessions: 1000},
+	} {
+		o := o
+		Run(t, &Options{
+			NewStore:    func(t *testing.T) session.Store { return session.NewInMemStoreOptions(o) },
+			Timeout:     400 * time.Millisecond,
+			ExpiryDelay: 10 * time.Millisecond,
+			Clock:       clock,
+		})
+	}
+}
+
+func TestInMemStorePersistent(t *testing.T) {
+	clock := clocktest.New(time.Now())
+	Run(t, &Options{
+		NewStore: func(t *testing.T) session.Store {
+			return session.NewInMemStoreOptions(&session.InMemStoreOptions{
+				SessCleanerInterval: 10 * time.Millisecond,
+				SnapshotPath:        filepath.Join(t.TempDir(), "sessions"),
+				Journal:             true,
+				Clock:               clock,
+			})
+		},
+		Timeout:     400 * time.Millisecond,
+		ExpiryDelay: 10 * time.Millisecond,
+		Clock:       clock,
+	})
+}
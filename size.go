@@ -0,0 +1,76 @@
+/*
+
+Approximate size estimation of sessions.
+
+*/
+
+package session
+
+import (
+	"reflect"
+)
+
+// sessionOverhead is the estimated size of a session excluding its ID and attributes.
+const sessionOverhead = 256
+
+// EstimateSize returns the approximate size of a session in bytes: the size of its ID and attributes
+// (both constant and variable) plus a constant overhead.
+// Attribute values are measured by walking them with reflection; values referenced
+// multiple times are counted each time.
+func EstimateSize(sess Session) int {
+	size := sessionOverhead + len(sess.ID())
+	for k, v := range sess.Values() {
+		size += len(k) + valueSize(reflect.ValueOf(v), 0)
+	}
+	if si, ok := sess.(*sessionImpl); ok {
+		for k, v := range si.CAttrsF {
+			size += len(k) + valueSize(reflect.ValueOf(v), 0)
+		}
+	}
+	return size
+}
+
+// maxSizeDepth is the max depth valueSize descends to, to guard against cyclic values.
+const maxSizeDepth = 16
+
+// valueSize returns the approximate size of a value in bytes.
+func valueSize(v reflect.Value, depth int) int {
+	if !v.IsValid() || depth > maxSizeDepth {
+		return 0
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return 16 + v.Len()
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return 24 + v.Len()
+		}
+		fallthrough
+	case reflect.Array:
+		size := 24
+		for i := 0; i < v.Len(); i++ {
+			size += valueSize(v.Index(i), depth+1)
+		}
+		return size
+	case reflect.Map:
+		size := 48
+		it := v.MapRange()
+		for it.Next() {
+			size += valueSize(it.Key(), depth+1) + valueSize(it.Value(), depth+1)
+		}
+		return size
+	case reflect.Struct:
+		size := 0
+		for i := 0; i < v.NumField(); i++ {
+			size += valueSize(v.Field(i), depth+1)
+		}
+		return size
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return 8
+		}
+		return 8 + valueSize(v.Elem(), depth+1)
+	}
+	return int(v.Type().Size())
+}
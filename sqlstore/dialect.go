@@ -0,0 +1,94 @@
+package sqlstore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dialect describes the differences of SQL databases the store has to deal with.
+// Use one of the predefined dialects: SQLite, Postgres or MySQL.
+type Dialect struct {
+	// Name of the dialect.
+	Name string
+
+	placeholder func(n int) string // Returns the placeholder of the nth (1-based) parameter
+	blobType    string             // Column type of the payload
+	upsert      string             // Upsert statement template, %s is the table name
+	purge       string             // Statement template to delete a batch of expired sessions, %s is the table name
+	migrations  []string           // Schema migrations, %s is the table name
+}
+
+// Predefined dialects.
+var (
+	// SQLite is the dialect of SQLite 3.24.0 or newer.
+	SQLite = &Dialect{
+		Name:        "sqlite",
+		placeholder: questionMark,
+		blobType:    "BLOB",
+		upsert: `INSERT INTO %s (id, data, created, accessed, expires) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET data = excluded.data, accessed = excluded.accessed, expires = excluded.expires`,
+		purge: `DELETE FROM %[1]s WHERE id IN (SELECT id FROM %[1]s WHERE expires < ? LIMIT ?)`,
+		migrations: []string{
+			createTable,
+			`CREATE INDEX IF NOT EXISTS %[1]s_expires_idx ON %[1]s (expires)`,
+		},
+	}
+
+	// Postgres is the dialect of PostgreSQL 9.5 or newer.
+	Postgres = &Dialect{
+		Name:        "postgres",
+		placeholder: dollar,
+		blobType:    "BYTEA",
+		upsert: `INSERT INTO %s (id, data, created, accessed, expires) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (id) DO UPDATE SET data = excluded.data, accessed = excluded.accessed, expires = excluded.expires`,
+		purge: `DELETE FROM %[1]s WHERE id IN (SELECT id FROM %[1]s WHERE expires < $1 LIMIT $2)`,
+		migrations: []string{
+			createTable,
+			`CREATE INDEX IF NOT EXISTS %[1]s_expires_idx ON %[1]s (expires)`,
+		},
+	}
+
+	// MySQL is the dialect of MySQL 5.6 or newer and MariaDB.
+	MySQL = &Dialect{
+		Name:        "mysql",
+		placeholder: questionMark,
+		blobType:    "LONGBLOB",
+		upsert: `INSERT INTO %s (id, data, created, accessed, expires) VALUES (?, ?, ?, ?, ?)
+ON DUPLICATE KEY UPDATE data = VALUES(data), accessed = VALUES(accessed), expires = VALUES(expires)`,
+		purge: `DELETE FROM %s WHERE expires < ? LIMIT ?`,
+		migrations: []string{
+			createTable,
+			`CREATE INDEX %[1]s_expires_idx ON %[1]s (expires)`,
+		},
+	}
+)
+
+// createTable is the first migration of all dialects; %[2]s is the blob type.
+const createTable = `CREATE TABLE IF NOT EXISTS %[1]s (
+	id       VARCHAR(255) NOT NULL PRIMARY KEY,
+	data     %[2]s NOT NULL,
+	created  BIGINT NOT NULL,
+	accessed BIGINT NOT NULL,
+	expires  BIGINT NOT NULL
+)`
+
+func questionMark(int) string { return "?" }
+func dollar(n int) string     { return fmt.Sprintf("$%d", n) }
+
+// query returns the query with "?" placeholders replaced by the placeholders of the dialect.
+func (d *Dialect) query(q string) string {
+	if d.placeholder(1) == "?" {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			b.WriteString(d.placeholder(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
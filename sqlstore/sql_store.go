@@ -0,0 +1,307 @@
+/*
+
+Package sqlstore provides a session store implementation backed by an SQL database via database/sql.
+
+Sessions are stored in a table with the session ID, the session marshalled with the codec of the store,
+and the created, last accessed and expiration times (as Unix milliseconds, for portability).
+The expiration column is indexed, and a background purge job deletes expired sessions in batches.
+
+The store works with SQLite, PostgreSQL and MySQL (see Dialect); the appropriate database driver
+must be imported by the application. The schema can be created with Migrate(), or automatically
+by setting StoreOptions.AutoMigrate.
+
+*/
+
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-osin/session"
+	"github.com/go-osin/session/codec"
+)
+
+// SQL database session Store implementation.
+type sqlStore struct {
+	db      *sql.DB     // Database handle
+	dialect *Dialect    // Dialect of the database
+	table   string      // Name of the sessions table
+	codec   codec.Codec // Codec used to marshal and unmarshal a Session to a byte slice
+
+	purgeBatchSize   int           // Number of sessions to delete in one statement when purging
+	purgeMaxDuration time.Duration // Max duration of a purge
+
+	// Prepared SQL statements
+	qLoad, qTouch, qSave, qRemove, qPurge string
+
+	clock      session.Clock // Clock to decide session timeouts and to run the purge job with
+	stopPurger func()        // Function to stop the purge job, nil if it is disabled
+}
+
+// StoreOptions defines options that may be passed when creating a new SQL session Store.
+// All fields are optional except DB; default value will be used for any field that has the zero value.
+type StoreOptions struct {
+	// Database handle to use; required.
+	DB *sql.DB
+
+	// Dialect of the database; default value is SQLite.
+	Dialect *Dialect
+
+	// Name of the table to store sessions in, must be a valid SQL identifier; default value is "sessions".
+	Table string
+
+	// Codec used to marshal and unmarshal a Session to a byte slice;
+	// default value is codec.Gob (attribute types must be registered with gob.Register()).
+	Codec *codec.Codec
+
+	// Tells if the schema is to be created / migrated (with Migrate()) when the store is created;
+	// default value is false.
+	AutoMigrate bool
+
+	// Interval of the background job purging expired sessions; default value is 10 minutes.
+	// Pass a negative value to disable the background job (e.g. if PurgeExpiredSessFunc() is used from a cron job).
+	PurgeInterval time.Duration
+
+	// Number of expired sessions to delete in one statement when purging; default value is 100.
+	PurgeBatchSize int
+
+	// Max duration of a purge, after which the purge stops even if there are more expired sessions;
+	// default value is 8 minutes.
+	PurgeMaxDuration time.Duration
+
+	// Clock to decide session timeouts and to run the purge job with; default value is session.SystemClock.
+	Clock session.Clock
+}
+
+// NewStoreOptions returns a new, SQL database session Store with the specified options.
+// Unless disabled, the returned Store has a background job purging expired sessions which runs
+// in its own goroutine.
+func NewStoreOptions(o *StoreOptions) session.Store {
+	s := &sqlStore{
+		db:               o.DB,
+		dialect:          o.Dialect,
+		table:            o.Table,
+		purgeBatchSize:   o.PurgeBatchSize,
+		purgeMaxDuration: o.PurgeMaxDuration,
+		clock:            o.Clock,
+	}
+	if s.clock == nil {
+		s.clock = session.SystemClock
+	}
+	if s.dialect == nil {
+		s.dialect = SQLite
+	}
+	if s.table == "" {
+		s.table = defaultTable
+	}
+	if o.Codec != nil {
+		s.codec = *o.Codec
+	} else {
+		s.codec = codec.Gob
+	}
+	if s.purgeBatchSize <= 0 {
+		s.purgeBatchSize = 100
+	}
+	if s.purgeMaxDuration <= 0 {
+		s.purgeMaxDuration = 8 * time.Minute
+	}
+
+	d := s.dialect
+	s.qLoad = d.query(fmt.Sprintf("SELECT data, expires FROM %s WHERE id = ?", s.table))
+	s.qTouch = d.query(fmt.Sprintf("UPDATE %s SET accessed = ?, expires = ? WHERE id = ?", s.table))
+	s.qSave = fmt.Sprintf(d.upsert, s.table)
+	s.qRemove = d.query(fmt.Sprintf("DELETE FROM %s WHERE id = ?", s.table))
+	s.qPurge = fmt.Sprintf(d.purge, s.table)
+
+	if o.AutoMigrate {
+		if err := Migrate(s.db, s.dialect, s.table); err != nil {
+			log.Printf("Failed to migrate session table %s: %v", s.table, err)
+		}
+	}
+
+	interval := o.PurgeInterval
+	if interval == 0 {
+		interval = 10 * time.Minute
+	}
+	if interval > 0 {
+		s.stopPurger = s.clock.Every(interval, func() {
+			if _, err := s.purge(); err != nil {
+				log.Printf("Failed to purge expired sessions: %v", err)
+			}
+		})
+	}
+
+	return s
+}
+
+const defaultTable = "sessions" // Default value of Table.
+
+// Migrate creates or migrates the sessions table (and its index) in the database.
+// Applied migrations are recorded in the table named table + "_migrations".
+// Pass an empty table to use the default table name.
+func Migrate(db *sql.DB, dialect *Dialect, table string) error {
+	if table == "" {
+		table = defaultTable
+	}
+	mtable := table + "_migrations"
+	if _, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version INTEGER NOT NULL)", mtable)); err != nil {
+		return err
+	}
+
+	var version int
+	if err := db.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s", mtable)).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(dialect.migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(fmt.Sprintf(dialect.migrations[i], table, dialect.blobType)); err == nil {
+			_, err = tx.Exec(dialect.query(fmt.Sprintf("INSERT INTO %s (version) VALUES (?)", mtable)), i+1)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %v", i+1, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// millis converts a time to Unix milliseconds.
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Load is to implement Store.Load().
+// A new Session value is returned on each call, read from the database.
+func (s *sqlStore) Load(id string) session.Session {
+	var data []byte
+	var expires int64
+	err := s.db.QueryRow(s.qLoad, id).Scan(&data, &expires)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to load session from database, id: %s, error: %v", id, err)
+		return nil
+	}
+
+	now := s.clock.Now()
+	if millis(now) > expires {
+		// Session expired.
+		s.db.Exec(s.qRemove, id) // Omitting error check...
+		return nil
+	}
+
+	o, err := session.UnmarshalSession(s.codec, data, id)
+	if err != nil {
+		log.Printf("Failed to unmarshal session, id: %s, error: %v", id, err)
+		return nil
+	}
+	o.Clock, o.State = s.clock, session.StateLoaded
+	ss := session.NewSessionOptions(o)
+	ss.Access()
+
+	// Record the access:
+	if _, err := s.db.Exec(s.qTouch, millis(ss.Accessed()), millis(ss.Accessed().Add(ss.Timeout())), id); err != nil {
+		log.Printf("Failed to touch session in database, id: %s, error: %v", id, err)
+	}
+	return ss
+}
+
+// Save is to implement Store.Save().
+func (s *sqlStore) Save(sess session.Session) {
+	// Marshal the session value itself (its exported fields), holding its read lock:
+	mux := sess.Mutex()
+	mux.RLock()
+	data, err := s.codec.Marshal(sess)
+	mux.RUnlock()
+	if err != nil {
+		log.Printf("Failed to marshal session, id: %s, error: %v", sess.ID(), err)
+		return
+	}
+
+	accessed := sess.Accessed()
+	_, err = s.db.Exec(s.qSave, sess.ID(), data, millis(sess.Created()), millis(accessed), millis(accessed.Add(sess.Timeout())))
+	if err != nil {
+		log.Printf("Failed to save session to database, id: %s, error: %v", sess.ID(), err)
+	}
+}
+
+// Remove is to implement Store.Remove().
+func (s *sqlStore) Remove(sess session.Session) {
+	if _, err := s.db.Exec(s.qRemove, sess.ID()); err != nil {
+		log.Printf("Failed to remove session from database, id: %s, error: %v", sess.ID(), err)
+	}
+}
+
+// Close is to implement Store.Close().
+// The database handle is not closed.
+func (s *sqlStore) Close() {
+	if s.stopPurger != nil {
+		s.stopPurger()
+	}
+}
+
+// purge deletes expired sessions in batches until there are no more,
+// or until purgeMaxDuration elapses.
+// Returns true if all expired sessions were deleted.
+func (s *sqlStore) purge() (completed bool, err error) {
+	now := s.clock.Now()
+	deadline := time.Now().Add(s.purgeMaxDuration)
+
+	for {
+		res, err := s.db.Exec(s.qPurge, millis(now), s.purgeBatchSize)
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		if n < int64(s.purgeBatchSize) {
+			// We're done, no more expired sessions
+			return true, nil
+		}
+		if time.Now().After(deadline) {
+			// Our time is up, return
+			return false, nil
+		}
+		// We have time to continue
+	}
+}
+
+// PurgeExpiredSessFunc returns a request handler function which deletes expired sessions
+// from the database of the specified store, which must be a store created by this package.
+//
+// It may be registered to a path which then can be called periodically by a cron job, in which case the
+// background purge job of the store may be disabled (see StoreOptions.PurgeInterval).
+// The handler stops after StoreOptions.PurgeMaxDuration even if there are more expired sessions.
+//
+// The response of the handler func is a JSON text telling if the handler was able to delete all expired sessions,
+// or that it was finished early due to the time. Example of a response where all expired sessions were deleted:
+//
+//	{"completed":true}
+func PurgeExpiredSessFunc(st session.Store) http.HandlerFunc {
+	s := st.(*sqlStore)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		completed, err := s.purge()
+		if err != nil {
+			log.Printf("Failed to purge expired sessions: %v", err)
+			http.Error(w, "Failed to purge expired sessions!", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"completed":%t}`, completed)
+	}
+}
@@ -0,0 +1,152 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/go-osin/session"
+	"github.com/go-osin/session/clocktest"
+	"github.com/go-osin/session/sessiontest"
+)
+
+func openDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrate(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	db := openDB(t)
+	eq(nil, Migrate(db, SQLite, ""))
+	eq(nil, Migrate(db, SQLite, "")) // Migrating again is a no-op
+
+	var version int
+	eq(nil, db.QueryRow("SELECT MAX(version) FROM sessions_migrations").Scan(&version))
+	eq(len(SQLite.migrations), version)
+}
+
+func TestSQLStore(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	db := openDB(t)
+	clock := clocktest.New(time.Now())
+	st := NewStoreOptions(&StoreOptions{DB: db, AutoMigrate: true, Clock: clock})
+	defer st.Close()
+
+	eq(nil, st.Load("asdf"))
+
+	s := session.NewSessionOptions(&session.SessOptions{
+		CAttrs:  map[string]interface{}{"user": "bob"},
+		Timeout: time.Hour,
+		Clock:   clock,
+	})
+	s.Set("count", 1)
+	st.Save(s)
+
+	clock.Advance(10 * time.Millisecond)
+	s2 := st.Load(s.ID())
+	neq(nil, s2)
+	eq(s.ID(), s2.ID())
+	eq("bob", s2.Getp("user"))
+	eq(1, s2.Get("count"))
+	eq(time.Hour, s2.Timeout())
+	eq(s.Created().UnixNano(), s2.Created().UnixNano())
+	neq(s2.Accessed(), s2.Created())
+
+	s2.Set("count", 2)
+	st.Save(s2)
+	eq(2, st.Load(s.ID()).Get("count"))
+
+	st.Remove(s)
+	eq(nil, st.Load(s.ID()))
+}
+
+func TestSQLStoreExpired(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	db := openDB(t)
+	clock := clocktest.New(time.Now())
+	st := NewStoreOptions(&StoreOptions{DB: db, AutoMigrate: true, PurgeInterval: -1, Clock: clock})
+	defer st.Close()
+
+	s := session.NewSessionOptions(&session.SessOptions{Timeout: 20 * time.Millisecond, Clock: clock})
+	st.Save(s)
+	eq(s.ID(), st.Load(s.ID()).ID())
+
+	clock.Advance(30 * time.Millisecond)
+	eq(nil, st.Load(s.ID()))
+}
+
+func TestSQLStorePurge(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	db := openDB(t)
+	clock := clocktest.New(time.Now())
+	st := NewStoreOptions(&StoreOptions{DB: db, AutoMigrate: true, PurgeInterval: -1, PurgeBatchSize: 2, Clock: clock})
+	defer st.Close()
+
+	for i := 0; i < 5; i++ {
+		st.Save(session.NewSessionOptions(&session.SessOptions{Timeout: 10 * time.Millisecond, Clock: clock}))
+	}
+	live := session.NewSessionOptions(&session.SessOptions{Timeout: time.Hour, Clock: clock})
+	st.Save(live)
+
+	clock.Advance(20 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	PurgeExpiredSessFunc(st)(rec, httptest.NewRequest("GET", "/purge", nil))
+	eq(`{"completed":true}`, rec.Body.String())
+
+	var count int
+	eq(nil, db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count))
+	eq(1, count)
+	eq(live.ID(), st.Load(live.ID()).ID())
+}
+
+func TestSQLStorePurger(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	db := openDB(t)
+	clock := clocktest.New(time.Now())
+	st := NewStoreOptions(&StoreOptions{DB: db, AutoMigrate: true, PurgeInterval: 10 * time.Millisecond, Clock: clock})
+	defer st.Close()
+
+	st.Save(session.NewSessionOptions(&session.SessOptions{Timeout: 10 * time.Millisecond, Clock: clock}))
+	clock.Advance(50 * time.Millisecond)
+
+	var count int
+	eq(nil, db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count))
+	eq(0, count)
+}
+
+func TestDialectQuery(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	eq("SELECT a FROM t WHERE b = ? AND c = ?", SQLite.query("SELECT a FROM t WHERE b = ? AND c = ?"))
+	eq("SELECT a FROM t WHERE b = $1 AND c = $2", Postgres.query("SELECT a FROM t WHERE b = ? AND c = ?"))
+}
+
+func TestSQLStoreConformance(t *testing.T) {
+	db := openDB(t)
+	clock := clocktest.New(time.Now())
+	sessiontest.Run(t, &sessiontest.Options{
+		NewStore: func(t *testing.T) session.Store {
+			return NewStoreOptions(&StoreOptions{DB: db, AutoMigrate: true, PurgeInterval: 10 * time.Millisecond, Clock: clock})
+		},
+		Timeout:     400 * time.Millisecond,
+		ExpiryDelay: 10 * time.Millisecond,
+		Clock:       clock,
+	})
+}
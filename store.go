@@ -6,11 +6,20 @@ Session Store interface.
 
 package session
 
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-osin/session/codec"
+)
+
 // Store is a session store interface.
 // A session store is responsible to store sessions and make them retrievable by their IDs at the server side.
 type Store interface {
 	// Load returns the session specified by its id.
-	// The returned session will have an updated access time (set to the current time).
+	// The returned session will have an updated access time (set to the current time),
+	// and its state will be StateLoaded (unless it was modified since it was saved, see Session.State()).
 	// nil is returned if this store does not contain a session with the specified id.
 	Load(id string) Session
 
@@ -23,3 +32,96 @@ type Store interface {
 	// Close closes the session store, releasing any resources that were allocated.
 	Close()
 }
+
+// ContextStore is an optional interface a Store may implement to receive the context of the operations,
+// e.g. to report tracing spans as children of the span of the request.
+// Managers of this package use these methods if the Store implements them.
+type ContextStore interface {
+	Store
+
+	// LoadContext is like Store.Load() but with a context.
+	LoadContext(ctx context.Context, id string) Session
+
+	// SaveContext is like Store.Save() but with a context.
+	SaveContext(ctx context.Context, sess Session)
+
+	// RemoveContext is like Store.Remove() but with a context.
+	RemoveContext(ctx context.Context, sess Session)
+}
+
+// Lister is an optional interface a Store may implement to list the sessions it contains.
+type Lister interface {
+	Store
+
+	// IDs returns the IDs of the sessions in the store, in no particular order.
+	// Sessions that timed out but were not yet removed by the store may be included.
+	IDs() []string
+}
+
+// Toucher is an optional interface a Store may implement to update the access time of a session
+// without loading it, e.g. to keep a session alive.
+type Toucher interface {
+	Store
+
+	// Touch updates the access time of the session specified by its id to the current time.
+	// It returns false if this store does not contain a session with the specified id.
+	Touch(id string) bool
+}
+
+// loadContext loads a session from st, passing ctx if st implements ContextStore.
+func loadContext(ctx context.Context, st Store, id string) Session {
+	if cs, ok := st.(ContextStore); ok {
+		return cs.LoadContext(ctx, id)
+	}
+	return st.Load(id)
+}
+
+// saveContext saves a session to st, passing ctx if st implements ContextStore.
+func saveContext(ctx context.Context, st Store, sess Session) {
+	if cs, ok := st.(ContextStore); ok {
+		cs.SaveContext(ctx, sess)
+		return
+	}
+	st.Save(sess)
+}
+
+// removeContext removes a session from st, passing ctx if st implements ContextStore.
+func removeContext(ctx context.Context, st Store, sess Session) {
+	if cs, ok := st.(ContextStore); ok {
+		cs.RemoveContext(ctx, sess)
+		return
+	}
+	st.Remove(sess)
+}
+
+// ErrIDMismatch is returned by UnmarshalSession if the data is the data of another session than requested.
+var ErrIDMismatch = errors.New("session: session id mismatch")
+
+// UnmarshalSession unmarshals a session marshalled by a store with the codec c (stores marshal the Session value itself),
+// and returns the options to rebuild the session with NewSessionOptions(); Codec is set to c.
+// ErrIDMismatch is returned if data is the data of another session than the one specified by id
+// (e.g. copied by someone with access to the storage); if c binds payloads to session IDs
+// (see codec.Codec.UnmarshalID), unmarshalling such data fails with the error of c instead.
+func UnmarshalSession(c codec.Codec, data []byte, id string) (*SessOptions, error) {
+	var sess sessionImpl
+	var err error
+	if c.UnmarshalID != nil {
+		err = c.UnmarshalID(data, id, &sess)
+	} else {
+		err = c.Unmarshal(data, &sess)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sess.IDF != id {
+		return nil, fmt.Errorf("%w, stored id: %s", ErrIDMismatch, sess.IDF)
+	}
+	return &SessOptions{
+		IDF:      sess.IDF,
+		CreatedF: sess.CreatedF,
+		CAttrs:   sess.CAttrsF,
+		Attrs:    sess.AttrsF,
+		Timeout:  sess.TimeoutF,
+		Codec:    &c,
+	}, nil
+}
@@ -0,0 +1,273 @@
+/*
+
+A tiered session store implementation: a fast front store in front of a durable back store.
+
+*/
+
+package session
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Tiered session Store implementation.
+type tieredStore struct {
+	front Store // Fast store, checked first
+	back  Store // Durable store, the source of truth
+
+	promote     bool // Tells if sessions loaded from back are to be saved in front
+	writeBehind bool // Tells if saving to back happens asynchronously
+
+	// Write-behind state, only used if writeBehind is true:
+	pmux    sync.Mutex         // mutex to synchronize access to pending
+	pending map[string]Session // Sessions waiting to be saved to back (mapped from ID)
+	wake    chan struct{}      // Channel to signal the writer that there are pending sessions
+	done    chan struct{}      // Channel to signal close for the writer
+	stopped chan struct{}      // Channel closed when the writer returned
+	wmux    sync.Mutex         // mutex held while the writer saves a batch, so removals don't race with them
+
+	clock     Clock                // Clock to throttle refreshes in back with
+	rmux      sync.Mutex           // mutex to synchronize access to refreshed and pruneAt
+	refreshed map[string]time.Time // Times until sessions need no refresh in back (mapped from ID)
+	pruneAt   int                  // Size of refreshed at which passed times are pruned
+
+	closeOnce sync.Once // To close only once
+}
+
+// TieredStoreOptions defines options that may be passed when creating a new tiered Store.
+// All fields are optional; default value will be used for any field that has the zero value.
+type TieredStoreOptions struct {
+	// Tells if saving to the back store is to happen asynchronously in a background goroutine (write-behind);
+	// default value is false which means sessions are saved to the back store synchronously (write-through).
+	// With write-behind, repeated saves of a session are coalesced, and pending saves are flushed when the store is closed;
+	// sessions saved since the last flush are lost if the process crashes.
+	WriteBehind bool
+
+	// Tells if sessions loaded from the back store are not to be saved in the front store;
+	// default value is false which means sessions found in the back store are promoted to the front store.
+	NoPromotion bool
+
+	// Clock to throttle keeping sessions alive in the back store with; default value is SystemClock.
+	Clock Clock
+}
+
+// Pointer to zero value of TieredStoreOptions to be reused for efficiency.
+var zeroTieredStoreOptions = new(TieredStoreOptions)
+
+// TieredStore returns a new Store which composes a fast front store (e.g. an in-memory store)
+// in front of a durable back store (e.g. a Redis or SQL store).
+// o may be nil, in which case default options are used (see TieredStoreOptions).
+//
+// Load() checks the front store first, and reads through to the back store on a miss.
+// On a hit in the front store, the session is kept alive in the back store too, so back stores with their own
+// expiration (e.g. Redis, memcached or SQL stores) don't expire sessions which are only read: it is touched
+// if the back store implements Toucher, else it is saved to the back store (asynchronously with write-behind).
+// This is throttled: a session is only kept alive in the back store if more than half of its timeout passed
+// since it was last saved or kept alive there, so front hits rarely reach the back store.
+// Save() saves to both stores, Remove() removes from both stores.
+// Context-aware stores (ContextStore) receive the context of the operations.
+// Closing the returned store closes both the front and the back stores.
+func TieredStore(front, back Store, o *TieredStoreOptions) Store {
+	if o == nil {
+		o = zeroTieredStoreOptions
+	}
+	s := &tieredStore{
+		front:       front,
+		back:        back,
+		promote:     !o.NoPromotion,
+		writeBehind: o.WriteBehind,
+		clock:       clockOrSystem(o.Clock),
+		refreshed:   make(map[string]time.Time),
+		pruneAt:     minPruneAt,
+	}
+	if s.writeBehind {
+		s.pending = make(map[string]Session)
+		s.wake = make(chan struct{}, 1)
+		s.done = make(chan struct{})
+		s.stopped = make(chan struct{})
+		go s.writer()
+	}
+	return s
+}
+
+// Load is to implement Store.Load().
+func (s *tieredStore) Load(id string) Session {
+	return s.LoadContext(context.Background(), id)
+}
+
+// LoadContext is to implement ContextStore.LoadContext().
+func (s *tieredStore) LoadContext(ctx context.Context, id string) Session {
+	if sess := loadContext(ctx, s.front, id); sess != nil {
+		s.refresh(ctx, sess)
+		return sess
+	}
+
+	if s.writeBehind {
+		// A session waiting to be written might have been evicted from front:
+		s.pmux.Lock()
+		sess := s.pending[id]
+		s.pmux.Unlock()
+		if sess != nil {
+			sess.Access()
+			if s.promote {
+				saveContext(ctx, s.front, sess)
+			}
+			return sess
+		}
+	}
+
+	sess := loadContext(ctx, s.back, id)
+	if sess != nil && s.promote {
+		saveContext(ctx, s.front, sess)
+	}
+	return sess
+}
+
+// Save is to implement Store.Save().
+func (s *tieredStore) Save(sess Session) {
+	s.SaveContext(context.Background(), sess)
+}
+
+// SaveContext is to implement ContextStore.SaveContext().
+func (s *tieredStore) SaveContext(ctx context.Context, sess Session) {
+	saveContext(ctx, s.front, sess)
+	s.kept(sess)
+
+	if !s.writeBehind {
+		saveContext(ctx, s.back, sess)
+		return
+	}
+	s.enqueue(sess)
+}
+
+// refresh keeps a session loaded from the front store alive in the back store,
+// if more than half of its timeout passed since it was last saved or kept alive there.
+func (s *tieredStore) refresh(ctx context.Context, sess Session) {
+	s.rmux.Lock()
+	until, ok := s.refreshed[sess.ID()]
+	s.rmux.Unlock()
+	if ok && s.clock.Now().Before(until) {
+		return
+	}
+
+	defer s.kept(sess)
+	if t, ok := s.back.(Toucher); ok && t.Touch(sess.ID()) {
+		return
+	}
+	// Back can't touch or lost the session (e.g. write-behind save still pending), save it:
+	if s.writeBehind {
+		s.enqueue(sess)
+	} else {
+		saveContext(ctx, s.back, sess)
+	}
+}
+
+// minPruneAt is the minimum size of tieredStore.refreshed at which passed times are pruned.
+const minPruneAt = 1024
+
+// kept records that the session was saved or kept alive in the back store now,
+// so it needs no refresh until half of its timeout passes.
+func (s *tieredStore) kept(sess Session) {
+	now := s.clock.Now()
+
+	s.rmux.Lock()
+	defer s.rmux.Unlock()
+
+	s.refreshed[sess.ID()] = now.Add(sess.Timeout() / 2)
+	if len(s.refreshed) < s.pruneAt {
+		return
+	}
+	// Passed times are the same as missing ones, prune them (e.g. of sessions which timed out):
+	for id, until := range s.refreshed {
+		if now.After(until) {
+			delete(s.refreshed, id)
+		}
+	}
+	if s.pruneAt = 2 * len(s.refreshed); s.pruneAt < minPruneAt {
+		s.pruneAt = minPruneAt
+	}
+}
+
+// enqueue adds a session to the pending write-behind saves, and signals the writer.
+func (s *tieredStore) enqueue(sess Session) {
+	s.pmux.Lock()
+	s.pending[sess.ID()] = sess
+	s.pmux.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default: // Writer is already signaled
+	}
+}
+
+// Remove is to implement Store.Remove().
+func (s *tieredStore) Remove(sess Session) {
+	s.RemoveContext(context.Background(), sess)
+}
+
+// RemoveContext is to implement ContextStore.RemoveContext().
+func (s *tieredStore) RemoveContext(ctx context.Context, sess Session) {
+	removeContext(ctx, s.front, sess)
+
+	s.rmux.Lock()
+	delete(s.refreshed, sess.ID())
+	s.rmux.Unlock()
+
+	if s.writeBehind {
+		s.pmux.Lock()
+		delete(s.pending, sess.ID())
+		s.pmux.Unlock()
+
+		// Wait for a batch being written (which might contain sess) so it can't resurrect sess in back:
+		s.wmux.Lock()
+		defer s.wmux.Unlock()
+	}
+	removeContext(ctx, s.back, sess)
+}
+
+// writer saves pending sessions to the back store in an endless loop.
+// This method is to be started as a new goroutine.
+func (s *tieredStore) writer() {
+	defer close(s.stopped)
+
+	for {
+		select {
+		case <-s.done:
+			// We are being shut down, flush what's left...
+			s.flush()
+			return
+		case <-s.wake:
+			s.flush()
+		}
+	}
+}
+
+// flush saves pending sessions to the back store.
+func (s *tieredStore) flush() {
+	s.wmux.Lock()
+	defer s.wmux.Unlock()
+
+	s.pmux.Lock()
+	batch := s.pending
+	s.pending = make(map[string]Session, len(batch))
+	s.pmux.Unlock()
+
+	for _, sess := range batch {
+		s.back.Save(sess)
+	}
+}
+
+// Close is to implement Store.Close().
+// Pending write-behind saves are flushed, and both the front and the back stores are closed.
+func (s *tieredStore) Close() {
+	s.closeOnce.Do(func() {
+		if s.writeBehind {
+			close(s.done)
+			<-s.stopped
+		}
+		s.front.Close()
+		s.back.Close()
+	})
+}
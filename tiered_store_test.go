@@ -0,0 +1,225 @@
+package session
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-osin/session/clocktest"
+	"github.com/icza/mighty"
+)
+
+// countingStore is a Store which counts the operations of the wrapped Store.
+type countingStore struct {
+	Store
+
+	mux                  sync.Mutex
+	loads, saves, closes int
+}
+
+func (s *countingStore) Load(id string) Session {
+	s.mux.Lock()
+	s.loads++
+	s.mux.Unlock()
+	return s.Store.Load(id)
+}
+
+func (s *countingStore) Save(sess Session) {
+	s.mux.Lock()
+	s.saves++
+	s.mux.Unlock()
+	s.Store.Save(sess)
+}
+
+func (s *countingStore) Close() {
+	s.closes++
+	s.Store.Close()
+}
+
+func (s *countingStore) counts() (loads, saves int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.loads, s.saves
+}
+
+func TestTieredStore(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	front := &countingStore{Store: NewInMemStore()}
+	back := &countingStore{Store: NewInMemStore()}
+	st := TieredStore(front, back, nil)
+
+	eq(nil, st.Load("asdf"))
+
+	// Write-through:
+	s := NewSession()
+	st.Save(s)
+	eq(s, front.Store.Load(s.ID()))
+	eq(s, back.Store.Load(s.ID()))
+
+	// Hit in front doesn't load from back, and doesn't refresh the session in back right after it was saved:
+	eq(s, st.Load(s.ID()))
+	loads, saves := back.counts()
+	eq(1, loads) // The miss of "asdf"
+	eq(1, saves)
+
+	// Read-through with promotion:
+	front.Store.Remove(s)
+	eq(s, st.Load(s.ID()))
+	eq(s, front.Store.Load(s.ID()))
+
+	st.Remove(s)
+	eq(nil, front.Store.Load(s.ID()))
+	eq(nil, back.Store.Load(s.ID()))
+	eq(nil, st.Load(s.ID()))
+
+	st.Close()
+	st.Close()
+	eq(1, front.closes)
+	eq(1, back.closes)
+}
+
+func TestTieredStoreNoPromotion(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	front, back := NewInMemStore(), NewInMemStore()
+	st := TieredStore(front, back, &TieredStoreOptions{NoPromotion: true})
+	defer st.Close()
+
+	s := NewSession()
+	back.Save(s)
+	eq(s, st.Load(s.ID()))
+	eq(nil, front.Load(s.ID()))
+}
+
+func TestTieredStoreWriteBehind(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	front := NewInMemStore()
+	back := &countingStore{Store: NewInMemStore()}
+	st := TieredStore(front, back, &TieredStoreOptions{WriteBehind: true})
+
+	ss := []Session{NewSession(), NewSession(), NewSession()}
+	for i := 0; i < 10; i++ {
+		for _, s := range ss {
+			st.Save(s)
+		}
+	}
+	st.Remove(ss[2])
+
+	// Pending sessions are found even if front lost them:
+	front.Remove(ss[0])
+	eq(ss[0], st.Load(ss[0].ID()))
+
+	st.Close() // Flushes pending saves
+	eq(ss[0], back.Store.Load(ss[0].ID()))
+	eq(ss[1], back.Store.Load(ss[1].ID()))
+	eq(nil, back.Store.Load(ss[2].ID()))
+
+	_, saves := back.counts()
+	eq(true, saves <= 30) // Coalesced
+}
+
+// ttlStore is a Store expiring sessions after their timeout since they were last saved or touched
+// (like Redis or memcached), independently of their access time.
+type ttlStore struct {
+	clock *clocktest.Clock
+
+	mux      sync.Mutex
+	sessions map[string]Session
+	expires  map[string]time.Time
+	saves    int
+}
+
+func newTTLStore(clock *clocktest.Clock) *ttlStore {
+	return &ttlStore{clock: clock, sessions: map[string]Session{}, expires: map[string]time.Time{}}
+}
+
+func (s *ttlStore) Load(id string) Session {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.clock.Now().After(s.expires[id]) {
+		return nil
+	}
+	return s.sessions[id]
+}
+
+func (s *ttlStore) Save(sess Session) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.sessions[sess.ID()] = sess
+	s.saves++
+	s.expires[sess.ID()] = s.clock.Now().Add(sess.Timeout())
+}
+
+func (s *ttlStore) Remove(sess Session) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.sessions, sess.ID())
+	delete(s.expires, sess.ID())
+}
+
+func (s *ttlStore) Close() {}
+
+// touchingTTLStore is a ttlStore which implements Toucher.
+type touchingTTLStore struct {
+	*ttlStore
+	touches int
+}
+
+func (s *touchingTTLStore) Touch(id string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.clock.Now().After(s.expires[id]) {
+		return false
+	}
+	s.expires[id] = s.clock.Now().Add(s.sessions[id].Timeout())
+	s.touches++
+	return true
+}
+
+func TestTieredStoreRefreshBack(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	clock := clocktest.New(time.Now())
+	touching := &touchingTTLStore{ttlStore: newTTLStore(clock)}
+
+	for _, c := range []struct {
+		name        string
+		back        Store
+		writeBehind bool
+	}{
+		{"save", newTTLStore(clock), false},
+		{"save-write-behind", newTTLStore(clock), true},
+		{"touch", touching, false},
+	} {
+		front := NewInMemStoreOptions(&InMemStoreOptions{Clock: clock})
+		st := TieredStore(front, c.back, &TieredStoreOptions{WriteBehind: c.writeBehind, Clock: clock})
+
+		s := NewSessionOptions(&SessOptions{Clock: clock, Timeout: 100 * time.Millisecond})
+		st.Save(s)
+
+		// Only read (hits in front) for longer than the timeout:
+		for i := 0; i < 6; i++ {
+			clock.Advance(30 * time.Millisecond)
+			eq(s, st.Load(s.ID()))
+		}
+		st.Close() // Flushes pending saves
+
+		// If front loses the session (e.g. restart), it's still alive in back:
+		if c.back.Load(s.ID()) != s {
+			t.Errorf("[%s] Session expired in back", c.name)
+		}
+
+		// Refreshed only after half of the timeout passed (at 60, 120 and 180 ms):
+		switch {
+		case c.back == touching:
+			eq(1, touching.saves)
+		case c.writeBehind:
+			eq(true, c.back.(*ttlStore).saves <= 4) // Coalesced
+		default:
+			eq(4, c.back.(*ttlStore).saves)
+		}
+	}
+	eq(3, touching.touches)
+}
@@ -0,0 +1,139 @@
+/*
+
+Time based indices of sessions.
+
+*/
+
+package session
+
+import (
+	"container/heap"
+	"time"
+)
+
+// timeItem is an entry of a timeIndex.
+type timeItem struct {
+	sess  Session   // The indexed session
+	key   time.Time // Indexed key; the actual key of the session is not before this
+	index int       // Index of the item in the heap, maintained by the heap.Interface methods
+}
+
+// timeHeap is a min-heap of sessions ordered by their indexed keys.
+// It implements heap.Interface.
+type timeHeap []*timeItem
+
+func (h timeHeap) Len() int           { return len(h) }
+func (h timeHeap) Less(i, j int) bool { return h[i].key.Before(h[j].key) }
+
+func (h timeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timeHeap) Push(x interface{}) {
+	item := x.(*timeItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *timeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil // Don't keep the item reachable
+	item.index = -1
+	*h = old[:n-1]
+	return item
+}
+
+// timeIndex indexes sessions by a time key derived from the session which may only increase,
+// such as the expiration time (last accessed time + timeout) or the last accessed time.
+// It allows finding expired or least recently used sessions without scanning all sessions.
+//
+// Session.Access() may be called without the index knowing about it, so the index is refreshed lazily:
+// an indexed key is only a lower bound. When an item reaches the top of the heap, its actual key
+// is checked, and if the session was accessed in the meantime, the item is moved to its new position.
+// So a sweep only touches sessions whose indexed key has passed.
+//
+// timeIndex is not safe for concurrent use.
+type timeIndex struct {
+	keyf  func(Session) time.Time // Function to derive the key of a session
+	h     timeHeap                // Min-heap of items
+	items map[string]*timeItem    // Items mapped from session ID
+}
+
+// newTimeIndex returns a new, empty timeIndex using the specified key function.
+func newTimeIndex(keyf func(Session) time.Time) *timeIndex {
+	return &timeIndex{keyf: keyf, items: make(map[string]*timeItem)}
+}
+
+// expiresAt returns the expiration time of a session.
+func expiresAt(sess Session) time.Time {
+	return sess.Accessed().Add(sess.Timeout())
+}
+
+// accessedAt returns the last accessed time of a session.
+func accessedAt(sess Session) time.Time {
+	return sess.Accessed()
+}
+
+// set adds the session to the index, or updates its key if it is already indexed.
+func (x *timeIndex) set(sess Session) {
+	if item := x.items[sess.ID()]; item != nil {
+		item.sess = sess
+		item.key = x.keyf(sess)
+		heap.Fix(&x.h, item.index)
+		return
+	}
+	item := &timeItem{sess: sess, key: x.keyf(sess)}
+	x.items[sess.ID()] = item
+	heap.Push(&x.h, item)
+}
+
+// remove removes the session specified by its ID from the index.
+func (x *timeIndex) remove(id string) {
+	if item := x.items[id]; item != nil {
+		heap.Remove(&x.h, item.index)
+		delete(x.items, id)
+	}
+}
+
+// due tells if there might be sessions whose keys are before the specified time.
+func (x *timeIndex) due(now time.Time) bool {
+	return len(x.h) > 0 && now.After(x.h[0].key)
+}
+
+// popExpired removes and returns the sessions whose keys are before the specified time.
+// Items of sessions which were accessed since they were indexed are moved to their new position.
+func (x *timeIndex) popExpired(now time.Time) (expired []Session) {
+	for x.due(now) {
+		item := x.h[0]
+		if key := x.keyf(item.sess); now.After(key) {
+			heap.Pop(&x.h)
+			delete(x.items, item.sess.ID())
+			expired = append(expired, item.sess)
+		} else {
+			item.key = key
+			heap.Fix(&x.h, 0)
+		}
+	}
+	return
+}
+
+// popMin removes and returns the session with the smallest actual key, nil if the index is empty.
+// Items of sessions which were accessed since they were indexed are moved to their new position.
+func (x *timeIndex) popMin() Session {
+	for len(x.h) > 0 {
+		item := x.h[0]
+		if key := x.keyf(item.sess); key.After(item.key) {
+			item.key = key
+			heap.Fix(&x.h, 0)
+			continue
+		}
+		heap.Pop(&x.h)
+		delete(x.items, item.sess.ID())
+		return item.sess
+	}
+	return nil
+}
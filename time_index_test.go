@@ -0,0 +1,67 @@
+package session
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+)
+
+func TestTimeIndex(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	x := newTimeIndex(expiresAt)
+	now := time.Now()
+	var ss []Session
+	for i := 0; i < 10; i++ {
+		s := NewSessionOptions(&SessOptions{IDF: strconv.Itoa(i), Timeout: time.Duration(10-i) * time.Minute})
+		ss = append(ss, s)
+		x.set(s)
+	}
+
+	eq(false, x.due(now))
+	eq(0, len(x.popExpired(now)))
+
+	// Sessions with the smallest timeouts expire first:
+	expired := x.popExpired(now.Add(3*time.Minute + time.Second))
+	eq(3, len(expired))
+	eq(ss[9], expired[0])
+	eq(ss[8], expired[1])
+	eq(ss[7], expired[2])
+	eq(7, len(x.items))
+
+	// Accessed session is not removed but reindexed:
+	ss[6].(*sessionImpl).AccessedF = now.Add(time.Hour)
+	expired = x.popExpired(now.Add(4*time.Minute + time.Second))
+	eq(0, len(expired))
+	eq(false, x.due(now.Add(4*time.Minute+time.Second)))
+	eq(true, x.items["6"].key.After(now.Add(time.Hour)))
+
+	x.remove("0")
+	x.remove("nonexistent")
+	eq(6, len(x.items))
+	eq(6, len(x.h))
+
+	expired = x.popExpired(now.Add(2 * time.Hour))
+	eq(6, len(expired))
+	eq(0, len(x.items))
+	eq(false, x.due(now.Add(3*time.Hour)))
+}
+
+func BenchmarkInMemStoreSweep(b *testing.B) {
+	st := NewInMemStore().(*inMemStore)
+	defer st.Close()
+
+	for i := 0; i < 100000; i++ {
+		sess := NewSession()
+		st.sessions[sess.ID()] = sess
+		st.expiry.set(sess)
+	}
+	now := time.Now()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		st.sweep(now)
+	}
+}
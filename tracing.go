@@ -0,0 +1,151 @@
+/*
+
+Tracing hook interface for session operations.
+
+*/
+
+package session
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Tracer is a small tracing interface used to create spans around session operations,
+// so session latency appears inside request traces.
+// It can be implemented by an adapter of OpenTelemetry or of any other tracing library.
+// Implementations must be safe for concurrent use.
+type Tracer interface {
+	// Start starts a new span with the specified name as a child of the span carried by ctx (if any),
+	// and returns a Context carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span created by a Tracer.
+type Span interface {
+	// SetAttr sets an attribute of the span.
+	SetAttr(key string, value interface{})
+
+	// End ends the span.
+	End()
+}
+
+// Span attribute keys set by the implementations of this package.
+const (
+	// AttrSessionIDHash is the hash of the session ID (see SessionIDHash()); the ID itself is never recorded.
+	AttrSessionIDHash = "session.id_hash"
+
+	// AttrStore is the type of the store, e.g. "inmem" or "redicache".
+	AttrStore = "session.store"
+
+	// AttrHit tells if a session was found by a load operation.
+	AttrHit = "session.hit"
+
+	// AttrRetry is the number of retries performed by an operation against a backend.
+	AttrRetry = "session.retry_attempt"
+)
+
+// NopTracer is a Tracer implementation whose spans do nothing.
+// This is the default used when no Tracer is specified in options.
+var NopTracer Tracer = nopTracer{}
+
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttr(string, interface{}) {}
+func (nopSpan) End()                        {}
+
+// SessionIDHash returns a hash of the session ID which is safe to be recorded in traces and logs
+// without exposing the session ID itself.
+func SessionIDHash(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// SpanRecorder is a Tracer implementation which records spans in memory.
+// It is intended for testing.
+type SpanRecorder struct {
+	mux   sync.Mutex      // mutex to synchronize access to spans
+	spans []*RecordedSpan // Recorded spans in the order they were started
+}
+
+// RecordedSpan is a span recorded by SpanRecorder.
+type RecordedSpan struct {
+	Name   string                 // Name of the span
+	Parent *RecordedSpan          // Parent span, nil if the span is a root span
+	Attrs  map[string]interface{} // Attributes of the span
+	Start  time.Time              // Start time
+	End    time.Time              // End time, zero if the span has not yet ended
+}
+
+// Key to use when storing the current RecordedSpan in a Context.
+type ctxKeyRecordedSpan int
+
+// Start is to implement Tracer.Start().
+func (r *SpanRecorder) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(ctxKeyRecordedSpan(0)).(*RecordedSpan)
+	rs := &RecordedSpan{
+		Name:   name,
+		Parent: parent,
+		Attrs:  make(map[string]interface{}),
+		Start:  time.Now(),
+	}
+
+	r.mux.Lock()
+	r.spans = append(r.spans, rs)
+	r.mux.Unlock()
+
+	return context.WithValue(ctx, ctxKeyRecordedSpan(0), rs), &recSpan{r: r, rs: rs}
+}
+
+// Spans returns copies of the recorded spans in the order they were started.
+func (r *SpanRecorder) Spans() []RecordedSpan {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	spans := make([]RecordedSpan, len(r.spans))
+	for i, rs := range r.spans {
+		spans[i] = *rs
+		spans[i].Attrs = make(map[string]interface{}, len(rs.Attrs))
+		for k, v := range rs.Attrs {
+			spans[i].Attrs[k] = v
+		}
+	}
+	return spans
+}
+
+// Reset discards all recorded spans.
+func (r *SpanRecorder) Reset() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.spans = nil
+}
+
+// recSpan is the Span implementation of SpanRecorder.
+type recSpan struct {
+	r  *SpanRecorder
+	rs *RecordedSpan
+}
+
+func (s *recSpan) SetAttr(key string, value interface{}) {
+	s.r.mux.Lock()
+	defer s.r.mux.Unlock()
+
+	s.rs.Attrs[key] = value
+}
+
+func (s *recSpan) End() {
+	s.r.mux.Lock()
+	defer s.r.mux.Unlock()
+
+	s.rs.End = time.Now()
+}
@@ -0,0 +1,57 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/icza/mighty"
+)
+
+func TestTracing(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	rec := &SpanRecorder{}
+	st := NewInMemStoreOptions(&InMemStoreOptions{Tracer: rec})
+	mgr := NewCookieManagerOptions(st, &CookieMngrOptions{AllowHTTP: true, Tracer: rec})
+	defer mgr.Close()
+
+	sess := NewSession()
+	mgr.Save(sess, httptest.NewRecorder())
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sessid", Value: sess.ID()})
+	eq(sess, mgr.Load(r))
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sessid", Value: NewSession().ID()}) // Unknown
+	eq(nil, mgr.Load(r))
+
+	spans := rec.Spans()
+	eq(6, len(spans))
+
+	names := []string{
+		"session.Manager.Save", "session.Store.Save",
+		"session.Manager.Load", "session.Store.Load",
+		"session.Manager.Load", "session.Store.Load",
+	}
+	for i, s := range spans {
+		eq(names[i], s.Name)
+		eq(false, s.End.IsZero())
+		if i%2 == 0 {
+			eq(true, s.Parent == nil)
+		} else {
+			eq(spans[i-1].Name, s.Parent.Name)
+			eq("inmem", s.Attrs[AttrStore])
+		}
+	}
+
+	eq(SessionIDHash(sess.ID()), spans[1].Attrs[AttrSessionIDHash])
+	neq(sess.ID(), spans[1].Attrs[AttrSessionIDHash])
+	eq(true, spans[3].Attrs[AttrHit])
+	eq(false, spans[5].Attrs[AttrHit])
+	eq(false, spans[4].Attrs[AttrHit])
+
+	rec.Reset()
+	eq(0, len(rec.Spans()))
+}
@@ -0,0 +1,37 @@
+/*
+
+Registry of attribute types.
+
+*/
+
+package session
+
+import (
+	"encoding/gob"
+	"reflect"
+
+	"github.com/go-osin/session/codec"
+)
+
+// RegisterType registers the attribute type T under name with all codecs that need it:
+// with gob (see gob.RegisterName()) and with the codec package (see codec.RegisterType()),
+// used by the MsgPack and CBOR codecs.
+//
+// Values of custom types stored as attributes must have their types registered, else they can't be
+// marshalled by these codecs (see Session.TrySet() to detect this when setting attributes).
+// Note that T and *T are different types: register the one you store in sessions.
+// The name must be the same in all processes sharing a store, and must not be changed later
+// as it is saved along with the values.
+//
+// Registering the same type under the same name multiple times is allowed,
+// but RegisterType panics if T is an interface type, or if the name or the type is
+// already registered differently.
+// It should be called from init functions.
+func RegisterType[T any](name string) {
+	var v T
+	if reflect.TypeOf(v) == nil {
+		panic("session: RegisterType with interface type")
+	}
+	gob.RegisterName(name, v)
+	codec.RegisterType(name, v)
+}
@@ -0,0 +1,39 @@
+package session
+
+import (
+	"testing"
+
+	"github.com/go-osin/session/codec"
+	"github.com/icza/mighty"
+)
+
+type registeredAttr struct {
+	Name string
+}
+
+func init() {
+	RegisterType[*registeredAttr]("session.registeredAttr")
+}
+
+func TestRegisterType(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	panics := func(f func()) (p bool) {
+		defer func() { p = recover() != nil }()
+		f()
+		return
+	}
+
+	RegisterType[*registeredAttr]("session.registeredAttr") // Same registration is allowed
+	eq(true, panics(func() { RegisterType[*registeredAttr]("other") }))
+	eq(true, panics(func() { RegisterType[interface{}]("iface") }))
+
+	// Registered values round-trip in attributes with all codecs requiring registration:
+	for _, c := range []codec.Codec{codec.Gob, codec.MsgPack, codec.CBOR} {
+		data, err := c.Marshal(&attrCheck{V: &registeredAttr{Name: "x"}})
+		eq(nil, err)
+		var out attrCheck
+		eq(nil, c.Unmarshal(data, &out))
+		eq("x", out.V.(*registeredAttr).Name)
+	}
+}